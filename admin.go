@@ -0,0 +1,610 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+const (
+	settingRequire2FA = "require_2fa"
+	csrfField         = "csrf_token"
+)
+
+var (
+	// adminNames are always treated as administrators, so that a fresh
+	// deployment has someone who can grant the role to others.
+	adminNames []string
+)
+
+type UserStatus struct {
+	UserID            int64      `db:"user_id"`
+	IsAdmin           bool       `db:"is_admin"`
+	Banned            bool       `db:"banned"`
+	SuspendedUntil    *time.Time `db:"suspended_until"`
+	Reason            string     `db:"reason"`
+	SessionsRevokedAt *time.Time `db:"sessions_revoked_at"`
+}
+
+// Blocked reports whether the account may not be used at t.
+func (s *UserStatus) Blocked(t time.Time) bool {
+	return s.Banned || (s.SuspendedUntil != nil && t.Before(*s.SuspendedUntil))
+}
+
+// SessionRevoked reports whether a session that logged in at loginAt
+// (unix seconds) has been invalidated.
+func (s *UserStatus) SessionRevoked(loginAt int64) bool {
+	return s.SessionsRevokedAt != nil && loginAt <= s.SessionsRevokedAt.Unix()
+}
+
+func isAdminName(name string) bool {
+	for _, n := range adminNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func getUserStatus(txn *Transaction, userID int64) (*UserStatus, error) {
+	st, err := userStore.Status(txn, userID)
+	if err != nil {
+		txn.Error("Failed to getUserStatus:", err)
+		return nil, err
+	}
+	return st, nil
+}
+
+func getSetting(txn *Transaction, name string) (string, error) {
+	return settingStore.Get(txn, name)
+}
+
+func setSetting(txn *Transaction, name, value string) error {
+	return settingStore.Set(txn, name, value)
+}
+
+// ensureAdmin is ensureLogin for the admin area. Anything but a GET must
+// carry the session's CSRF token.
+func ensureAdmin(c echo.Context) (*User, error) {
+	user, err := ensureLogin(c)
+	if user == nil {
+		return nil, err
+	}
+	if !user.IsAdmin {
+		return nil, echo.ErrForbidden
+	}
+	if c.Request().Method != http.MethodGet && !validCSRF(c) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "invalid CSRF token")
+	}
+	return user, nil
+}
+
+// csrfToken returns the session's token for admin and webhook forms,
+// creating it on first use. Login and logout drop it.
+func csrfToken(c echo.Context) string {
+	sess, _ := session.Get("session", c)
+	if t, ok := sess.Values[csrfField].(string); ok && t != "" {
+		return t
+	}
+	t := randomToken()
+	sess.Values[csrfField] = t
+	sess.Save(c.Request(), c.Response())
+	return t
+}
+
+// validCSRF reports whether the form carries the session's token.
+func validCSRF(c echo.Context) bool {
+	sess, _ := session.Get("session", c)
+	want, _ := sess.Values[csrfField].(string)
+	got := c.FormValue(csrfField)
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// confirmed renders a confirmation page for a destructive admin action
+// unless the form was already submitted from that page.
+func confirmed(c echo.Context, self *User, channels []ChannelInfo, summary string) (bool, error) {
+	if c.FormValue("confirm") == "1" {
+		return true, nil
+	}
+	params, err := c.FormParams()
+	if err != nil {
+		return false, err
+	}
+	fields := map[string]string{}
+	for k, v := range params {
+		if len(v) > 0 {
+			fields[k] = v[0]
+		}
+	}
+	return false, c.Render(http.StatusOK, "admin_confirm", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  channels,
+		"User":      self,
+		"Action":    c.Request().URL.Path,
+		"Summary":   summary,
+		"Fields":    fields,
+	})
+}
+
+func targetUser(txn *Transaction, c echo.Context) (*User, error) {
+	userID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil {
+		return nil, ErrBadReqeust
+	}
+	user, err := getUser(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, echo.ErrNotFound
+	}
+	return user, nil
+}
+
+func upsertUserStatus(txn *Transaction, userID int64, set string, args ...interface{}) error {
+	s := StartMySQLSegment(txn, "user_status", "INSERT")
+	_, err := db.Exec("INSERT IGNORE INTO user_status (user_id) VALUES (?)", userID)
+	s.End()
+	if err != nil {
+		return err
+	}
+	s2 := StartMySQLSegment(txn, "user_status", "UPDATE")
+	_, err = db.Exec("UPDATE user_status SET "+set+" WHERE user_id = ?", append(args, userID)...)
+	s2.End()
+	return err
+}
+
+func redirectAdminUsers(c echo.Context) error {
+	if back := c.FormValue("back"); strings.HasPrefix(back, "/admin/") {
+		return c.Redirect(http.StatusSeeOther, back)
+	}
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
+
+// request handlers
+
+type adminUserRow struct {
+	User
+	Status UserStatus
+}
+
+func getAdmin(c echo.Context) error {
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
+
+func getAdminUsers(c echo.Context) error {
+	txn := app.StartTransaction("getAdminUsers", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	const N = 50
+	page, err := strconv.ParseInt(c.QueryParam("page"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+	q := c.QueryParam("q")
+
+	var users []User
+	s := StartMySQLSegment(txn, "user", "SELECT")
+	err = db.Select(&users,
+		"SELECT * FROM user WHERE name LIKE ? OR display_name LIKE ? ORDER BY id LIMIT ? OFFSET ?",
+		"%"+q+"%", "%"+q+"%", N+1, (page-1)*N)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to getAdminUsers1:", err)
+		return err
+	}
+	hasNext := len(users) > N
+	if hasNext {
+		users = users[:N]
+	}
+
+	rows := make([]adminUserRow, 0, len(users))
+	for _, u := range users {
+		st, err := getUserStatus(txn, u.ID)
+		if err != nil {
+			return err
+		}
+		u.IsAdmin = st.IsAdmin || isAdminName(u.Name)
+		rows = append(rows, adminUserRow{User: u, Status: *st})
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		txn.Error("Failed to getAdminUsers2:", err)
+		return err
+	}
+
+	require2FA, err := getSetting(txn, settingRequire2FA)
+	if err != nil {
+		txn.Error("Failed to getAdminUsers3:", err)
+		return err
+	}
+
+	return c.Render(http.StatusOK, "admin_users", map[string]interface{}{
+		"ChannelID":  0,
+		"Channels":   channels,
+		"User":       self,
+		"Users":      rows,
+		"Query":      q,
+		"Page":       page,
+		"HasNext":    hasNext,
+		"Require2FA": requireTOTP || require2FA == "1",
+		"Forced2FA":  requireTOTP,
+		"LogLevel":   getLogLevel().String(),
+		"LogLevels":  logLevelNames,
+		"Now":        time.Now(),
+		"Back":       c.Request().URL.RequestURI(),
+	})
+}
+
+func postAdminSuspend(c echo.Context) error {
+	txn := app.StartTransaction("postAdminSuspend", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	target, err := targetUser(txn, c)
+	if target == nil {
+		return err
+	}
+	if target.ID == self.ID {
+		return ErrBadReqeust
+	}
+	days, err := strconv.Atoi(c.FormValue("days"))
+	if err != nil || days < 1 {
+		return ErrBadReqeust
+	}
+	reason := c.FormValue("reason")
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels,
+		fmt.Sprintf("%s を %d 日間停止します。", target.Name, days))
+	if !ok {
+		return err
+	}
+
+	until := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	err = upsertUserStatus(txn, target.ID,
+		"suspended_until = ?, reason = ?, sessions_revoked_at = NOW()", until, reason)
+	if err != nil {
+		txn.Error("Failed to postAdminSuspend:", err)
+		return err
+	}
+	audit(txn, c, auditAdminSuspend, self, "user", target.ID, target.Name,
+		fmt.Sprintf("%d days: %s", days, reason))
+	return redirectAdminUsers(c)
+}
+
+func postAdminBan(c echo.Context) error {
+	txn := app.StartTransaction("postAdminBan", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	target, err := targetUser(txn, c)
+	if target == nil {
+		return err
+	}
+	if target.ID == self.ID {
+		return ErrBadReqeust
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels, fmt.Sprintf("%s を永久停止します。", target.Name))
+	if !ok {
+		return err
+	}
+
+	err = upsertUserStatus(txn, target.ID,
+		"banned = 1, reason = ?, sessions_revoked_at = NOW()", c.FormValue("reason"))
+	if err != nil {
+		txn.Error("Failed to postAdminBan:", err)
+		return err
+	}
+	audit(txn, c, auditAdminBan, self, "user", target.ID, target.Name, c.FormValue("reason"))
+	return redirectAdminUsers(c)
+}
+
+func postAdminReinstate(c echo.Context) error {
+	txn := app.StartTransaction("postAdminReinstate", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	target, err := targetUser(txn, c)
+	if target == nil {
+		return err
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels, fmt.Sprintf("%s の停止を解除します。", target.Name))
+	if !ok {
+		return err
+	}
+
+	err = upsertUserStatus(txn, target.ID, "banned = 0, suspended_until = NULL, reason = ''")
+	if err != nil {
+		txn.Error("Failed to postAdminReinstate:", err)
+		return err
+	}
+	audit(txn, c, auditAdminReinstate, self, "user", target.ID, target.Name, "")
+	return redirectAdminUsers(c)
+}
+
+func postAdminRevokeSessions(c echo.Context) error {
+	txn := app.StartTransaction("postAdminRevokeSessions", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	target, err := targetUser(txn, c)
+	if target == nil {
+		return err
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels, fmt.Sprintf("%s の全セッションをログアウトさせます。", target.Name))
+	if !ok {
+		return err
+	}
+
+	err = upsertUserStatus(txn, target.ID, "sessions_revoked_at = NOW()")
+	if err != nil {
+		txn.Error("Failed to postAdminRevokeSessions:", err)
+		return err
+	}
+	audit(txn, c, auditAdminRevoke, self, "user", target.ID, target.Name, "")
+	return redirectAdminUsers(c)
+}
+
+func postAdminRole(c echo.Context) error {
+	txn := app.StartTransaction("postAdminRole", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	target, err := targetUser(txn, c)
+	if target == nil {
+		return err
+	}
+	grant := c.FormValue("grant") == "1"
+	if !grant && target.ID == self.ID {
+		return ErrBadReqeust
+	}
+
+	summary := fmt.Sprintf("%s に管理者権限を付与します。", target.Name)
+	if !grant {
+		summary = fmt.Sprintf("%s の管理者権限を取り消します。", target.Name)
+	}
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels, summary)
+	if !ok {
+		return err
+	}
+
+	err = upsertUserStatus(txn, target.ID, "is_admin = ?", grant)
+	if err != nil {
+		txn.Error("Failed to postAdminRole:", err)
+		return err
+	}
+	audit(txn, c, auditAdminRole, self, "user", target.ID, target.Name, fmt.Sprintf("admin=%v", grant))
+	return redirectAdminUsers(c)
+}
+
+func postAdminResetName(c echo.Context) error {
+	txn := app.StartTransaction("postAdminResetName", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	target, err := targetUser(txn, c)
+	if target == nil {
+		return err
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels,
+		fmt.Sprintf("%s の表示名「%s」をユーザ名に戻します。", target.Name, target.DisplayName))
+	if !ok {
+		return err
+	}
+
+	err = userStore.SetDisplayName(txn, target.ID, target.Name)
+	if err != nil {
+		txn.Error("Failed to postAdminResetName:", err)
+		return err
+	}
+	audit(txn, c, auditAdminResetName, self, "user", target.ID, target.Name, target.DisplayName)
+	return redirectAdminUsers(c)
+}
+
+func postAdminResetAvatar(c echo.Context) error {
+	txn := app.StartTransaction("postAdminResetAvatar", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	target, err := targetUser(txn, c)
+	if target == nil {
+		return err
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels, fmt.Sprintf("%s のアイコンを自動生成のアイコンに戻します。", target.Name))
+	if !ok {
+		return err
+	}
+
+	avatar, err := generateAvatar(txn, target.Name)
+	if err != nil {
+		txn.Error("Failed to postAdminResetAvatar1:", err)
+		return err
+	}
+	err = userStore.SetAvatarIcon(txn, target.ID, avatar)
+	if err != nil {
+		txn.Error("Failed to postAdminResetAvatar2:", err)
+		return err
+	}
+	audit(txn, c, auditAdminResetIcon, self, "user", target.ID, target.Name, target.AvatarIcon)
+	return redirectAdminUsers(c)
+}
+
+func postAdminDeleteMessage(c echo.Context) error {
+	txn := app.StartTransaction("postAdminDeleteMessage", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	msgID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	m, err := messageStore.Get(txn, msgID)
+	if err != nil {
+		txn.Error("Failed to postAdminDeleteMessage1:", err)
+		return err
+	}
+	if m == nil {
+		return echo.ErrNotFound
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels, fmt.Sprintf("メッセージ #%d「%s」を削除します。", m.ID, m.Content))
+	if !ok {
+		return err
+	}
+
+	if err := messageStore.Delete(txn, m); err != nil {
+		txn.Error("Failed to postAdminDeleteMessage2:", err)
+		return err
+	}
+	notifyWebhooks(txn, m.ChannelID, webhookMessageDeleted, func() (*WebhookPayload, error) {
+		return messagePayload(txn, m)
+	})
+	audit(txn, c, auditAdminDeleteMsg, self, "message", m.ID, "",
+		fmt.Sprintf("channel %d, user %d: %s", m.ChannelID, m.UserID, m.Content))
+	if back := c.FormValue("back"); strings.HasPrefix(back, "/history/") {
+		return c.Redirect(http.StatusSeeOther, back)
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/history/%d", m.ChannelID))
+}
+
+func postAdminDeleteChannel(c echo.Context) error {
+	txn := app.StartTransaction("postAdminDeleteChannel", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	var target *ChannelInfo
+	for i := range channels {
+		if channels[i].ID == chID {
+			target = &channels[i]
+		}
+	}
+	if target == nil {
+		return echo.ErrNotFound
+	}
+	ok, err := confirmed(c, self, channels,
+		fmt.Sprintf("チャンネル「%s」とそのメッセージをすべて削除します。", target.Name))
+	if !ok {
+		return err
+	}
+
+	if err := channelStore.Delete(txn, chID); err != nil {
+		txn.Error("Failed to postAdminDeleteChannel1:", err)
+		return err
+	}
+	notifyWebhooks(txn, chID, webhookChannelDeleted, func() (*WebhookPayload, error) {
+		return &WebhookPayload{Channel: toAPIChannel(*target)}, nil
+	})
+	deactivateChannelWebhooks(txn, chID)
+	audit(txn, c, auditAdminDeleteCh, self, "channel", target.ID, target.Name, target.Description)
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
+
+func postAdminSettings(c echo.Context) error {
+	txn := app.StartTransaction("postAdminSettings", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	require := c.FormValue("require_2fa") == "1"
+
+	summary := "全ユーザに二要素認証を必須にします。"
+	if !require {
+		summary = "二要素認証の必須設定を解除します。"
+	}
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return err
+	}
+	ok, err := confirmed(c, self, channels, summary)
+	if !ok {
+		return err
+	}
+
+	value := "0"
+	if require {
+		value = "1"
+	}
+	if err := setSetting(txn, settingRequire2FA, value); err != nil {
+		txn.Error("Failed to postAdminSettings:", err)
+		return err
+	}
+	audit(txn, c, auditAdminSettings, self, "setting", 0, settingRequire2FA, value)
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+func TestCSRFToken(t *testing.T) {
+	e := echo.New()
+	e.Use(session.Middleware(sessions.NewCookieStore([]byte("test"))))
+	e.GET("/token", func(c echo.Context) error {
+		return c.String(http.StatusOK, csrfToken(c))
+	})
+	e.POST("/action", func(c echo.Context) error {
+		if !validCSRF(c) {
+			return echo.ErrForbidden
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	tc := newTestClient(t, srv)
+	token := tc.expect("GET", "/token", nil, http.StatusOK)
+	if again := tc.expect("GET", "/token", nil, http.StatusOK); again != token {
+		t.Errorf("token changed within a session: %q, then %q", token, again)
+	}
+	tc.expect("POST", "/action", url.Values{}, http.StatusForbidden)
+	tc.expect("POST", "/action", url.Values{csrfField: {token + "0"}}, http.StatusForbidden)
+	tc.expect("POST", "/action", url.Values{csrfField: {token}}, http.StatusNoContent)
+
+	// A token is only good with the session it was issued to.
+	newTestClient(t, srv).expect("POST", "/action", url.Values{csrfField: {token}}, http.StatusForbidden)
+}
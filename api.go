@@ -0,0 +1,789 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// /api/v1 serves in JSON what the HTML pages show, for clients that do
+// not want to parse templates. It uses the same session cookie as the
+// pages; POST /api/v1/session logs in.
+//
+// Conventions:
+//   - Responses are JSON. A request whose Accept header rules out
+//     application/json gets 406; request bodies are JSON or a form
+//     (multipart for uploads), anything else gets 415.
+//   - Errors have the body {"error": {"status", "code", "message",
+//     "request_id"}}. code is the status text in snake_case, e.g.
+//     "not_found", unless something more specific is known.
+//   - Lists are {"items", "total", "offset", "limit"}, paged with the
+//     offset and limit query parameters (limit 20 by default, at most
+//     100). A Link header with rel="next" points at the next page.
+//   - Messages are listed newest first; times are RFC 3339.
+
+const (
+	apiPrefix       = "/api/v1"
+	apiDefaultLimit = 20
+	apiMaxLimit     = 100
+)
+
+type APIUser struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	AvatarIcon  string `json:"avatar_icon"`
+}
+
+// APIMe is the logged-in user.
+type APIMe struct {
+	APIUser
+	IsAdmin          bool `json:"is_admin"`
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+}
+
+type APIChannel struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type APIMessage struct {
+	ID        int64     `json:"id"`
+	ChannelID int64     `json:"channel_id"`
+	User      APIUser   `json:"user"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIReadState is how far the user has read a channel; Read counts the
+// messages seen.
+type APIReadState struct {
+	ChannelID int64 `json:"channel_id"`
+	Read      int64 `json:"read"`
+	Unread    int64 `json:"unread"`
+}
+
+type APIList struct {
+	Items  interface{} `json:"items"`
+	Total  int64       `json:"total"`
+	Offset int64       `json:"offset"`
+	Limit  int64       `json:"limit"`
+}
+
+// APIErrorBody wraps every error response.
+type APIErrorBody struct {
+	Error *APIError `json:"error"`
+}
+
+type APIError struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func apiErrorCode(status int) string {
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+// apiErrorHandler writes errors under /api/ as JSON error bodies and
+// leaves the rest to next.
+func apiErrorHandler(next echo.HTTPErrorHandler) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if !strings.HasPrefix(c.Request().URL.Path, apiPrefix+"/") {
+			next(err, c)
+			return
+		}
+		if c.Response().Committed {
+			return
+		}
+		e, ok := err.(*APIError)
+		if !ok {
+			e = &APIError{Status: http.StatusInternalServerError}
+			if he, ok := err.(*echo.HTTPError); ok {
+				e.Status = he.Code
+				if he.Message != nil {
+					e.Message = fmt.Sprint(he.Message)
+				}
+			}
+		}
+		if e.Code == "" {
+			e.Code = apiErrorCode(e.Status)
+		}
+		if e.Message == "" {
+			e.Message = http.StatusText(e.Status)
+		}
+		if r := requestLogFrom(c.Request().Context()); r != nil {
+			e.RequestID = r.id
+		}
+		c.JSON(e.Status, APIErrorBody{e})
+	}
+}
+
+// acceptsJSON reports whether an Accept header allows a JSON response.
+func acceptsJSON(accept string) bool {
+	for _, r := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(r))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		switch mt {
+		case echo.MIMEApplicationJSON, "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateJSON enforces the API's content types.
+func negotiateJSON(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if accept := req.Header.Get(echo.HeaderAccept); accept != "" && !acceptsJSON(accept) {
+			return newAPIError(http.StatusNotAcceptable, "", "responses are application/json")
+		}
+		if req.ContentLength != 0 && req.Method != echo.GET && req.Method != echo.DELETE {
+			mt, _, _ := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+			switch mt {
+			case echo.MIMEApplicationJSON, echo.MIMEApplicationForm, echo.MIMEMultipartForm:
+			default:
+				return newAPIError(http.StatusUnsupportedMediaType, "",
+					"request bodies are application/json, a form or multipart/form-data")
+			}
+		}
+		c.Response().Header().Set(echo.HeaderVary, echo.HeaderAccept)
+		return next(c)
+	}
+}
+
+// apiLogin returns the logged-in user, or an error to return as is.
+func apiLogin(c echo.Context) (*User, error) {
+	txn := app.StartTransaction("apiLogin", c.Response().Writer, c.Request())
+	defer txn.End()
+	userID := sessUserID(c)
+	if userID == 0 {
+		return nil, newAPIError(http.StatusUnauthorized, "", "login required")
+	}
+	user, err := getUser(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, newAPIError(http.StatusUnauthorized, "", "login required")
+	}
+	st, err := getUserStatus(txn, userID)
+	if err != nil {
+		return nil, err
+	}
+	user.IsAdmin = st.IsAdmin || isAdminName(user.Name)
+	enroll, err := needsTOTPEnrollment(txn, c, user)
+	if err != nil {
+		return nil, err
+	}
+	if enroll {
+		return nil, newAPIError(http.StatusForbidden, "totp_enrollment_required",
+			"two-factor authentication must be set up at /2fa/setup first")
+	}
+	return user, nil
+}
+
+func toAPIUser(u *User) APIUser {
+	return APIUser{ID: u.ID, Name: u.Name, DisplayName: u.DisplayName, AvatarIcon: u.AvatarIcon}
+}
+
+func toAPIMe(txn *Transaction, u *User) (*APIMe, error) {
+	t, err := getUserTOTP(txn, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &APIMe{APIUser: toAPIUser(u), IsAdmin: u.IsAdmin, TwoFactorEnabled: t != nil}, nil
+}
+
+func toAPIChannel(ch ChannelInfo) APIChannel {
+	return APIChannel{
+		ID:          ch.ID,
+		Name:        ch.Name,
+		Description: ch.Description,
+		CreatedAt:   ch.CreatedAt,
+		UpdatedAt:   ch.UpdatedAt,
+	}
+}
+
+// apiPaging reads the offset and limit query parameters.
+func apiPaging(c echo.Context) (offset, limit int64, err error) {
+	limit = apiDefaultLimit
+	if s := c.QueryParam("offset"); s != "" {
+		offset, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, newAPIError(http.StatusBadRequest, "", "offset must be a non-negative integer")
+		}
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, newAPIError(http.StatusBadRequest, "",
+				fmt.Sprintf("limit must be between 1 and %d", apiMaxLimit))
+		}
+	}
+	return offset, limit, nil
+}
+
+// apiListResponse writes a page of a list, linking to the next one.
+func apiListResponse(c echo.Context, items interface{}, total, offset, limit int64) error {
+	if offset+limit < total {
+		u := *c.Request().URL
+		q := u.Query()
+		q.Set("offset", strconv.FormatInt(offset+limit, 10))
+		q.Set("limit", strconv.FormatInt(limit, 10))
+		u.RawQuery = q.Encode()
+		c.Response().Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI()))
+	}
+	return c.JSON(http.StatusOK, APIList{Items: items, Total: total, Offset: offset, Limit: limit})
+}
+
+func toAPIMessage(m *Message, u *User) APIMessage {
+	return APIMessage{
+		ID:        m.ID,
+		ChannelID: m.ChannelID,
+		User:      toAPIUser(u),
+		Content:   m.Content,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+// apiChannel returns the channel with the given ID.
+func apiChannel(txn *Transaction, id int64) (*ChannelInfo, error) {
+	channels, err := channelStore.List(txn)
+	if err != nil {
+		txn.Error("Failed to apiChannel:", err)
+		return nil, err
+	}
+	for _, ch := range channels {
+		if ch.ID == id {
+			return &ch, nil
+		}
+	}
+	return nil, newAPIError(http.StatusNotFound, "", "channel not found")
+}
+
+// apiChannelParam returns the channel named by the channel_id parameter.
+func apiChannelParam(txn *Transaction, c echo.Context) (*ChannelInfo, error) {
+	id, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || id <= 0 {
+		return nil, newAPIError(http.StatusBadRequest, "", "invalid channel id")
+	}
+	return apiChannel(txn, id)
+}
+
+// apiBind decodes the request body into v.
+func apiBind(c echo.Context, v interface{}) error {
+	if err := c.Bind(v); err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return newAPIError(http.StatusBadRequest, "", fmt.Sprint(he.Message))
+		}
+		return err
+	}
+	return nil
+}
+
+// request handlers
+
+type apiCredentials struct {
+	Name     string `json:"name" form:"name"`
+	Password string `json:"password" form:"password"`
+	// Code is a TOTP or recovery code, required with 2FA enabled.
+	Code string `json:"code,omitempty" form:"code"`
+}
+
+func postAPISession(c echo.Context) error {
+	txn := app.StartTransaction("postAPISession", c.Response().Writer, c.Request())
+	defer txn.End()
+	var req apiCredentials
+	if err := apiBind(c, &req); err != nil {
+		return err
+	}
+	if req.Name == "" || req.Password == "" {
+		return newAPIError(http.StatusBadRequest, "", "name and password are required")
+	}
+	user, err := authenticate(txn, c, req.Name, req.Password)
+	if err == echo.ErrForbidden {
+		return newAPIError(http.StatusUnauthorized, "invalid_credentials", "invalid name or password")
+	}
+	if err != nil {
+		return err
+	}
+	t, err := getUserTOTP(txn, user.ID)
+	if err != nil {
+		return err
+	}
+	method := ""
+	if t != nil {
+		if req.Code == "" {
+			return newAPIError(http.StatusUnauthorized, "totp_required", "a two-factor code is required")
+		}
+		err := verifySecondFactor(txn, c, user, t, req.Code)
+		if err == echo.ErrForbidden {
+			return newAPIError(http.StatusUnauthorized, "invalid_totp_code", "invalid two-factor code")
+		}
+		if err != nil {
+			return err
+		}
+		method = "2fa"
+	}
+	audit(txn, c, auditLogin, user, "user", user.ID, user.Name, method)
+	sessSetUserID(c, user.ID)
+
+	st, err := getUserStatus(txn, user.ID)
+	if err != nil {
+		return err
+	}
+	user.IsAdmin = st.IsAdmin || isAdminName(user.Name)
+	me, err := toAPIMe(txn, user)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, me)
+}
+
+func deleteAPISession(c echo.Context) error {
+	txn := app.StartTransaction("deleteAPISession", c.Response().Writer, c.Request())
+	defer txn.End()
+	sessClear(c)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func postAPIUsers(c echo.Context) error {
+	txn := app.StartTransaction("postAPIUsers", c.Response().Writer, c.Request())
+	defer txn.End()
+	var req apiCredentials
+	if err := apiBind(c, &req); err != nil {
+		return err
+	}
+	if req.Name == "" || req.Password == "" {
+		return newAPIError(http.StatusBadRequest, "", "name and password are required")
+	}
+	userID, err := register(txn, req.Name, req.Password)
+	if err == errDuplicateName {
+		return newAPIError(http.StatusConflict, "", "name already taken")
+	}
+	if err != nil {
+		txn.Error("Failed to postAPIUsers:", err)
+		return err
+	}
+	audit(txn, c, auditRegister, &User{ID: userID, Name: req.Name}, "user", userID, req.Name, "")
+	sessSetUserID(c, userID)
+	user, err := getUser(txn, userID)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, apiPrefix+"/users/"+url.PathEscape(user.Name))
+	return c.JSON(http.StatusCreated, toAPIUser(user))
+}
+
+func getAPIUser(c echo.Context) error {
+	txn := app.StartTransaction("getAPIUser", c.Response().Writer, c.Request())
+	defer txn.End()
+	if _, err := apiLogin(c); err != nil {
+		return err
+	}
+	user, err := userStore.GetByName(txn, c.Param("user_name"))
+	if err != nil {
+		txn.Error("Failed to getAPIUser:", err)
+		return err
+	}
+	if user == nil {
+		return newAPIError(http.StatusNotFound, "", "user not found")
+	}
+	return c.JSON(http.StatusOK, toAPIUser(user))
+}
+
+func getAPIMe(c echo.Context) error {
+	txn := app.StartTransaction("getAPIMe", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	me, err := toAPIMe(txn, self)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, me)
+}
+
+type apiProfileUpdate struct {
+	DisplayName *string `json:"display_name" form:"display_name"`
+}
+
+func patchAPIMe(c echo.Context) error {
+	txn := app.StartTransaction("patchAPIMe", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	var req apiProfileUpdate
+	if err := apiBind(c, &req); err != nil {
+		return err
+	}
+	if req.DisplayName != nil {
+		if *req.DisplayName == "" {
+			return newAPIError(http.StatusBadRequest, "", "display_name must not be empty")
+		}
+		if err := setDisplayName(txn, c, self, *req.DisplayName); err != nil {
+			return err
+		}
+	}
+	me, err := toAPIMe(txn, self)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, me)
+}
+
+// putAPIMeAvatar replaces the avatar with the avatar_icon part of a
+// multipart body.
+func putAPIMeAvatar(c echo.Context) error {
+	txn := app.StartTransaction("putAPIMeAvatar", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	_, file, err := readUpload(c, "avatar_icon", "", avatarMaxBytes)
+	if err != nil {
+		txn.Error("Failed to putAPIMeAvatar:", err)
+		return uploadError(err)
+	}
+	if file == nil {
+		return newAPIError(http.StatusBadRequest, "", "avatar_icon is required")
+	}
+	defer file.Close()
+	if err := uploadAvatar(txn, c, self, file); err != nil {
+		if err == ErrBadReqeust {
+			return newAPIError(http.StatusBadRequest, "", "avatar_icon must be a JPEG, PNG or GIF image")
+		}
+		return err
+	}
+	me, err := toAPIMe(txn, self)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, me)
+}
+
+// deleteAPIMeAvatar goes back to a generated avatar.
+func deleteAPIMeAvatar(c echo.Context) error {
+	txn := app.StartTransaction("deleteAPIMeAvatar", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	if err := resetAvatar(txn, c, self); err != nil {
+		return err
+	}
+	me, err := toAPIMe(txn, self)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, me)
+}
+
+func getAPIChannels(c echo.Context) error {
+	txn := app.StartTransaction("getAPIChannels", c.Response().Writer, c.Request())
+	defer txn.End()
+	if _, err := apiLogin(c); err != nil {
+		return err
+	}
+	offset, limit, err := apiPaging(c)
+	if err != nil {
+		return err
+	}
+	channels, err := channelStore.List(txn)
+	if err != nil {
+		txn.Error("Failed to getAPIChannels:", err)
+		return err
+	}
+	items := []APIChannel{}
+	for i := offset; i < int64(len(channels)) && i < offset+limit; i++ {
+		items = append(items, toAPIChannel(channels[i]))
+	}
+	return apiListResponse(c, items, int64(len(channels)), offset, limit)
+}
+
+type apiChannelCreate struct {
+	Name        string `json:"name" form:"name"`
+	Description string `json:"description" form:"description"`
+}
+
+func postAPIChannels(c echo.Context) error {
+	txn := app.StartTransaction("postAPIChannels", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	var req apiChannelCreate
+	if err := apiBind(c, &req); err != nil {
+		return err
+	}
+	if req.Name == "" || req.Description == "" {
+		return newAPIError(http.StatusBadRequest, "", "name and description are required")
+	}
+	id, err := channelStore.Create(txn, req.Name, req.Description, self.ID)
+	if err != nil {
+		txn.Error("Failed to postAPIChannels:", err)
+		return err
+	}
+	audit(txn, c, auditChannelCreate, self, "channel", id, req.Name, req.Description)
+	ch, err := apiChannel(txn, id)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("%s/channels/%d", apiPrefix, id))
+	return c.JSON(http.StatusCreated, toAPIChannel(*ch))
+}
+
+func getAPIChannel(c echo.Context) error {
+	txn := app.StartTransaction("getAPIChannel", c.Response().Writer, c.Request())
+	defer txn.End()
+	if _, err := apiLogin(c); err != nil {
+		return err
+	}
+	ch, err := apiChannelParam(txn, c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, toAPIChannel(*ch))
+}
+
+// getAPIMessages pages through a channel's messages, newest first. With
+// after=<message id> it instead returns up to limit messages newer than
+// that one, for polling.
+func getAPIMessages(c echo.Context) error {
+	txn := app.StartTransaction("getAPIMessages", c.Response().Writer, c.Request())
+	defer txn.End()
+	if _, err := apiLogin(c); err != nil {
+		return err
+	}
+	ch, err := apiChannelParam(txn, c)
+	if err != nil {
+		return err
+	}
+	offset, limit, err := apiPaging(c)
+	if err != nil {
+		return err
+	}
+	total, err := messageStore.Count(txn, ch.ID)
+	if err != nil {
+		txn.Error("Failed to getAPIMessages1:", err)
+		return err
+	}
+
+	items := []APIMessage{}
+	if s := c.QueryParam("after"); s != "" {
+		after, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || after < 0 {
+			return newAPIError(http.StatusBadRequest, "", "after must be a message id")
+		}
+		msgs, err := messageStore.Since(txn, ch.ID, after, int(limit))
+		if err != nil {
+			txn.Error("Failed to getAPIMessages2:", err)
+			return err
+		}
+		for _, m := range msgs {
+			items = append(items, toAPIMessage(&m.Message, &m.User))
+		}
+		return c.JSON(http.StatusOK, APIList{Items: items, Total: total, Limit: limit})
+	}
+
+	msgs, err := messageStore.Page(txn, ch.ID, offset, limit)
+	if err != nil {
+		txn.Error("Failed to getAPIMessages3:", err)
+		return err
+	}
+	users := map[int64]*User{}
+	for _, m := range msgs {
+		u, ok := users[m.UserID]
+		if !ok {
+			u, err = getUser(txn, m.UserID)
+			if err != nil {
+				return err
+			}
+			if u == nil {
+				u = &User{ID: m.UserID}
+			}
+			users[m.UserID] = u
+		}
+		items = append(items, toAPIMessage(&m, u))
+	}
+	return apiListResponse(c, items, total, offset, limit)
+}
+
+type apiMessageCreate struct {
+	Content string `json:"content" form:"content"`
+}
+
+func postAPIMessages(c echo.Context) error {
+	txn := app.StartTransaction("postAPIMessages", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	ch, err := apiChannelParam(txn, c)
+	if err != nil {
+		return err
+	}
+	var req apiMessageCreate
+	if err := apiBind(c, &req); err != nil {
+		return err
+	}
+	if req.Content == "" {
+		return newAPIError(http.StatusBadRequest, "", "content is required")
+	}
+	id, err := addMessage(txn, ch.ID, self.ID, req.Content)
+	if err != nil {
+		return err
+	}
+	m, err := messageStore.Get(txn, id)
+	if err != nil {
+		txn.Error("Failed to postAPIMessages:", err)
+		return err
+	}
+	if m == nil {
+		// Deleted right away; report what was posted.
+		m = &Message{ID: id, ChannelID: ch.ID, UserID: self.ID, Content: req.Content, CreatedAt: time.Now()}
+	}
+	return c.JSON(http.StatusCreated, toAPIMessage(m, self))
+}
+
+// getAPIReadStates reports the unread count of every channel.
+func getAPIReadStates(c echo.Context) error {
+	txn := app.StartTransaction("getAPIReadStates", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	channels, err := queryChannels(txn)
+	if err != nil {
+		txn.Error("Failed to getAPIReadStates1:", err)
+		return err
+	}
+	reads, err := readStateStore.GetAll(txn, self.ID, channels)
+	if err != nil {
+		txn.Error("Failed to getAPIReadStates2:", err)
+		return err
+	}
+	counts, err := messageStore.Counts(txn, channels)
+	if err != nil {
+		txn.Error("Failed to getAPIReadStates3:", err)
+		return err
+	}
+	items := make([]APIReadState, 0, len(channels))
+	for _, ch := range channels {
+		items = append(items, readState(ch, reads[ch], counts[ch]))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"items": items})
+}
+
+func readState(channelID, read, count int64) APIReadState {
+	unread := count - read
+	if unread < 0 {
+		// messages were deleted after they had been read
+		unread = 0
+	}
+	return APIReadState{ChannelID: channelID, Read: read, Unread: unread}
+}
+
+func getAPIReadState(c echo.Context) error {
+	txn := app.StartTransaction("getAPIReadState", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	ch, err := apiChannelParam(txn, c)
+	if err != nil {
+		return err
+	}
+	read, err := readStateStore.Get(txn, self.ID, ch.ID)
+	if err != nil {
+		txn.Error("Failed to getAPIReadState1:", err)
+		return err
+	}
+	count, err := messageStore.Count(txn, ch.ID)
+	if err != nil {
+		txn.Error("Failed to getAPIReadState2:", err)
+		return err
+	}
+	return c.JSON(http.StatusOK, readState(ch.ID, read, count))
+}
+
+// putAPIReadState marks every message of the channel as read.
+func putAPIReadState(c echo.Context) error {
+	txn := app.StartTransaction("putAPIReadState", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := apiLogin(c)
+	if err != nil {
+		return err
+	}
+	ch, err := apiChannelParam(txn, c)
+	if err != nil {
+		return err
+	}
+	count, err := messageStore.Count(txn, ch.ID)
+	if err != nil {
+		txn.Error("Failed to putAPIReadState1:", err)
+		return err
+	}
+	if err := readStateStore.Set(txn, self.ID, ch.ID, count); err != nil {
+		txn.Error("Failed to putAPIReadState2:", err)
+		return err
+	}
+	return c.JSON(http.StatusOK, readState(ch.ID, count, count))
+}
+
+// registerAPI adds the /api/v1 routes.
+func registerAPI(e *echo.Echo) {
+	e.HTTPErrorHandler = apiErrorHandler(e.HTTPErrorHandler)
+	g := e.Group(apiPrefix, negotiateJSON)
+	g.POST("/session", postAPISession)
+	g.DELETE("/session", deleteAPISession)
+	g.POST("/users", postAPIUsers)
+	g.GET("/users/:user_name", getAPIUser)
+	g.GET("/me", getAPIMe)
+	g.PATCH("/me", patchAPIMe)
+	g.PUT("/me/avatar", putAPIMeAvatar, limitBody(uploadMaxFormSize))
+	g.DELETE("/me/avatar", deleteAPIMeAvatar)
+	g.GET("/channels", getAPIChannels)
+	g.POST("/channels", postAPIChannels)
+	g.GET("/channels/:channel_id", getAPIChannel)
+	g.GET("/channels/:channel_id/messages", getAPIMessages)
+	g.POST("/channels/:channel_id/messages", postAPIMessages)
+	g.GET("/channels/:channel_id/read", getAPIReadState)
+	g.PUT("/channels/:channel_id/read", putAPIReadState)
+	g.GET("/read", getAPIReadStates)
+}
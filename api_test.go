@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// apiCall sends a JSON body, if any, and decodes the JSON response.
+func (tc *testClient) apiCall(method, path, body string, header http.Header) (int, http.Header, map[string]interface{}) {
+	req, err := http.NewRequest(method, tc.base+path, strings.NewReader(body))
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	status, h, raw := tc.send(req)
+	var res map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &res); err != nil {
+		tc.t.Fatalf("%s %s: %v: %s", method, path, err, raw)
+	}
+	return status, h, res
+}
+
+// apiErrorCodeOf returns error.code from an error body.
+func apiErrorCodeOf(res map[string]interface{}) string {
+	e, _ := res["error"].(map[string]interface{})
+	code, _ := e["code"].(string)
+	return code
+}
+
+func TestAPINegotiation(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	tc := newTestClient(t, srv)
+	for _, tt := range []struct {
+		name   string
+		header http.Header
+		body   string
+		status int
+		code   string
+	}{
+		{"html only", http.Header{"Accept": {"text/html"}}, "", http.StatusNotAcceptable, "not_acceptable"},
+		{"json refused", http.Header{"Accept": {"application/json;q=0, text/html"}}, "", http.StatusNotAcceptable, "not_acceptable"},
+		{"text body", http.Header{"Content-Type": {"text/plain"}}, "name=x", http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"json body", http.Header{"Accept": {"application/json"}}, `{"name":"x"}`, http.StatusBadRequest, "bad_request"},
+	} {
+		status, _, res := tc.apiCall("POST", "/api/v1/session", tt.body, tt.header)
+		if status != tt.status || apiErrorCodeOf(res) != tt.code {
+			t.Errorf("%s: got %d %q, want %d %q", tt.name, status, apiErrorCodeOf(res), tt.status, tt.code)
+		}
+	}
+}
+
+func TestAPIErrorBody(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	status, _, res := newTestClient(t, srv).apiCall("GET", "/api/v1/me", "", nil)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", status)
+	}
+	e, ok := res["error"].(map[string]interface{})
+	if !ok || len(res) != 1 {
+		t.Fatalf("body %v is not {\"error\": {...}}", res)
+	}
+	if e["status"] != float64(http.StatusUnauthorized) || e["code"] != "unauthorized" || e["message"] != "login required" {
+		t.Errorf("error %v", e)
+	}
+	if id, _ := e["request_id"].(string); id == "" {
+		t.Errorf("error %v has no request_id", e)
+	}
+}
+
+func TestAPISession(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	tc := newTestClient(t, srv)
+	tc.expect("POST", "/register", url.Values{"name": {"frank"}, "password": {"pw"}}, http.StatusSeeOther)
+
+	status, _, res := tc.apiCall("POST", "/api/v1/session", `{"name":"frank","password":"wrong"}`, nil)
+	if status != http.StatusUnauthorized || apiErrorCodeOf(res) != "invalid_credentials" {
+		t.Errorf("wrong password: got %d %v", status, res)
+	}
+	status, _, res = tc.apiCall("POST", "/api/v1/session", `{"name":"frank","password":"pw"}`, nil)
+	if status != http.StatusOK || res["name"] != "frank" || res["two_factor_enabled"] != false {
+		t.Errorf("login: got %d %v", status, res)
+	}
+
+	key := []byte("12345678901234567890")
+	if err := totpStore.Enable(nil, 1, totpEncoding.EncodeToString(key), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	status, _, res = tc.apiCall("POST", "/api/v1/session", `{"name":"frank","password":"pw"}`, nil)
+	if status != http.StatusUnauthorized || apiErrorCodeOf(res) != "totp_required" {
+		t.Errorf("without a code: got %d %v", status, res)
+	}
+	status, _, res = tc.apiCall("POST", "/api/v1/session", `{"name":"frank","password":"pw","code":"000000"}`, nil)
+	if status != http.StatusUnauthorized || apiErrorCodeOf(res) != "invalid_totp_code" {
+		t.Errorf("wrong code: got %d %v", status, res)
+	}
+}
+
+func TestAPIPaging(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	tc := newTestClient(t, srv)
+	tc.expect("POST", "/register", url.Values{"name": {"grace"}, "password": {"pw"}}, http.StatusSeeOther)
+	for _, m := range []string{"one", "two", "three"} {
+		tc.expect("POST", "/message", url.Values{"channel_id": {"1"}, "message": {m}}, http.StatusNoContent)
+	}
+
+	for _, q := range []string{"limit=0", "limit=101", "offset=-1", "limit=x"} {
+		status, _, res := tc.apiCall("GET", "/api/v1/channels/1/messages?"+q, "", nil)
+		if status != http.StatusBadRequest || apiErrorCodeOf(res) != "bad_request" {
+			t.Errorf("%s: got %d %v", q, status, res)
+		}
+	}
+
+	status, h, res := tc.apiCall("GET", "/api/v1/channels/1/messages?limit=2", "", nil)
+	if status != http.StatusOK || res["total"] != float64(3) || len(res["items"].([]interface{})) != 2 {
+		t.Fatalf("first page: got %d %v", status, res)
+	}
+	if link := h.Get("Link"); link != `</api/v1/channels/1/messages?limit=2&offset=2>; rel="next"` {
+		t.Errorf("first page Link %q", link)
+	}
+	status, h, res = tc.apiCall("GET", "/api/v1/channels/1/messages?limit=2&offset=2", "", nil)
+	if status != http.StatusOK || len(res["items"].([]interface{})) != 1 {
+		t.Fatalf("last page: got %d %v", status, res)
+	}
+	if link := h.Get("Link"); link != "" {
+		t.Errorf("last page Link %q", link)
+	}
+	if status, _, _ := tc.apiCall("GET", "/api/v1/channels/1/messages?limit=100", "", nil); status != http.StatusOK {
+		t.Errorf("limit=100: got %d", status)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
@@ -17,28 +16,22 @@ import (
 	"strings"
 	"time"
 	"hash/fnv"
-	"bytes"
-	"mime/multipart"
 
-	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/middleware"
-	"github.com/newrelic/go-agent"
 	"github.com/go-redis/redis"
 )
 
 const (
 	avatarMaxBytes = 1 * 1024 * 1024
-	iconsDir = "/home/isucon/icons"
 )
 
 var (
 	db            *sqlx.DB
 	ErrBadReqeust = echo.NewHTTPError(http.StatusBadRequest)
-	app newrelic.Application
 	rd *redis.Client
 	me string
 	hosts []string
@@ -54,88 +47,73 @@ func hash(s string) int {
 	return int(h.Sum32())
 }
 
-func StartMySQLSegment(txn newrelic.Transaction, collection, operation string) newrelic.DatastoreSegment {
-	return newrelic.DatastoreSegment{
-		StartTime: txn.StartSegmentNow(),
-		Product: newrelic.DatastoreMySQL,
-		Collection: collection,
-		Operation: operation,
-	}
-}
-
 func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	// Pages for a logged-in user get the token admin forms post back.
+	if m, ok := data.(map[string]interface{}); ok && c != nil {
+		if userID, _ := sessUser(c); userID != 0 {
+			m["CSRFToken"] = csrfToken(c)
+		}
+	}
 	return r.templates.ExecuteTemplate(w, name, data)
 }
 
 func init() {
-	me = os.Getenv("ISUBATA_ME")
-	fmt.Println("ME:", me)
-	hosts = strings.Split(os.Getenv("ISUBATA_HOSTS"), ",")
-	fmt.Println("HOSTS:", hosts)
 	seedBuf := make([]byte, 8)
 	crand.Read(seedBuf)
 	rand.Seed(int64(binary.LittleEndian.Uint64(seedBuf)))
+}
 
-	db_host := os.Getenv("ISUBATA_DB_HOST")
-	if db_host == "" {
-		db_host = "127.0.0.1"
-	}
-	db_port := os.Getenv("ISUBATA_DB_PORT")
-	if db_port == "" {
-		db_port = "3306"
-	}
-	db_user := os.Getenv("ISUBATA_DB_USER")
-	if db_user == "" {
-		db_user = "root"
-	}
-	db_password := os.Getenv("ISUBATA_DB_PASSWORD")
+// setup applies config and creates the MySQL and Redis clients.
+func setup() {
+	defaultLogLevel, _ = parseLogLevel(config.LogLevel)
+	setLogLevel(defaultLogLevel)
+	me = config.Me
+	log.Println("ME:", me)
+	hosts = config.Hosts
+	log.Println("HOSTS:", hosts)
+	requireTOTP = config.Require2FA
+	peerSecret = []byte(config.PeerSecret)
+	if len(peerSecret) == 0 {
+		log.Println("peer_secret is not set; icon pushes from peers will be rejected")
+	}
+	adminNames = config.Admins
+	trustedProxies, _ = parseProxies(config.TrustedProxies) // checked by Validate
+	iconGCGrace = config.Icons.GCGrace.Duration
+	iconGCDryRun = config.Icons.GCDryRun
+
+	db_password := config.DB.Password
 	if db_password != "" {
 		db_password = ":" + db_password
 	}
 
-	dsn := fmt.Sprintf("%s%s@tcp(%s:%s)/isubata?parseTime=true&loc=Local&charset=utf8mb4",
-		db_user, db_password, db_host, db_port)
+	dsn := fmt.Sprintf("%s%s@tcp(%s:%d)/%s?parseTime=true&loc=Local&charset=utf8mb4",
+		config.DB.User, db_password, config.DB.Host, config.DB.Port, config.DB.Name)
 
-	log.Printf("Connecting to db: %q", dsn)
-	db, _ = sqlx.Connect("mysql", dsn)
-	for {
-		err := db.Ping()
-		if err == nil {
-			break
-		}
-		log.Println(err)
-		time.Sleep(time.Second * 3)
-	}
-
-	db.SetMaxOpenConns(20)
+	// Connections are established in the background by
+	// connectDependencies; sqlx.Open and redis.NewClient do not dial.
+	db = sqlx.MustOpen("mysql", dsn)
+	db.SetMaxOpenConns(config.DB.MaxOpenConns)
 	db.SetConnMaxLifetime(5 * time.Minute)
-	log.Printf("Succeeded to connect db.")
 
-	redis_host := os.Getenv("ISUBATA_REDIS_HOST")
-	if redis_host == "" {
-		redis_host = "127.0.0.1"
-	}
-	redis_port := os.Getenv("ISUBATA_REDIS_PORT")
-	if redis_port == "" {
-		redis_port = "6379"
-	}
-
-	rd = redis.NewClient(&redis.Options{
-		Addr: redis_host + ":" + redis_port,
-		Password: "",
-		DB: 0,
-	})
+	shards = newRedisRing(config.Redis.Addrs(), newRedisClient)
+	rd = shards.nodes[0].Client
+	app = newTelemetry(config.Telemetry, config.NewRelicKey)
 
-	for {
-		err := rd.Ping().Err()
-		if err == nil {
-			break
-		}
-		log.Println(err)
-		time.Sleep(time.Second * 3)
+	if err := initStores(config.Store); err != nil {
+		log.Fatalln("Failed to configure stores:", err)
 	}
 
-	log.Println("Succeeded to connect redis.")
+	store, err := newBlobStore(config.Icons)
+	if err != nil {
+		log.Fatalln("Failed to configure icon storage:", err)
+	}
+	iconStore = store
+	if _, ok := store.(*mysqlBlobStore); ok || memoryStores {
+		// The memory stores start without the seeded icons.
+		seedStore = store
+	} else {
+		seedStore = &mysqlBlobStore{}
+	}
 }
 
 type User struct {
@@ -146,6 +124,7 @@ type User struct {
 	DisplayName string    `json:"display_name" db:"display_name"`
 	AvatarIcon  string    `json:"avatar_icon" db:"avatar_icon"`
 	CreatedAt   time.Time `json:"-" db:"created_at"`
+	IsAdmin     bool      `json:"-" db:"-"`
 }
 
 func keyHaveread(user, ch int64) string {
@@ -176,42 +155,26 @@ func splitMessage(unified string) (ID, userID int64, content string, createdAt s
 	return
 }
 
-func getUser(txn newrelic.Transaction, userID int64) (*User, error) {
-	u := User{}
-	s := StartMySQLSegment(txn, "user", "SELECT")
-	err := db.Get(&u, "SELECT * FROM user WHERE id = ?", userID)
-	s.End()
+func getUser(txn *Transaction, userID int64) (*User, error) {
+	u, err := userStore.Get(txn, userID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		log.Println("Failed to get user:", err)
+		txn.Error("Failed to get user:", err)
 		return nil, err
 	}
-	return &u, nil
+	return u, nil
 }
 
-func addMessage(txn newrelic.Transaction, channelID, userID int64, content string) error {
-	s := StartMySQLSegment(txn, "message", "INSERT")
-	res, err := db.Exec(
-		"INSERT INTO message (channel_id, user_id, content, created_at) VALUES (?, ?, ?, NOW())",
-		channelID, userID, content)
-	s.End()
-	if err != nil {
-		log.Println("Failed to addMessage1:", err)
-		return err
-	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		log.Println("Failed to addMessage2:", err)
-		return err
-	}
-	err = rd.LPush(keyMessages(channelID), unifyMessage(id, userID, content, time.Now())).Err()
+func addMessage(txn *Transaction, channelID, userID int64, content string) (int64, error) {
+	id, err := messageStore.Add(txn, channelID, userID, content)
 	if err != nil {
-		log.Println("Failed to addMessage4:", err)
-		return err
+		txn.Error("Failed to addMessage1:", err)
+		return 0, err
 	}
-	return nil
+	messagesPosted.Inc()
+	notifyWebhooks(txn, channelID, webhookMessageCreated, func() (*WebhookPayload, error) {
+		return messagePayload(txn, &Message{ID: id, ChannelID: channelID, UserID: userID, Content: content, CreatedAt: time.Now()})
+	})
+	return id, nil
 }
 
 type Message struct {
@@ -222,14 +185,29 @@ type Message struct {
 	CreatedAt time.Time `db:"created_at"`
 }
 
-func sessUserID(c echo.Context) int64 {
-	txn := app.StartTransaction("sessUserID", c.Response().Writer, c.Request())
-	defer txn.End()
+func sessUser(c echo.Context) (userID, loginAt int64) {
 	sess, _ := session.Get("session", c)
-	var userID int64
 	if x, ok := sess.Values["user_id"]; ok {
 		userID, _ = x.(int64)
 	}
+	if x, ok := sess.Values["login_at"]; ok {
+		loginAt, _ = x.(int64)
+	}
+	return
+}
+
+func sessUserID(c echo.Context) int64 {
+	txn := app.StartTransaction("sessUserID", c.Response().Writer, c.Request())
+	defer txn.End()
+	userID, loginAt := sessUser(c)
+	if userID == 0 {
+		return 0
+	}
+	st, err := getUserStatus(txn, userID)
+	if err != nil || st.Blocked(time.Now()) || st.SessionRevoked(loginAt) {
+		return 0
+	}
+	setLogUser(c, userID)
 	return userID
 }
 
@@ -238,20 +216,67 @@ func sessSetUserID(c echo.Context, id int64) {
 	defer txn.End()
 	sess, _ := session.Get("session", c)
 	sess.Options = &sessions.Options{
+		// Without a path, logging in at /login/2fa would scope the
+		// cookie to /login.
+		Path:     "/",
 		HttpOnly: true,
 		MaxAge:   360000,
 	}
 	sess.Values["user_id"] = id
+	sess.Values["login_at"] = time.Now().Unix()
+	delete(sess.Values, csrfField)
+	sess.Save(c.Request(), c.Response())
+	setLogUser(c, id)
+}
+
+// sessClear logs the session out.
+func sessClear(c echo.Context) {
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "user_id")
+	delete(sess.Values, "pending_user_id")
+	delete(sess.Values, "pending_at")
+	delete(sess.Values, "totp_setup_secret")
+	delete(sess.Values, csrfField)
 	sess.Save(c.Request(), c.Response())
 }
 
+// authenticate checks a name and password, auditing failures. The second
+// factor is left to the caller.
+func authenticate(txn *Transaction, c echo.Context, name, pw string) (*User, error) {
+	user, err := userStore.GetByName(txn, name)
+	if err != nil {
+		txn.Error("Failed to postLogin:", err)
+		return nil, err
+	}
+	if user == nil {
+		audit(txn, c, auditLoginFailed, nil, "user", 0, name, "unknown user")
+		return nil, echo.ErrForbidden
+	}
+
+	digest := fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+pw)))
+	if digest != user.Password {
+		audit(txn, c, auditLoginFailed, nil, "user", user.ID, user.Name, "bad password")
+		return nil, echo.ErrForbidden
+	}
+
+	st, err := getUserStatus(txn, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if st.Blocked(time.Now()) {
+		audit(txn, c, auditLoginFailed, nil, "user", user.ID, user.Name, "suspended")
+		return nil, echo.NewHTTPError(http.StatusForbidden, "account suspended")
+	}
+	return user, nil
+}
+
 func ensureLogin(c echo.Context) (*User, error) {
 	txn := app.StartTransaction("ensureLogin", c.Response().Writer, c.Request())
 	defer txn.End()
 	var user *User
 	var err error
 
-	userID := sessUserID(c)
+	userID, loginAt := sessUser(c)
 	if userID == 0 {
 		c.Redirect(http.StatusSeeOther, "/login")
 		return nil, nil
@@ -259,16 +284,35 @@ func ensureLogin(c echo.Context) (*User, error) {
 
 	user, err = getUser(txn, userID)
 	if err != nil {
-		log.Println("Failed to getUser():", err)
+		txn.Error("Failed to getUser():", err)
 		return nil, err
 	}
-	if user == nil {
+	var st *UserStatus
+	if user != nil {
+		st, err = getUserStatus(txn, userID)
+		if err != nil {
+			txn.Error("Failed to getUserStatus():", err)
+			return nil, err
+		}
+	}
+	if user == nil || st.SessionRevoked(loginAt) || st.Blocked(time.Now()) {
 		sess, _ := session.Get("session", c)
 		delete(sess.Values, "user_id")
 		sess.Save(c.Request(), c.Response())
 		c.Redirect(http.StatusSeeOther, "/login")
 		return nil, nil
 	}
+	user.IsAdmin = st.IsAdmin || isAdminName(user.Name)
+	setLogUser(c, user.ID)
+	enroll, err := needsTOTPEnrollment(txn, c, user)
+	if err != nil {
+		txn.Error("Failed to needsTOTPEnrollment():", err)
+		return nil, err
+	}
+	if enroll {
+		c.Redirect(http.StatusSeeOther, "/2fa/setup")
+		return nil, nil
+	}
 	return user, nil
 }
 
@@ -284,21 +328,20 @@ func randomString(n int) string {
 	return string(b)
 }
 
-func register(txn newrelic.Transaction, name, password string) (int64, error) {
+func register(txn *Transaction, name, password string) (int64, error) {
 	salt := randomString(20)
 	digest := fmt.Sprintf("%x", sha1.Sum([]byte(salt+password)))
-
-	s := StartMySQLSegment(txn, "user", "INSERT")
-	res, err := db.Exec(
-		"INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
-			" VALUES (?, ?, ?, ?, ?, NOW())",
-		name, salt, digest, name, "default.png")
-	s.End()
+	avatar, err := generateAvatar(txn, name)
 	if err != nil {
-		log.Println("Failed to register:", err)
-		return 0, err
+		txn.Error("Failed to generate avatar:", err)
+		avatar = defaultIcon
 	}
-	return res.LastInsertId()
+
+	userID, err := userStore.Create(txn, name, salt, digest, name, avatar)
+	if err != nil && err != errDuplicateName {
+		txn.Error("Failed to register:", err)
+	}
+	return userID, err
 }
 
 // request handlers
@@ -308,44 +351,39 @@ func getInitialize(c echo.Context) error {
 	defer txn.End()
 	after := time.After(8 * time.Second)
 	db.MustExec("DELETE FROM user WHERE id > 1000")
-	db.MustExec("DELETE FROM image WHERE id > 1001")
+	db.MustExec("DELETE FROM image WHERE id > ?", seedImageMaxID)
 	db.MustExec("DELETE FROM channel WHERE id > 10")
 	db.MustExec("DELETE FROM message WHERE id > 10000")
-	rd.FlushDB().Err()
+	db.MustExec("DELETE FROM icon_replication")
+	db.MustExec("DELETE FROM icon_gc_mark")
+	db.MustExec("DELETE FROM webhook")
+	db.MustExec("DELETE FROM webhook_delivery")
+	db.MustExec("DELETE FROM incoming_webhook")
+	db.MustExec("DELETE FROM incoming_webhook_user")
+	for _, n := range shards.nodes {
+		n.FlushDB().Err()
+	}
 	var msgs []Message
 	err := db.Select(&msgs, "SELECT * FROM message")
 	if err != nil {
-		log.Println("Failed to getInitialize:", err)
+		txn.Error("Failed to getInitialize:", err)
 		return err
 	}
 	for _, mes := range msgs {
-		err := rd.LPush(keyMessages(mes.ChannelID), unifyMessage(mes.ID, mes.UserID, mes.Content, mes.CreatedAt)).Err()
+		err := redisShard(mes.ChannelID).LPush(keyMessages(mes.ChannelID), unifyMessage(mes.ID, mes.UserID, mes.Content, mes.CreatedAt)).Err()
 		if err != nil {
-			log.Println("Failed to getInitialize1.5:", err)
+			txn.Error("Failed to getInitialize1.5:", err)
 		}
 	}
-	os.RemoveAll(iconsDir)
-	os.Mkdir(iconsDir, 0777)
-	rows, err := db.Query("SELECT name, data FROM image")
-	if err != nil {
-		log.Println("Failed to preload image:", err)
-		return err
-	}
-	for rows.Next() {
-		var name string
-		var data []byte
-		err := rows.Scan(&name, &data)
-		if err != nil {
-			log.Println("Failed to scan data:", err)
-			return err
-		}
-		err = ioutil.WriteFile(iconsDir + "/" + name, data, 0777)
-		if err != nil {
-			log.Println("Failed to write file:", err)
-			return err
+	for _, n := range shards.nodes {
+		if err := n.Set(cacheReadyKey, time.Now().Unix(), 0).Err(); err != nil {
+			txn.Error("Failed to getInitialize1.6:", err)
 		}
 	}
-	rows.Close()
+	if err := resetIconStore(); err != nil {
+		txn.Error("Failed to reset icons:", err)
+		return err
+	}
 	<-after
 	return c.String(204, "")
 }
@@ -367,6 +405,7 @@ type ChannelInfo struct {
 	ID          int64     `db:"id"`
 	Name        string    `db:"name"`
 	Description string    `db:"description"`
+	OwnerID     int64     `db:"owner_id"` // 0 for channels made before owners
 	UpdatedAt   time.Time `db:"updated_at"`
 	CreatedAt   time.Time `db:"created_at"`
 }
@@ -380,22 +419,21 @@ func getChannel(c echo.Context) error {
 	}
 	cID, err := strconv.Atoi(c.Param("channel_id"))
 	if err != nil {
-		log.Println("Failed to getChannel:", err)
+		txn.Error("Failed to getChannel:", err)
 		return err
 	}
-	channels := []ChannelInfo{}
-	s := StartMySQLSegment(txn, "channel", "SELECT")
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
-	s.End()
+	channels, err := channelStore.List(txn)
 	if err != nil {
-		log.Println("Failed to getChannel:", err)
+		txn.Error("Failed to getChannel:", err)
 		return err
 	}
 
 	var desc string
+	var owner int64
 	for _, ch := range channels {
 		if ch.ID == int64(cID) {
 			desc = ch.Description
+			owner = ch.OwnerID
 			break
 		}
 	}
@@ -404,6 +442,7 @@ func getChannel(c echo.Context) error {
 		"Channels":    channels,
 		"User":        user,
 		"Description": desc,
+		"CanManage":   user.IsAdmin || owner == user.ID,
 	})
 }
 
@@ -426,15 +465,14 @@ func postRegister(c echo.Context) error {
 		return ErrBadReqeust
 	}
 	userID, err := register(txn, name, pw)
+	if err == errDuplicateName {
+		return c.NoContent(http.StatusConflict)
+	}
 	if err != nil {
-		if merr, ok := err.(*mysql.MySQLError); ok {
-			if merr.Number == 1062 { // Duplicate entry xxxx for key zzzz
-				return c.NoContent(http.StatusConflict)
-			}
-		}
-		log.Println("Failed to postRegister:", err)
+		txn.Error("Failed to postRegister:", err)
 		return err
 	}
+	audit(txn, c, auditRegister, &User{ID: userID, Name: name}, "user", userID, name, "")
 	sessSetUserID(c, userID)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
@@ -458,21 +496,20 @@ func postLogin(c echo.Context) error {
 		return ErrBadReqeust
 	}
 
-	var user User
-	s := StartMySQLSegment(txn, "user", "SELECT")
-	err := db.Get(&user, "SELECT * FROM user WHERE name = ?", name)
-	s.End()
-	if err == sql.ErrNoRows {
-		return echo.ErrForbidden
-	} else if err != nil {
-		log.Println("Failed to postLogin:", err)
+	user, err := authenticate(txn, c, name, pw)
+	if err != nil {
 		return err
 	}
 
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+pw)))
-	if digest != user.Password {
-		return echo.ErrForbidden
+	t, err := getUserTOTP(txn, user.ID)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		sessSetPendingUserID(c, user.ID)
+		return c.Redirect(http.StatusSeeOther, "/login/2fa")
 	}
+	audit(txn, c, auditLogin, user, "user", user.ID, user.Name, "")
 	sessSetUserID(c, user.ID)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
@@ -480,9 +517,7 @@ func postLogin(c echo.Context) error {
 func getLogout(c echo.Context) error {
 	txn := app.StartTransaction("getLogout", c.Response().Writer, c.Request())
 	defer txn.End()
-	sess, _ := session.Get("session", c)
-	delete(sess.Values, "user_id")
-	sess.Save(c.Request(), c.Response())
+	sessClear(c)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
@@ -506,66 +541,51 @@ func postMessage(c echo.Context) error {
 		chanID = int64(x)
 	}
 
-	if err := addMessage(txn, chanID, user.ID, message); err != nil {
-		log.Println("Failed to postMessage:", err)
+	if _, err := addMessage(txn, chanID, user.ID, message); err != nil {
+		txn.Error("Failed to postMessage:", err)
 		return err
 	}
 
 	return c.NoContent(204)
 }
 
-func jsonifyMessage(txn newrelic.Transaction, m_id, m_uid int64, m_con, m_at string) (map[string]interface{}, error) {
-	u := User{}
-	s := StartMySQLSegment(txn, "user", "SELECT")
-	err := db.Get(&u, "SELECT name, display_name, avatar_icon FROM user WHERE id = ?",
-		m_uid)
-	s.End()
+func jsonifyMessage(txn *Transaction, m_id, m_uid int64, m_con, m_at string) (map[string]interface{}, error) {
+	u, err := userStore.Get(txn, m_uid)
+	if err == nil && u == nil {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
-		log.Println("Failed to jsonifyMessage:", err)
+		txn.Error("Failed to jsonifyMessage:", err)
 		return nil, err
 	}
 
 	r := make(map[string]interface{})
 	r["id"] = m_id
-	r["user"] = u
+	r["user"] = *u
 	r["date"] = m_at
 	r["content"] = m_con
 	return r, nil
 }
 
-func queryResponse(txn newrelic.Transaction, chanID, oldLastID int64) (response []map[string]interface{}, read int64, err error) {
-	response = make([]map[string]interface{}, 0, 100)
-	s := StartMySQLSegment(txn, "message", "SELECT")
-	rows, err := db.Query("SELECT m.id, m.created_at, m.content, u.name, u.display_name, u.avatar_icon " +
-		"FROM message AS m INNER JOIN user AS u ON m.user_id = u.id " +
-		"WHERE m.id > ? AND m.channel_id = ? ORDER BY m.id DESC LIMIT 100", oldLastID, chanID)
-	defer rows.Close()
+func queryResponse(txn *Transaction, chanID, oldLastID int64) (response []map[string]interface{}, read int64, err error) {
+	msgs, err := messageStore.Since(txn, chanID, oldLastID, 100)
 	if err != nil {
-		s.End()
-		log.Println("Failed to queryResponse:", err)
+		txn.Error("Failed to queryResponse:", err)
 		return nil, 0, err
 	}
-	for rows.Next() {
-		var m Message
-		var u User
-		err := rows.Scan(&m.ID, &m.CreatedAt, &m.Content, &u.Name, &u.DisplayName, &u.AvatarIcon)
-		if err != nil {
-			s.End()
-			log.Println("Failed to queryResponse:", err)
-			return nil, 0, err
-		}
+	response = make([]map[string]interface{}, 0, len(msgs))
+	for _, m := range msgs {
 		r := make(map[string]interface{})
 		r["id"] = m.ID
-		r["user"] = u
+		r["user"] = m.User
 		r["date"] = m.CreatedAt.Format("2006/01/02 15:04:05")
 		r["content"] = m.Content
 		response = append(response, r)
 	}
-	s.End()
 
-	read, err = rd.LLen(keyMessages(chanID)).Result()
+	read, err = messageStore.Count(txn, chanID)
 	if err != nil {
-		log.Println("Failed to queryResponse2:", err)
+		txn.Error("Failed to queryResponse2:", err)
 		return
 	}
 
@@ -587,42 +607,35 @@ func getMessage(c echo.Context) error {
 
 	chanID, err := strconv.ParseInt(c.QueryParam("channel_id"), 10, 64)
 	if err != nil {
-		log.Println("Failed to getMessage:", err)
+		txn.Error("Failed to getMessage:", err)
 		return err
 	}
 	lastID, err := strconv.ParseInt(c.QueryParam("last_message_id"), 10, 64)
 	if err != nil {
-		log.Println("Failed to getMessage:", err)
+		txn.Error("Failed to getMessage:", err)
 		return err
 	}
 
 	response, read, err := queryResponse(txn, chanID, lastID)
 
 	if len(response) > 0 {
-		err := rd.Set(keyHaveread(userID, chanID), read, 0).Err()
+		err := readStateStore.Set(txn, userID, chanID, read)
 		if err != nil {
-			log.Println("Failed to getMessage:", err)
+			txn.Error("Failed to getMessage:", err)
 			return err
 		}
 	}
 
+	messagesDelivered.Add(float64(len(response)))
 	return c.JSON(http.StatusOK, response)
 }
 
-func queryChannels(txn newrelic.Transaction) ([]int64, error) {
-	res := []int64{}
-	s := StartMySQLSegment(txn, "channel", "SELECT")
-	err := db.Select(&res, "SELECT id FROM channel")
-	s.End()
-	return res, err
+func queryChannelInfos(txn *Transaction) ([]ChannelInfo, error) {
+	return channelStore.List(txn)
 }
 
-func queryHaveRead(txn newrelic.Transaction, userID, chID int64) (int64, error) {
-	id, err := rd.Get(keyHaveread(userID, chID)).Int64()
-	if err == redis.Nil {
-		return 0, nil
-	}
-	return id, err
+func queryChannels(txn *Transaction) ([]int64, error) {
+	return channelStore.IDs(txn)
 }
 
 func fetchUnread(c echo.Context) error {
@@ -637,27 +650,28 @@ func fetchUnread(c echo.Context) error {
 
 	channels, err := queryChannels(txn)
 	if err != nil {
-		log.Println("Failed to fetchUnread1:", err)
+		txn.Error("Failed to fetchUnread1:", err)
 		return err
 	}
 
 	resp := []map[string]interface{}{}
 
-	for _, chID := range channels {
-		read, err := queryHaveRead(txn, userID, chID)
-		if err != nil {
-			log.Println("Failed to fetchUnread2:", err)
-			return err
-		}
+	reads, err := readStateStore.GetAll(txn, userID, channels)
+	if err != nil {
+		txn.Error("Failed to fetchUnread2:", err)
+		return err
+	}
+	counts, err := messageStore.Counts(txn, channels)
+	if err != nil {
+		txn.Error("Failed to fetchUnread2.5:", err)
+	}
 
-		max, err := rd.LLen(keyMessages(chID)).Result()
-		if err == redis.Nil {
-			max = 0
-		} else if err != nil {
-			log.Println("Failed to fetchUnread2.5:", err)
+	for _, chID := range channels {
+		cnt := counts[chID] - reads[chID]
+		if cnt < 0 {
+			// messages were deleted after they had been read
+			cnt = 0
 		}
-
-		cnt := max - read
 		r := map[string]interface{}{
 			"channel_id": chID,
 			"unread":     cnt}
@@ -692,11 +706,9 @@ func getHistory(c echo.Context) error {
 	}
 
 	const N = 20
-	cnt, err := rd.LLen(keyMessages(chID)).Result()
-	if err == redis.Nil {
-		cnt = 0
-	} else if err != nil {
-		log.Println("Failed to getHistory1:", err)
+	cnt, err := messageStore.Count(txn, chID)
+	if err != nil {
+		txn.Error("Failed to getHistory1:", err)
 	}
 	maxPage := int64(cnt+N-1) / N
 	if maxPage == 0 {
@@ -706,29 +718,26 @@ func getHistory(c echo.Context) error {
 		return ErrBadReqeust
 	}
 
-	unifieds, err := rd.LRange(keyMessages(chID), (page - 1) * N, page * N - 1).Result()
+	msgs, err := messageStore.Page(txn, chID, (page - 1) * N, N)
 	if err != nil {
-		log.Println("Failed to getHistory2:", err)
+		txn.Error("Failed to getHistory2:", err)
 		return err
 	}
 
 	mjson := make([]map[string]interface{}, 0)
-	for i := len(unifieds) - 1; i >= 0; i-- {
-		id, uid, content, at := splitMessage(unifieds[i])
-		r, err := jsonifyMessage(txn, id, uid, content, at)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		r, err := jsonifyMessage(txn, m.ID, m.UserID, m.Content, m.CreatedAt.Format("2006/01/02 15:04:05"))
 		if err != nil {
-			log.Println("Failed to getHistory3:", err)
+			txn.Error("Failed to getHistory3:", err)
 			return err
 		}
 		mjson = append(mjson, r)
 	}
 
-	channels := []ChannelInfo{}
-	s3 := StartMySQLSegment(txn, "channel", "SELECT")
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
-	s3.End()
+	channels, err := channelStore.List(txn)
 	if err != nil {
-		log.Println("Failed to getHistory4:", err)
+		txn.Error("Failed to getHistory4:", err)
 		return err
 	}
 
@@ -750,25 +759,24 @@ func getProfile(c echo.Context) error {
 		return err
 	}
 
-	channels := []ChannelInfo{}
-	s1 := StartMySQLSegment(txn, "channel", "SELECT")
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
-	s1.End()
+	channels, err := channelStore.List(txn)
 	if err != nil {
-		log.Println("Failed to getProfile1:", err)
+		txn.Error("Failed to getProfile1:", err)
 		return err
 	}
 
 	userName := c.Param("user_name")
-	var other User
-	s2 := StartMySQLSegment(txn, "user", "SELECT")
-	err = db.Get(&other, "SELECT * FROM user WHERE name = ?", userName)
-	s2.End()
-	if err == sql.ErrNoRows {
+	other, err := userStore.GetByName(txn, userName)
+	if err != nil {
+		txn.Error("Failed to getProfile2:", err)
+		return err
+	}
+	if other == nil {
 		return echo.ErrNotFound
 	}
+
+	t, err := getUserTOTP(txn, self.ID)
 	if err != nil {
-		log.Println("Failed to getProfile2:", err)
 		return err
 	}
 
@@ -778,6 +786,7 @@ func getProfile(c echo.Context) error {
 		"User":        self,
 		"Other":       other,
 		"SelfProfile": self.ID == other.ID,
+		"TOTPEnabled": t != nil,
 	})
 }
 
@@ -789,12 +798,9 @@ func getAddChannel(c echo.Context) error {
 		return err
 	}
 
-	channels := []ChannelInfo{}
-	s := StartMySQLSegment(txn, "channel", "SELECT")
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
-	s.End()
+	channels, err := channelStore.List(txn)
 	if err != nil {
-		log.Println("Failed to getAddChannel:", err)
+		txn.Error("Failed to getAddChannel:", err)
 		return err
 	}
 
@@ -819,16 +825,12 @@ func postAddChannel(c echo.Context) error {
 		return ErrBadReqeust
 	}
 
-	s := StartMySQLSegment(txn, "channel", "INSERT")
-	res, err := db.Exec(
-		"INSERT INTO channel (name, description, updated_at, created_at) VALUES (?, ?, NOW(), NOW())",
-		name, desc)
-	s.End()
+	lastID, err := channelStore.Create(txn, name, desc, self.ID)
 	if err != nil {
-		log.Println("Failed to postAddChannel:", err)
+		txn.Error("Failed to postAddChannel:", err)
 		return err
 	}
-	lastID, _ := res.LastInsertId()
+	audit(txn, c, auditChannelCreate, self, "channel", lastID, name, desc)
 	return c.Redirect(http.StatusSeeOther,
 		fmt.Sprintf("/channel/%v", lastID))
 }
@@ -841,195 +843,187 @@ func postProfile(c echo.Context) error {
 		return err
 	}
 
-	avatarName := ""
-	var avatarData []byte
+	form, file, err := readUpload(c, "avatar_icon", "", avatarMaxBytes)
+	if err != nil {
+		txn.Error("Failed to postProfile1:", err)
+		return uploadError(err)
+	}
 
-	if fh, err := c.FormFile("avatar_icon"); err == http.ErrMissingFile {
-		// no file upload
-	} else if err != nil {
-		log.Println("Failed to postProfile1:", err)
-		return err
-	} else {
-		dotPos := strings.LastIndexByte(fh.Filename, '.')
-		if dotPos < 0 {
-			return ErrBadReqeust
+	if file != nil {
+		defer file.Close()
+		if err := uploadAvatar(txn, c, self, file); err != nil {
+			return err
 		}
-		ext := fh.Filename[dotPos:]
-		switch ext {
-		case ".jpg", ".jpeg", ".png", ".gif":
-			break
-		default:
-			return ErrBadReqeust
+	} else if form.Get("reset_avatar") == "1" {
+		if err := resetAvatar(txn, c, self); err != nil {
+			return err
 		}
+	}
 
-		file, err := fh.Open()
-		if err != nil {
-			log.Println("Failed to PostProfile2:", err)
+	if name := form.Get("display_name"); name != "" {
+		if err := setDisplayName(txn, c, self, name); err != nil {
 			return err
 		}
-		avatarData, _ = ioutil.ReadAll(file)
-		file.Close()
+	}
 
-		if len(avatarData) > avatarMaxBytes {
-			return ErrBadReqeust
-		}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
 
-		avatarName = fmt.Sprintf("%x%s", sha1.Sum(avatarData), ext)
+// uploadAvatar normalizes an uploaded image, stores it and makes it the
+// user's icon.
+func uploadAvatar(txn *Transaction, c echo.Context, self *User, file *spooledFile) error {
+	ext := file.Ext()
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		break
+	default:
+		return ErrBadReqeust
 	}
 
-	if avatarName != "" && len(avatarData) > 0 {
-		for _, host := range hosts {
-			toURL := "http://" + host + "/icons/" + avatarName
-			body := &bytes.Buffer{}
-			writer := multipart.NewWriter(body)
-			part, err := writer.CreateFormFile("avatar_icon", avatarName)
-			if err != nil {
-				log.Println("Failed to PostProfile2.1:", err)
-				return err
-			}
-			_, err = io.Copy(part, bytes.NewReader(avatarData))
-			if err != nil {
-				log.Println("Failed to PostProfile2.2:", err)
-				return err
-			}
-			err = writer.Close()
-			if err != nil {
-				log.Println("Failed to PostProfile2.3:", err)
-				return err
-			}
-			req, err := http.NewRequest(http.MethodPost, toURL, body)
-			req.Header.Set("Content-Type", writer.FormDataContentType())
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				log.Println("Failed to PostProfile2.7:", err)
-				return err
-			}
-			resp.Body.Close()
-		}
-		s2 := StartMySQLSegment(txn, "user", "UPDATE")
-		_, err = db.Exec("UPDATE user SET avatar_icon = ? WHERE id = ?", avatarName, self.ID)
-		s2.End()
-		if err != nil {
-			log.Println("Failed to PostProfile4:", err)
-			return err
-		}
+	data, ext, err := normalizeAvatar(file, ext)
+	if err != nil {
+		txn.Error("Failed to PostProfile2.5:", err)
+		return ErrBadReqeust
+	}
+	name := fmt.Sprintf("%x%s", sha1.Sum(data), ext)
+	if err := saveAvatar(txn, name, data); err != nil {
+		txn.Error("Failed to PostProfile3:", err)
+		return err
 	}
+	return setAvatarIcon(txn, c, self, name)
+}
 
-	if name := c.FormValue("display_name"); name != "" {
-		s := StartMySQLSegment(txn, "user", "UPDATE")
-		_, err := db.Exec("UPDATE user SET display_name = ? WHERE id = ?", name, self.ID)
-		s.End()
-		if err != nil {
-			log.Println("Failed to PostProfile5:", err)
-			return err
-		}
+// resetAvatar gives the user a generated icon again.
+func resetAvatar(txn *Transaction, c echo.Context, self *User) error {
+	name, err := generateAvatar(txn, self.Name)
+	if err != nil {
+		txn.Error("Failed to PostProfile2:", err)
+		return err
 	}
+	return setAvatarIcon(txn, c, self, name)
+}
 
-	return c.Redirect(http.StatusSeeOther, "/")
+func setAvatarIcon(txn *Transaction, c echo.Context, self *User, name string) error {
+	if err := userStore.SetAvatarIcon(txn, self.ID, name); err != nil {
+		txn.Error("Failed to PostProfile4:", err)
+		return err
+	}
+	audit(txn, c, auditProfileAvatar, self, "user", self.ID, self.Name,
+		self.AvatarIcon+" -> "+name)
+	self.AvatarIcon = name
+	return nil
+}
+
+func setDisplayName(txn *Transaction, c echo.Context, self *User, name string) error {
+	if err := userStore.SetDisplayName(txn, self.ID, name); err != nil {
+		txn.Error("Failed to PostProfile5:", err)
+		return err
+	}
+	audit(txn, c, auditProfileName, self, "user", self.ID, self.Name,
+		self.DisplayName+" -> "+name)
+	self.DisplayName = name
+	return nil
 }
 
 func getIcon(c echo.Context) error {
 	txn := app.StartTransaction("getIcon", c.Response().Writer, c.Request())
 	defer txn.End()
 	fname := c.Param("file_name")
-	fpath := iconsDir + "/" + fname
-	if _, err := os.Stat(fpath); os.IsNotExist(err) {
-		log.Println("UNEXPECTED load icon from mysql:", fname)
-		var name string
-		var data []byte
-		s := StartMySQLSegment(txn, "image", "SELECT")
-		err := db.QueryRow("SELECT name, data FROM image WHERE name = ?",
-			fname).Scan(&name, &data)
-		s.End()
-		if err == sql.ErrNoRows {
-			return echo.ErrNotFound
+	askPeers := c.Request().Header.Get(peerHeader) == ""
+	if s := c.QueryParam("s"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || !validIconSize(size) {
+			return ErrBadReqeust
 		}
+		if size != avatarSize {
+			err := ensureIconVariant(txn, fname, size, askPeers)
+			if err == errIconNotFound {
+				return echo.ErrNotFound
+			} else if err != nil {
+				txn.Error("Failed to getIcon0:", err)
+				return err
+			}
+			fname = iconVariantName(fname, size)
+		}
+	}
+	// Icon names are content hashes, so a matching ETag means the client
+	// already has exactly this file, as long as the file still exists.
+	etag := iconETag(fname)
+	cached := etagMatch(c.Request().Header.Get("If-None-Match"), etag)
+	if cached {
+		ok, err := iconStore.Exists(fname)
 		if err != nil {
-			log.Println("Failed to getIcon1:", err)
+			txn.Error("Failed to getIcon2:", err)
 			return err
 		}
-
-		mime := ""
-		switch true {
-		case strings.HasSuffix(name, ".jpg"), strings.HasSuffix(name, ".jpeg"):
-			mime = "image/jpeg"
-		case strings.HasSuffix(name, ".png"):
-			mime = "image/png"
-		case strings.HasSuffix(name, ".gif"):
-			mime = "image/gif"
-		default:
-			return echo.ErrNotFound
+		if ok {
+			setIconCacheHeaders(c.Response().Header(), etag)
+			return c.NoContent(http.StatusNotModified)
 		}
-		return c.Blob(http.StatusOK, mime, data)
-	} else if err != nil {
-		log.Println("Failed to getIcon2:", err)
-		return err
 	}
-	ifms := time.Date(2000,1,1,1,1,1,1, time.UTC)
-	if c.Request().Header.Get("If-Modified-Since") == ifms.Format(http.TimeFormat) {
-		log.Println("return 304")
-		c.String(http.StatusNotModified, "")
-		return nil
+
+	data, err := loadIcon(txn, fname, askPeers)
+	if err == errIconNotFound {
+		return echo.ErrNotFound
 	}
-	w := c.Response().Writer
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-	w.Header().Set("Last-Modified", ifms.Format(http.TimeFormat))
-	file, err := os.Open(fpath)
 	if err != nil {
-		log.Println("Failed to getIcon4:", err)
+		txn.Error("Failed to getIcon1:", err)
 		return err
 	}
-	defer file.Close()
-	http.ServeContent(w, c.Request(), fpath, ifms, file)
-	return nil
+	if cached {
+		setIconCacheHeaders(c.Response().Header(), etag)
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	// Icons stored before uploads were validated may carry the wrong
+	// extension, so trust the content rather than the name.
+	mime := http.DetectContentType(data)
+	switch mime {
+	case "image/jpeg", "image/png", "image/gif":
+		break
+	default:
+		return echo.ErrNotFound
+	}
+	h := c.Response().Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	setIconCacheHeaders(h, etag)
+	return c.Blob(http.StatusOK, mime, data)
 }
 
 func postIcon(c echo.Context) error {
 	txn := app.StartTransaction("postIcon", c.Response().Writer, c.Request())
 	defer txn.End()
 
-	avatarName := ""
-	var avatarData []byte
-
-	if fh, err := c.FormFile("avatar_icon"); err == http.ErrMissingFile {
-		// no file upload
-	} else if err != nil {
-		log.Println("Failed to postIcon1:", err)
-		return err
-	} else {
-		dotPos := strings.LastIndexByte(fh.Filename, '.')
-		if dotPos < 0 {
-			return ErrBadReqeust
-		}
-		ext := fh.Filename[dotPos:]
-		switch ext {
-		case ".jpg", ".jpeg", ".png", ".gif":
-			break
-		default:
-			return ErrBadReqeust
-		}
-
-		file, err := fh.Open()
-		if err != nil {
-			log.Println("Failed to PostIcon2:", err)
-			return err
-		}
-		avatarData, _ = ioutil.ReadAll(file)
-		file.Close()
+	_, file, err := readUpload(c, "avatar_icon", uploadDir(), avatarMaxBytes)
+	if err != nil {
+		txn.Error("Failed to postIcon1:", err)
+		return uploadError(err)
+	}
+	if file == nil {
+		return c.NoContent(http.StatusOK)
+	}
+	defer file.Close()
 
-		if len(avatarData) > avatarMaxBytes {
-			return ErrBadReqeust
+	ext, err := avatarExt(file, file.Ext())
+	if err == nil {
+		file.Seek(0, io.SeekStart)
+		if !isNormalizedAvatar(file) {
+			err = errAvatarFormat
 		}
-
-		avatarName = fmt.Sprintf("%x%s", sha1.Sum(avatarData), ext)
+	}
+	if err != nil {
+		txn.Error("Failed to PostIcon2.5:", err)
+		return ErrBadReqeust
+	}
+	avatarName := file.SHA1 + ext
+	if avatarName != c.Param("file_name") {
+		txn.Error("Failed to PostIcon2.6: content does not match", c.Param("file_name"))
+		return ErrBadReqeust
 	}
 
-	if avatarName != "" && len(avatarData) > 0 {
-		err := ioutil.WriteFile(iconsDir + "/" + avatarName, avatarData, 0777)
-		if err != nil {
-			log.Println("Failed to PostIcon3:", err)
-			return err
-		}
+	if err := storeIconFile(avatarName, file); err != nil {
+		txn.Error("Failed to PostIcon3:", err)
+		return err
 	}
 
 	return c.NoContent(http.StatusOK)
@@ -1047,49 +1041,121 @@ func tRange(a, b int64) []int64 {
 	return r
 }
 
-func main() {
-	cfg := newrelic.NewConfig("Isubata", os.Getenv("NEW_RELIC_KEY"))
-	a, err := newrelic.NewApplication(cfg)
-	if err != nil {
-		log.Fatalln("Failed to connect to New Relic:", err)
-	}
-	app = a
-
-	e := echo.New()
-	funcs := template.FuncMap{
-		"add":    tAdd,
-		"xrange": tRange,
-	}
-	e.Renderer = &Renderer{
-		templates: template.Must(template.New("").Funcs(funcs).ParseGlob("views/*.html")),
-	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secretonymoris"))))
-	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "request:\"${method} ${uri}\" status:${status} latency:${latency} (${latency_human}) bytes:${bytes_out}\n",
-	}))
-	e.Use(middleware.Static("../public"))
-
-	e.GET("/initialize", getInitialize)
+// registerRoutes adds every route. Each one needs an entry in routeDocs
+// (openapi.go). Routes for features that keep their state in MySQL
+// whatever the store are marked with requireMySQLStore.
+func registerRoutes(e *echo.Echo) {
+	e.GET("/healthz", getHealthz)
+	e.GET("/readyz", getReadyz)
+	e.GET("/metrics", getMetrics)
+	e.GET("/initialize", getInitialize, requireMySQLStore)
 	e.GET("/", getIndex)
 	e.GET("/register", getRegister)
 	e.POST("/register", postRegister)
 	e.GET("/login", getLogin)
 	e.POST("/login", postLogin)
 	e.GET("/logout", getLogout)
+	e.GET("/login/2fa", getLogin2FA)
+	e.POST("/login/2fa", postLogin2FA)
 
 	e.GET("/channel/:channel_id", getChannel)
+	e.GET("/channel/:channel_id/webhooks", getChannelWebhooks, requireMySQLStore)
+	e.POST("/channel/:channel_id/webhooks", postChannelWebhooks, requireMySQLStore)
+	e.POST("/channel/:channel_id/webhooks/:webhook_id/delete", postChannelWebhookDelete, requireMySQLStore)
+	e.POST("/channel/:channel_id/webhooks/:webhook_id/enable", postChannelWebhookEnable, requireMySQLStore)
+	e.POST("/channel/:channel_id/incoming_webhooks", postChannelIncomingWebhooks, requireMySQLStore)
+	e.POST("/channel/:channel_id/incoming_webhooks/:webhook_id/delete", postChannelIncomingWebhookDelete, requireMySQLStore)
+	e.POST("/hooks/:webhook_id/:token", postIncomingWebhook, limitBody(incomingMaxBody), requireMySQLStore)
 	e.GET("/message", getMessage)
 	e.POST("/message", postMessage)
 	e.GET("/fetch", fetchUnread)
 	e.GET("/history/:channel_id", getHistory)
 
 	e.GET("/profile/:user_name", getProfile)
-	e.POST("/profile", postProfile)
+	e.POST("/profile", postProfile, limitBody(uploadMaxFormSize))
+	e.GET("/2fa/setup", getTOTPSetup)
+	e.POST("/2fa/setup", postTOTPSetup)
+	e.GET("/2fa/qr.png", getTOTPQRCode)
+	e.POST("/2fa/recovery", postTOTPRecovery)
+	e.POST("/2fa/disable", postTOTPDisable)
 
 	e.GET("add_channel", getAddChannel)
 	e.POST("add_channel", postAddChannel)
 	e.GET("/icons/:file_name", getIcon)
-	e.POST("/icons/:file_name", postIcon)
 
-	e.Start(":5000")
+	e.GET("/admin", getAdmin, requireMySQLStore)
+	e.GET("/admin/users", getAdminUsers, requireMySQLStore)
+	e.POST("/admin/users/:user_id/suspend", postAdminSuspend, requireMySQLStore)
+	e.POST("/admin/users/:user_id/ban", postAdminBan, requireMySQLStore)
+	e.POST("/admin/users/:user_id/reinstate", postAdminReinstate, requireMySQLStore)
+	e.POST("/admin/users/:user_id/revoke_sessions", postAdminRevokeSessions, requireMySQLStore)
+	e.POST("/admin/users/:user_id/role", postAdminRole, requireMySQLStore)
+	e.POST("/admin/users/:user_id/reset_name", postAdminResetName, requireMySQLStore)
+	e.POST("/admin/users/:user_id/reset_avatar", postAdminResetAvatar, requireMySQLStore)
+	e.POST("/admin/messages/:message_id/delete", postAdminDeleteMessage, requireMySQLStore)
+	e.POST("/admin/channels/:channel_id/delete", postAdminDeleteChannel, requireMySQLStore)
+	e.POST("/admin/settings", postAdminSettings, requireMySQLStore)
+	e.POST("/admin/log_level", postAdminLogLevel, requireMySQLStore)
+	e.GET("/admin/replication", getAdminReplication, requireMySQLStore)
+	e.POST("/admin/replication/repair", postAdminReplicationRepair, requireMySQLStore)
+	e.GET("/admin/icons/gc", getAdminIconGC, requireMySQLStore)
+	e.POST("/admin/icons/gc", postAdminIconGC, requireMySQLStore)
+	e.GET("/admin/audit", getAdminAudit, requireMySQLStore)
+	e.GET("/admin/audit.json", getAdminAuditExport, requireMySQLStore)
+	e.POST("/icons/:file_name", postIcon, requirePeerSignature, requireMySQLStore)
+	e.DELETE("/icons/:file_name", deleteIcon, requirePeerSignature, requireMySQLStore)
+	e.GET("/internal/icons", getInternalIcons, requirePeerSignature, requireMySQLStore)
+	registerAPI(e)
+	e.GET("/openapi.json", getOpenAPI)
+}
+
+func main() {
+	c, printOnly, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if printOnly {
+		c.Print(os.Stdout)
+		return
+	}
+	config = c
+	if len(args) > 0 {
+		if err := runCommand(args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	setup()
+
+	e, err := newServer()
+	if err != nil {
+		log.Fatalln("Failed to initOpenAPI:", err)
+	}
+	go connectDependencies()
+	serve(e)
+}
+
+// newServer sets up echo with the middleware and every route.
+func newServer() (*echo.Echo, error) {
+	e := echo.New()
+	quietEcho(e)
+	funcs := template.FuncMap{
+		"add":    tAdd,
+		"xrange": tRange,
+	}
+	e.Renderer = &Renderer{
+		templates: template.Must(template.New("").Funcs(funcs).ParseGlob("views/*.html")),
+	}
+	e.Use(logRequests)
+	e.Use(app.Middleware)
+	e.Use(requireStarted)
+	e.Use(session.Middleware(sessions.NewCookieStore([]byte(config.SessionSecret))))
+	e.Use(middleware.Static(config.PublicDir))
+
+	registerRoutes(e)
+	if err := initOpenAPI(e); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
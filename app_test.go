@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestServer serves the app from the memory stores.
+func newTestServer(t *testing.T) *httptest.Server {
+	config = defaultConfig()
+	config.Store = "memory"
+	config.SessionSecret = "test"
+	config.Icons.Storage = "memory"
+	config.Telemetry.Disabled = true
+	if err := initStores(config.Store); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newBlobStore(config.Icons)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iconStore, seedStore = store, store
+	localTOTPFailures.m = map[int64]totpFailures{}
+	app = newTelemetry(config.Telemetry, "")
+	health.Lock()
+	health.started = true
+	health.Unlock()
+
+	e, err := newServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(e)
+}
+
+// testClient keeps the session cookie and does not follow redirects.
+type testClient struct {
+	t      *testing.T
+	base   string
+	client *http.Client
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{t: t, base: srv.URL, client: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+func (tc *testClient) do(method, path string, form url.Values) (int, http.Header, string) {
+	var req *http.Request
+	var err error
+	if form != nil {
+		req, err = http.NewRequest(method, tc.base+path, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(method, tc.base+path, nil)
+	}
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return tc.send(req)
+}
+
+// send makes a request built by the caller against the test server.
+func (tc *testClient) send(req *http.Request) (int, http.Header, string) {
+	resp, err := tc.client.Do(req)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(body)
+}
+
+func (tc *testClient) expect(method, path string, form url.Values, status int) string {
+	got, _, body := tc.do(method, path, form)
+	if got != status {
+		tc.t.Fatalf("%s %s: status %d, want %d: %s", method, path, got, status, body)
+	}
+	return body
+}
+
+func TestPostAndReadMessages(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	tc := newTestClient(t, srv)
+
+	tc.expect("POST", "/register", url.Values{"name": {"alice"}, "password": {"pw"}}, http.StatusSeeOther)
+	_, h, _ := tc.do("GET", "/", nil)
+	if loc := h.Get("Location"); loc != "/channel/1" {
+		t.Fatalf("logged-in / redirects to %q, want /channel/1", loc)
+	}
+	if body := tc.expect("GET", "/channel/1", nil, http.StatusOK); !strings.Contains(body, "general") {
+		t.Errorf("channel page does not list the general channel")
+	}
+
+	tc.expect("POST", "/message", url.Values{"channel_id": {"1"}, "message": {"こんにちは"}}, http.StatusNoContent)
+	body := tc.expect("GET", "/message?channel_id=1&last_message_id=0", nil, http.StatusOK)
+	var msgs []struct {
+		Content string `json:"content"`
+		User    struct {
+			Name string `json:"name"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal([]byte(body), &msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Content != "こんにちは" || msgs[0].User.Name != "alice" {
+		t.Fatalf("got messages %+v", msgs)
+	}
+
+	count, err := messageStore.Count(nil, 1)
+	if err != nil || count != 1 {
+		t.Fatalf("count %d, %v", count, err)
+	}
+	read, err := readStateStore.Get(nil, 1, 1)
+	if err != nil || read != 1 {
+		t.Fatalf("read state %d, %v, want 1", read, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	newTestClient(t, srv).expect("POST", "/register", url.Values{"name": {"bob"}, "password": {"secret"}}, http.StatusSeeOther)
+
+	tc := newTestClient(t, srv)
+	tc.expect("POST", "/login", url.Values{"name": {"bob"}, "password": {"wrong"}}, http.StatusForbidden)
+	tc.expect("GET", "/channel/1", nil, http.StatusSeeOther)
+	tc.expect("POST", "/login", url.Values{"name": {"bob"}, "password": {"secret"}}, http.StatusSeeOther)
+	tc.expect("GET", "/channel/1", nil, http.StatusOK)
+
+	m := auditStore.(*memoryAuditStore)
+	var actions []string
+	for _, e := range m.audit {
+		actions = append(actions, e.Action)
+	}
+	if got, want := strings.Join(actions, ","), "register,login_failed,login"; got != want {
+		t.Errorf("audit actions %s, want %s", got, want)
+	}
+}
+
+func TestAddChannel(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	tc := newTestClient(t, srv)
+	tc.expect("POST", "/register", url.Values{"name": {"carol"}, "password": {"pw"}}, http.StatusSeeOther)
+
+	_, h, _ := tc.do("POST", "/add_channel", url.Values{"name": {"random"}, "description": {"雑談"}})
+	if loc := h.Get("Location"); loc != "/channel/2" {
+		t.Fatalf("add_channel redirects to %q, want /channel/2", loc)
+	}
+	channels, err := channelStore.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 || channels[1].Name != "random" || channels[1].OwnerID != 1 {
+		t.Fatalf("got channels %+v", channels)
+	}
+	tc.expect("GET", "/history/2", nil, http.StatusOK)
+}
+
+func TestMySQLOnlyRoutes(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	tc := newTestClient(t, srv)
+	tc.expect("POST", "/register", url.Values{"name": {"dave"}, "password": {"pw"}}, http.StatusSeeOther)
+
+	tc.expect("GET", "/admin", nil, http.StatusServiceUnavailable)
+	tc.expect("GET", "/admin/audit", nil, http.StatusServiceUnavailable)
+	tc.expect("GET", "/channel/1/webhooks", nil, http.StatusServiceUnavailable)
+}
+
+func TestIconNotModified(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	if err := iconStore.Put("present.png", []byte("\x89PNG\r\n\x1a\n")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{
+		"present.png": http.StatusNotModified,
+		"missing.png": http.StatusNotFound,
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/icons/"+name, nil)
+		req.Header.Set("If-None-Match", iconETag(name))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: status %d, want %d", name, resp.StatusCode, want)
+		}
+	}
+}
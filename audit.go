@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+// Audit actions.
+const (
+	auditLogin          = "login"
+	auditLoginFailed    = "login_failed"
+	auditRegister       = "register"
+	auditProfileName    = "profile_display_name"
+	auditProfileAvatar  = "profile_avatar"
+	auditTOTPEnabled    = "2fa_enabled"
+	auditTOTPDisabled   = "2fa_disabled"
+	auditTOTPRecovery   = "2fa_recovery_reset"
+	auditTOTPFailed     = "2fa_failed"
+	auditChannelCreate  = "channel_create"
+	auditAdminSuspend   = "admin_suspend"
+	auditAdminBan       = "admin_ban"
+	auditAdminReinstate = "admin_reinstate"
+	auditAdminRevoke    = "admin_revoke_sessions"
+	auditAdminRole      = "admin_role"
+	auditAdminResetName = "admin_reset_display_name"
+	auditAdminResetIcon = "admin_reset_avatar"
+	auditAdminDeleteMsg = "admin_delete_message"
+	auditAdminDeleteCh  = "admin_delete_channel"
+	auditAdminSettings  = "admin_settings"
+	auditAdminIconGC    = "admin_icon_gc"
+	auditAdminLogLevel  = "admin_log_level"
+	auditWebhookCreate  = "webhook_create"
+	auditWebhookDelete  = "webhook_delete"
+	auditWebhookEnable  = "webhook_enable"
+	auditIncomingCreate = "incoming_webhook_create"
+	auditIncomingDelete = "incoming_webhook_delete"
+)
+
+const auditExportMax = 10000
+
+type AuditEntry struct {
+	ID         int64     `json:"id" db:"id"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	Action     string    `json:"action" db:"action"`
+	ActorID    int64     `json:"actor_id" db:"actor_id"`
+	ActorName  string    `json:"actor_name" db:"actor_name"`
+	TargetType string    `json:"target_type" db:"target_type"`
+	TargetID   int64     `json:"target_id" db:"target_id"`
+	TargetName string    `json:"target_name" db:"target_name"`
+	IP         string    `json:"ip" db:"ip"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	Detail     string    `json:"detail" db:"detail"`
+}
+
+// truncateRunes shortens s to at most n runes, the unit of VARCHAR
+// lengths, without splitting one.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// trustedProxies are the reverse proxies whose forwarding headers
+// clientIP believes.
+var trustedProxies []*net.IPNet
+
+// parseProxies parses addresses and CIDR ranges.
+func parseProxies(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a CIDR range", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the client's address. Unlike echo's RealIP, it only
+// believes X-Forwarded-For and X-Real-IP from a trusted proxy, and takes
+// the nearest hop in X-Forwarded-For that is not one.
+func clientIP(c echo.Context) string {
+	req := c.Request()
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	if xff := req.Header[echo.HeaderXForwardedFor]; len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !trustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := req.Header.Get(echo.HeaderXRealIP); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+// audit records a security-relevant event. actor may be nil for
+// anonymous requests. Failures are logged but never fail the request.
+func audit(txn *Transaction, c echo.Context, action string, actor *User, targetType string, targetID int64, targetName, detail string) {
+	var actorID int64
+	var actorName string
+	if actor != nil {
+		actorID, actorName = actor.ID, actor.Name
+	}
+	err := auditStore.Add(txn, &AuditEntry{
+		Action:     action,
+		ActorID:    actorID,
+		ActorName:  actorName,
+		TargetType: targetType,
+		TargetID:   targetID,
+		TargetName: truncateRunes(targetName, 255),
+		IP:         truncateRunes(clientIP(c), 64),
+		UserAgent:  truncateRunes(c.Request().UserAgent(), 255),
+		Detail:     detail,
+	})
+	if err != nil {
+		txn.Error("Failed to audit:", action, err)
+	}
+}
+
+// auditFilter builds the WHERE clause shared by the audit page and export.
+func auditFilter(c echo.Context) (string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+	if v := c.QueryParam("action"); v != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, v)
+	}
+	if v := c.QueryParam("actor"); v != "" {
+		conds = append(conds, "actor_name = ?")
+		args = append(args, v)
+	}
+	if v := c.QueryParam("target"); v != "" {
+		conds = append(conds, "target_name = ?")
+		args = append(args, v)
+	}
+	if v := c.QueryParam("ip"); v != "" {
+		conds = append(conds, "ip = ?")
+		args = append(args, v)
+	}
+	for _, p := range []struct{ param, cond string }{
+		{"since", "created_at >= ?"},
+		{"until", "created_at < ?"},
+	} {
+		v := c.QueryParam(p.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, v)
+		}
+		if err != nil {
+			return "", nil, ErrBadReqeust
+		}
+		conds = append(conds, p.cond)
+		args = append(args, t)
+	}
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// request handlers
+
+func getAdminAudit(c echo.Context) error {
+	txn := app.StartTransaction("getAdminAudit", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	where, args, err := auditFilter(c)
+	if err != nil {
+		return err
+	}
+	const N = 100
+	page, err := strconv.ParseInt(c.QueryParam("page"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	entries := []AuditEntry{}
+	s := StartMySQLSegment(txn, "audit_log", "SELECT")
+	err = db.Select(&entries, "SELECT * FROM audit_log"+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, N+1, (page-1)*N)...)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to getAdminAudit1:", err)
+		return err
+	}
+	hasNext := len(entries) > N
+	if hasNext {
+		entries = entries[:N]
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		txn.Error("Failed to getAdminAudit2:", err)
+		return err
+	}
+
+	filter := map[string]string{}
+	for _, k := range []string{"action", "actor", "target", "ip", "since", "until"} {
+		filter[k] = c.QueryParam(k)
+	}
+	pageURL := func(p int64) string {
+		query := c.Request().URL.Query()
+		query.Set("page", strconv.FormatInt(p, 10))
+		return "/admin/audit?" + query.Encode()
+	}
+	query := c.Request().URL.Query()
+	query.Del("page")
+	return c.Render(http.StatusOK, "admin_audit", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  channels,
+		"User":      self,
+		"Entries":   entries,
+		"Filter":    filter,
+		"Page":      page,
+		"PrevURL":   pageURL(page - 1),
+		"NextURL":   pageURL(page + 1),
+		"HasNext":   hasNext,
+		"ExportURL": "/admin/audit.json?" + query.Encode(),
+	})
+}
+
+func getAdminAuditExport(c echo.Context) error {
+	txn := app.StartTransaction("getAdminAuditExport", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	where, args, err := auditFilter(c)
+	if err != nil {
+		return err
+	}
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 1 || limit > auditExportMax {
+		limit = auditExportMax
+	}
+
+	entries := []AuditEntry{}
+	s := StartMySQLSegment(txn, "audit_log", "SELECT")
+	err = db.Select(&entries, "SELECT * FROM audit_log"+where+" ORDER BY id DESC LIMIT ?",
+		append(args, limit)...)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to getAdminAuditExport:", err)
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit.json"`)
+	return c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, _ = parseProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	defer func() { trustedProxies = nil }()
+	e := echo.New()
+	for _, tt := range []struct {
+		remote, xff, realIP, want string
+	}{
+		{"203.0.113.5:1234", "198.51.100.1", "", "203.0.113.5"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "garbage, 198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "198.51.100.2", "198.51.100.2"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, tt.xff)
+		}
+		if tt.realIP != "" {
+			req.Header.Set(echo.HeaderXRealIP, tt.realIP)
+		}
+		if got := clientIP(e.NewContext(req, httptest.NewRecorder())); got != tt.want {
+			t.Errorf("%s via %q: got %s, want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// The messages:<channel> lists in Redis mirror the message table, newest
+// first. `isubata cache rebuild` recreates them from MySQL without
+// touching anything else, and `isubata cache verify` reports where they
+// diverge. Rows are streamed and pushed in pipelined batches, so memory
+// use does not grow with the size of a channel.
+
+const (
+	cacheBatch   = 1000
+	cacheLockKey = "messagecache:lock"
+	cacheLockTTL = 30 * time.Minute
+)
+
+var errCacheLocked = errors.New("another message cache rebuild is running")
+
+// cacheChannels returns the channels named in args, or every channel.
+func cacheChannels(args []string) ([]int64, error) {
+	if len(args) == 0 {
+		var ids []int64
+		err := db.Select(&ids, "SELECT id FROM channel ORDER BY id")
+		return ids, err
+	}
+	ids := make([]int64, 0, len(args))
+	for _, a := range args {
+		id, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel id %q", a)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// streamMessages calls fn for each message of the channel with an ID
+// greater than afterID, in ascending or descending ID order.
+func streamMessages(channelID, afterID int64, desc bool, fn func(m Message) error) error {
+	order := "ASC"
+	if desc {
+		order = "DESC"
+	}
+	rows, err := db.Query("SELECT id, user_id, content, created_at FROM message"+
+		" WHERE channel_id = ? AND id > ? ORDER BY id "+order, channelID, afterID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := Message{ChannelID: channelID}
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Content, &m.CreatedAt); err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// pushBatcher LPUSHes values to key in pipelined batches.
+type pushBatcher struct {
+	node   *redisNode
+	key    string
+	values []interface{}
+	pushed int
+}
+
+func (b *pushBatcher) add(v string) error {
+	b.values = append(b.values, v)
+	if len(b.values) >= cacheBatch {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *pushBatcher) flush() error {
+	if len(b.values) == 0 {
+		return nil
+	}
+	pipe := b.node.Pipeline()
+	for i := 0; i < len(b.values); i += 100 {
+		end := i + 100
+		if end > len(b.values) {
+			end = len(b.values)
+		}
+		pipe.LPush(b.key, b.values[i:end]...)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	b.pushed += len(b.values)
+	b.values = b.values[:0]
+	return nil
+}
+
+// rebuildChannelCache builds the channel's list under a temporary key and
+// renames it over the live one, so readers never see a partial list. It
+// returns the number of messages cached.
+//
+// Messages posted while the list is built are picked up by a final
+// catch-up pass just before the rename; one posted in the instant between
+// the two is lost from the cache, which verify reports.
+func rebuildChannelCache(channelID int64) (int, error) {
+	n := redisShard(channelID)
+	tmp := keyMessages(channelID) + ":rebuild"
+	if err := n.Del(tmp).Err(); err != nil {
+		return 0, err
+	}
+	b := &pushBatcher{node: n, key: tmp}
+	var lastID int64
+	push := func(m Message) error {
+		lastID = m.ID
+		return b.add(unifyMessage(m.ID, m.UserID, m.Content, m.CreatedAt))
+	}
+	if err := streamMessages(channelID, 0, false, push); err != nil {
+		return 0, err
+	}
+	if err := b.flush(); err != nil {
+		return 0, err
+	}
+	if err := streamMessages(channelID, lastID, false, push); err != nil {
+		return 0, err
+	}
+	if err := b.flush(); err != nil {
+		return 0, err
+	}
+
+	if b.pushed == 0 {
+		return 0, n.Del(keyMessages(channelID)).Err()
+	}
+	return b.pushed, n.Rename(tmp, keyMessages(channelID)).Err()
+}
+
+// rebuildMessageCache rebuilds the given channels' lists and reports
+// progress to w. full marks the cache as complete, which the backfill
+// after a Redis outage checks.
+func rebuildMessageCache(w io.Writer, channels []int64, full bool) error {
+	ok, err := rd.SetNX(cacheLockKey, me, cacheLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errCacheLocked
+	}
+	defer rd.Del(cacheLockKey)
+
+	for _, ch := range channels {
+		start := time.Now()
+		n, err := rebuildChannelCache(ch)
+		if err != nil {
+			return fmt.Errorf("channel %d: %v", ch, err)
+		}
+		fmt.Fprintf(w, "channel %d: cached %d messages in %s\n", ch, n, time.Since(start).Round(time.Millisecond))
+	}
+	if full {
+		for _, n := range shards.nodes {
+			if err := n.Set(cacheReadyKey, time.Now().Unix(), 0).Err(); err != nil {
+				return fmt.Errorf("%s: %v", n.addr, err)
+			}
+		}
+	}
+	return nil
+}
+
+// CacheDivergence compares one channel's cache with MySQL.
+type CacheDivergence struct {
+	ChannelID int64
+	MySQL     int
+	Redis     int
+	// Missing messages are in MySQL only, Extra ones in Redis only and
+	// Changed ones differ in user, content or time.
+	Missing int
+	Extra   int
+	Changed int
+	// Unordered counts Redis entries out of newest-first order.
+	Unordered int
+}
+
+func (d *CacheDivergence) OK() bool {
+	return d.Missing == 0 && d.Extra == 0 && d.Changed == 0 && d.Unordered == 0
+}
+
+// redisListReader reads a list from the head in chunks.
+type redisListReader struct {
+	node *redisNode
+	key  string
+	buf  []string
+	next int64
+	done bool
+	// count is the number of entries consumed; unordered those out of
+	// newest-first order.
+	count     int
+	unordered int
+	prevID    int64
+}
+
+// peek returns the current entry without consuming it; ok is false at
+// the end of the list.
+func (r *redisListReader) peek() (string, bool, error) {
+	if len(r.buf) == 0 && !r.done {
+		vals, err := r.node.LRange(r.key, r.next, r.next+cacheBatch-1).Result()
+		if err != nil && err != redis.Nil {
+			return "", false, err
+		}
+		r.buf = vals
+		r.next += int64(len(vals))
+		r.done = len(vals) < cacheBatch
+	}
+	if len(r.buf) == 0 {
+		return "", false, nil
+	}
+	return r.buf[0], true, nil
+}
+
+func (r *redisListReader) pop() {
+	id := cachedMessageID(r.buf[0])
+	if r.count > 0 && id >= r.prevID {
+		r.unordered++
+	}
+	r.prevID = id
+	r.buf = r.buf[1:]
+	r.count++
+}
+
+func cachedMessageID(unified string) int64 {
+	id, _ := strconv.ParseInt(strings.SplitN(unified, "@", 2)[0], 10, 64)
+	return id
+}
+
+// verifyChannelCache merges the channel's rows, newest first, with its
+// Redis list.
+func verifyChannelCache(channelID int64) (*CacheDivergence, error) {
+	d := &CacheDivergence{ChannelID: channelID}
+	r := &redisListReader{node: redisShard(channelID), key: keyMessages(channelID)}
+	// skipExtra consumes Redis entries newer than id, which MySQL lacks,
+	// and returns the next one.
+	skipExtra := func(id int64) (string, bool, error) {
+		for {
+			v, ok, err := r.peek()
+			if err != nil || !ok || cachedMessageID(v) <= id {
+				return v, ok, err
+			}
+			d.Extra++
+			r.pop()
+		}
+	}
+	err := streamMessages(channelID, 0, true, func(m Message) error {
+		d.MySQL++
+		v, ok, err := skipExtra(m.ID)
+		if err != nil {
+			return err
+		}
+		if !ok || cachedMessageID(v) != m.ID {
+			d.Missing++
+			return nil
+		}
+		if v != unifyMessage(m.ID, m.UserID, m.Content, m.CreatedAt) {
+			d.Changed++
+		}
+		r.pop()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := skipExtra(-1); err != nil {
+		return nil, err
+	}
+	d.Redis = r.count
+	d.Unordered = r.unordered
+	return d, nil
+}
+
+// orphanCacheKeys returns message lists of channels that do not exist,
+// and of channels held by another node, as "<node> <key>".
+func orphanCacheKeys() ([]string, error) {
+	var ids []int64
+	if err := db.Select(&ids, "SELECT id FROM channel"); err != nil {
+		return nil, err
+	}
+	owner := map[string]*redisNode{}
+	for _, id := range ids {
+		owner[keyMessages(id)] = redisShard(id)
+	}
+	var orphans []string
+	for _, n := range shards.nodes {
+		err := scanKeys(n, "messages:*", func(keys []string) error {
+			for _, k := range keys {
+				if owner[k] != n && !strings.HasSuffix(k, ":rebuild") && k != cacheReadyKey {
+					orphans = append(orphans, n.addr+" "+k)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", n.addr, err)
+		}
+	}
+	return orphans, nil
+}
+
+func verifyMessageCache(channels []int64, all bool) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANNEL\tMYSQL\tREDIS\tMISSING\tEXTRA\tCHANGED\tUNORDERED\tSTATUS")
+	diverged := 0
+	for _, ch := range channels {
+		d, err := verifyChannelCache(ch)
+		if err != nil {
+			return fmt.Errorf("channel %d: %v", ch, err)
+		}
+		status := "ok"
+		if !d.OK() {
+			status = "DIVERGED"
+			diverged++
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			d.ChannelID, d.MySQL, d.Redis, d.Missing, d.Extra, d.Changed, d.Unordered, status)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if all {
+		orphans, err := orphanCacheKeys()
+		if err != nil {
+			return err
+		}
+		for _, k := range orphans {
+			fmt.Println("orphaned list of a deleted or moved channel:", k)
+		}
+		diverged += len(orphans)
+	}
+	if diverged > 0 {
+		return fmt.Errorf("%d channels diverge; run `isubata cache rebuild`", diverged)
+	}
+	return nil
+}
+
+// cmdCache implements `isubata cache rebuild|verify [channel_id...]`.
+func cmdCache(args []string) error {
+	if len(args) == 0 || (args[0] != "rebuild" && args[0] != "verify") {
+		return errors.New("usage: cache rebuild|verify [channel_id...]")
+	}
+	if err := db.Ping(); err != nil {
+		return err
+	}
+	if err := pingRedis(); err != nil {
+		return err
+	}
+	channels, err := cacheChannels(args[1:])
+	if err != nil {
+		return err
+	}
+	if args[0] == "rebuild" {
+		return rebuildMessageCache(os.Stdout, channels, len(args) == 1)
+	}
+	return verifyMessageCache(channels, len(args) == 1)
+}
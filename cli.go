@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Maintenance commands run instead of the server:
+//
+//	isubata [flags] <command> [args...]
+//
+// They use the same configuration as the server.
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"migrate": {"migrate up [version] | down [steps] | status", cmdMigrate},
+	"cache":   {"cache rebuild|verify [channel_id...]", cmdCache},
+	"reshard": {"reshard [-rolled-out | -cleanup] <old redis nodes>", cmdReshard},
+	"openapi": {"openapi", cmdOpenAPI},
+}
+
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var usages []string
+		for _, c := range commands {
+			usages = append(usages, "  "+c.usage)
+		}
+		sort.Strings(usages)
+		return fmt.Errorf("unknown command %q; commands are:\n%s", args[0], strings.Join(usages, "\n"))
+	}
+	setup()
+	return cmd.run(args[1:])
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration is read, in increasing order of precedence, from the
+// built-in defaults, a JSON file (-config or ISUBATA_CONFIG), ISUBATA_*
+// environment variables and command-line flags. Secrets can only be set
+// from the file or the environment, never from flags, so that they do not
+// show up in the process list.
+
+type Config struct {
+	Listen     string   `json:"listen"`
+	PublicDir  string   `json:"public_dir"`
+	Me         string   `json:"me"`
+	Hosts      []string `json:"hosts"`
+	Admins     []string `json:"admins"`
+	Require2FA bool     `json:"require_2fa"`
+	// TrustedProxies are the addresses or CIDR ranges of the reverse
+	// proxies whose X-Forwarded-For and X-Real-IP are believed.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// LogLevel is debug, info, warn or error. A level set from the admin
+	// page takes precedence.
+	LogLevel      string `json:"log_level"`
+	SessionSecret string `json:"session_secret"`
+	PeerSecret    string `json:"peer_secret"`
+	NewRelicKey   string `json:"new_relic_key"`
+	// ShutdownDelay is how long /readyz fails before the listener closes;
+	// ShutdownTimeout bounds the wait for in-flight requests.
+	ShutdownDelay   Duration `json:"shutdown_delay"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Store selects the user, channel and message stores: "mysql" or
+	// "memory".
+	Store string `json:"store"`
+	// AutoMigrate applies pending schema migrations at startup instead of
+	// refusing to start.
+	AutoMigrate bool        `json:"auto_migrate"`
+	DB          DBConfig    `json:"db"`
+	Redis       RedisConfig `json:"redis"`
+	Icons       IconConfig  `json:"icons"`
+
+	Telemetry TelemetryConfig `json:"telemetry"`
+}
+
+type DBConfig struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	User         string `json:"user"`
+	Password     string `json:"password"`
+	Name         string `json:"name"`
+	MaxOpenConns int    `json:"max_open_conns"`
+}
+
+type RedisConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Password string `json:"password"`
+	// Nodes lists "host:port" of each Redis node that channels are
+	// sharded over, replacing host and port. New nodes should be
+	// appended: the first one also holds keys that are not per channel.
+	Nodes []string `json:"nodes"`
+}
+
+// Addrs returns the addresses of the Redis nodes.
+func (c RedisConfig) Addrs() []string {
+	if len(c.Nodes) > 0 {
+		return c.Nodes
+	}
+	return []string{net.JoinHostPort(c.Host, strconv.Itoa(c.Port))}
+}
+
+type IconConfig struct {
+	// Storage is "local", "mysql", "s3" or "memory". The memory store
+	// needs memory storage.
+	Storage  string   `json:"storage"`
+	Dir      string   `json:"dir"`
+	GCGrace  Duration `json:"gc_grace"`
+	GCDryRun bool     `json:"gc_dry_run"`
+	S3       S3Config `json:"s3"`
+}
+
+type TelemetryConfig struct {
+	// Disabled turns off tracing and request metrics altogether.
+	Disabled bool `json:"disabled"`
+	// OTLPEndpoint receives spans as OTLP/HTTP JSON, e.g.
+	// "http://collector:4318/v1/traces". Tracing is off when empty.
+	OTLPEndpoint string `json:"otlp_endpoint"`
+	ServiceName  string `json:"service_name"`
+}
+
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// Duration is a time.Duration written as a string such as "24h" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+var config Config
+
+func defaultConfig() Config {
+	return Config{
+		Listen:          ":5000",
+		LogLevel:        "info",
+		PublicDir:       "../public",
+		TrustedProxies:  []string{"127.0.0.0/8", "::1/128"},
+		ShutdownDelay:   Duration{5 * time.Second},
+		ShutdownTimeout: Duration{30 * time.Second},
+		Store:           "mysql",
+		AutoMigrate:     true,
+		DB: DBConfig{
+			Host:         "127.0.0.1",
+			Port:         3306,
+			User:         "root",
+			Name:         "isubata",
+			MaxOpenConns: 20,
+		},
+		Redis: RedisConfig{
+			Host: "127.0.0.1",
+			Port: 6379,
+		},
+		Icons: IconConfig{
+			Storage: "local",
+			Dir:     "/home/isucon/icons",
+			GCGrace: Duration{24 * time.Hour},
+			S3:      S3Config{Region: "us-east-1"},
+		},
+		Telemetry: TelemetryConfig{
+			ServiceName: "isubata",
+		},
+	}
+}
+
+// configVar is a setting that can be overridden from the environment
+// and, unless it is a secret (flag ""), from a flag.
+type configVar struct {
+	flag  string
+	env   string
+	usage string
+	set   configSetter
+}
+
+// configSetter parses a value into its field. Boolean settings can be
+// given as a bare flag.
+type configSetter struct {
+	apply  func(c *Config, v string) error
+	isBool bool
+}
+
+func setString(field func(*Config) *string) configSetter {
+	return configSetter{apply: func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func setInt(field func(*Config) *int) configSetter {
+	return configSetter{apply: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func setBool(field func(*Config) *bool) configSetter {
+	return configSetter{isBool: true, apply: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean; use true or false", v)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func setList(field func(*Config) *[]string) configSetter {
+	return configSetter{apply: func(c *Config, v string) error {
+		*field(c) = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*field(c) = append(*field(c), s)
+			}
+		}
+		return nil
+	}}
+}
+
+func setDuration(field func(*Config) *Duration) configSetter {
+	return configSetter{apply: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		field(c).Duration = d
+		return nil
+	}}
+}
+
+// flagValue holds a flag override until loadConfig applies it.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(v string) error {
+	f.value = v
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
+
+var configVars = []configVar{
+	{"listen", "ISUBATA_LISTEN", "listen address", setString(func(c *Config) *string { return &c.Listen })},
+	{"public-dir", "ISUBATA_PUBLIC_DIR", "static files directory", setString(func(c *Config) *string { return &c.PublicDir })},
+	{"me", "ISUBATA_ME", "this host as it appears in hosts", setString(func(c *Config) *string { return &c.Me })},
+	{"hosts", "ISUBATA_HOSTS", "comma-separated app hosts", setList(func(c *Config) *[]string { return &c.Hosts })},
+	{"admins", "ISUBATA_ADMINS", "comma-separated admin user names", setList(func(c *Config) *[]string { return &c.Admins })},
+	{"trusted-proxies", "ISUBATA_TRUSTED_PROXIES", "comma-separated proxy addresses or CIDRs trusted for X-Forwarded-For", setList(func(c *Config) *[]string { return &c.TrustedProxies })},
+	{"log-level", "ISUBATA_LOG_LEVEL", "default log level: debug, info, warn or error", setString(func(c *Config) *string { return &c.LogLevel })},
+	{"require-2fa", "ISUBATA_REQUIRE_2FA", "require two-factor authentication", setBool(func(c *Config) *bool { return &c.Require2FA })},
+	{"", "ISUBATA_SESSION_SECRET", "", setString(func(c *Config) *string { return &c.SessionSecret })},
+	{"", "ISUBATA_PEER_SECRET", "", setString(func(c *Config) *string { return &c.PeerSecret })},
+	{"", "NEW_RELIC_KEY", "", setString(func(c *Config) *string { return &c.NewRelicKey })},
+	{"shutdown-delay", "ISUBATA_SHUTDOWN_DELAY", "how long /readyz fails before the listener closes", setDuration(func(c *Config) *Duration { return &c.ShutdownDelay })},
+	{"shutdown-timeout", "ISUBATA_SHUTDOWN_TIMEOUT", "how long to wait for in-flight requests", setDuration(func(c *Config) *Duration { return &c.ShutdownTimeout })},
+	{"store", "ISUBATA_STORE", "user/channel/message store: mysql or memory", setString(func(c *Config) *string { return &c.Store })},
+	{"auto-migrate", "ISUBATA_AUTO_MIGRATE", "apply pending schema migrations at startup", setBool(func(c *Config) *bool { return &c.AutoMigrate })},
+	{"db-host", "ISUBATA_DB_HOST", "MySQL host", setString(func(c *Config) *string { return &c.DB.Host })},
+	{"db-port", "ISUBATA_DB_PORT", "MySQL port", setInt(func(c *Config) *int { return &c.DB.Port })},
+	{"db-user", "ISUBATA_DB_USER", "MySQL user", setString(func(c *Config) *string { return &c.DB.User })},
+	{"", "ISUBATA_DB_PASSWORD", "", setString(func(c *Config) *string { return &c.DB.Password })},
+	{"db-name", "ISUBATA_DB_NAME", "MySQL database", setString(func(c *Config) *string { return &c.DB.Name })},
+	{"db-max-open-conns", "ISUBATA_DB_MAX_OPEN_CONNS", "MySQL connection pool size", setInt(func(c *Config) *int { return &c.DB.MaxOpenConns })},
+	{"redis-host", "ISUBATA_REDIS_HOST", "Redis host", setString(func(c *Config) *string { return &c.Redis.Host })},
+	{"redis-port", "ISUBATA_REDIS_PORT", "Redis port", setInt(func(c *Config) *int { return &c.Redis.Port })},
+	{"redis-nodes", "ISUBATA_REDIS_NODES", "comma-separated Redis host:port nodes to shard channels over", setList(func(c *Config) *[]string { return &c.Redis.Nodes })},
+	{"", "ISUBATA_REDIS_PASSWORD", "", setString(func(c *Config) *string { return &c.Redis.Password })},
+	{"icon-storage", "ISUBATA_ICON_STORAGE", "icon storage: local, mysql, s3 or memory", setString(func(c *Config) *string { return &c.Icons.Storage })},
+	{"icons-dir", "ISUBATA_ICONS_DIR", "icon directory for local storage", setString(func(c *Config) *string { return &c.Icons.Dir })},
+	{"icon-gc-grace", "ISUBATA_ICON_GC_GRACE", "time an unreferenced icon is kept", setDuration(func(c *Config) *Duration { return &c.Icons.GCGrace })},
+	{"icon-gc-dry-run", "ISUBATA_ICON_GC_DRY_RUN", "only report what the icon GC would delete", setBool(func(c *Config) *bool { return &c.Icons.GCDryRun })},
+	{"s3-endpoint", "ISUBATA_S3_ENDPOINT", "S3 endpoint URL", setString(func(c *Config) *string { return &c.Icons.S3.Endpoint })},
+	{"s3-bucket", "ISUBATA_S3_BUCKET", "S3 bucket", setString(func(c *Config) *string { return &c.Icons.S3.Bucket })},
+	{"s3-region", "ISUBATA_S3_REGION", "S3 region", setString(func(c *Config) *string { return &c.Icons.S3.Region })},
+	{"", "ISUBATA_S3_ACCESS_KEY", "", setString(func(c *Config) *string { return &c.Icons.S3.AccessKey })},
+	{"", "ISUBATA_S3_SECRET_KEY", "", setString(func(c *Config) *string { return &c.Icons.S3.SecretKey })},
+	{"telemetry-disabled", "ISUBATA_TELEMETRY_DISABLED", "turn off tracing and request metrics", setBool(func(c *Config) *bool { return &c.Telemetry.Disabled })},
+	{"otlp-endpoint", "ISUBATA_OTLP_ENDPOINT", "OTLP/HTTP traces endpoint", setString(func(c *Config) *string { return &c.Telemetry.OTLPEndpoint })},
+	{"service-name", "ISUBATA_SERVICE_NAME", "service name reported with traces", setString(func(c *Config) *string { return &c.Telemetry.ServiceName })},
+}
+
+// loadConfig builds the effective configuration from args (without the
+// program name). printOnly is set by -print-config; rest holds the
+// arguments after the flags.
+func loadConfig(args []string) (c Config, printOnly bool, rest []string, err error) {
+	fs := flag.NewFlagSet("isubata", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("ISUBATA_CONFIG"), "JSON config file")
+	fs.BoolVar(&printOnly, "print-config", false, "print the effective config with secrets redacted and exit")
+	flagValues := map[string]*flagValue{}
+	for _, v := range configVars {
+		if v.flag != "" {
+			flagValues[v.flag] = &flagValue{isBool: v.set.isBool}
+			fs.Var(flagValues[v.flag], v.flag, v.usage+" (env "+v.env+")")
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, false, nil, err
+	}
+
+	c = defaultConfig()
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return c, false, nil, err
+		}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return c, false, nil, fmt.Errorf("%s: %v", *path, err)
+		}
+	}
+	for _, v := range configVars {
+		if s, ok := os.LookupEnv(v.env); ok && s != "" {
+			if err := v.set.apply(&c, s); err != nil {
+				return c, false, nil, fmt.Errorf("%s: %v", v.env, err)
+			}
+		}
+	}
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, v := range configVars {
+			if v.flag == f.Name && flagErr == nil {
+				if err := v.set.apply(&c, flagValues[f.Name].value); err != nil {
+					flagErr = fmt.Errorf("-%s: %v", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return c, false, nil, flagErr
+	}
+	return c, printOnly, fs.Args(), c.Validate()
+}
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.Listen != "", "listen must be set")
+	// The old built-in secret is published with the source.
+	check(c.SessionSecret != "" && c.SessionSecret != "secretonymoris",
+		"session_secret (or ISUBATA_SESSION_SECRET) must be set to a private value")
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, "log_level: "+err.Error())
+	}
+	check(c.ShutdownDelay.Duration >= 0, "shutdown_delay must not be negative")
+	check(c.ShutdownTimeout.Duration > 0, "shutdown_timeout must be positive")
+	if c.Me != "" && len(c.Hosts) > 0 {
+		found := false
+		for _, h := range c.Hosts {
+			found = found || h == c.Me
+		}
+		check(found, "me (%q) must be one of hosts %v", c.Me, c.Hosts)
+	}
+	_, err := parseProxies(c.TrustedProxies)
+	check(err == nil, "trusted_proxies: %v", err)
+	check(c.Store == "mysql" || c.Store == "memory", "store must be mysql or memory, not %q", c.Store)
+	if c.Store == "memory" {
+		check(c.Icons.Storage == "memory", "icons.storage must be memory for the memory store")
+	}
+	check(c.DB.Host != "", "db.host must be set")
+	check(c.DB.Port > 0 && c.DB.Port < 65536, "db.port %d is out of range", c.DB.Port)
+	check(c.DB.Name != "", "db.name must be set")
+	check(c.DB.MaxOpenConns > 0, "db.max_open_conns must be positive")
+	if len(c.Redis.Nodes) == 0 {
+		check(c.Redis.Host != "", "redis.host must be set")
+		check(c.Redis.Port > 0 && c.Redis.Port < 65536, "redis.port %d is out of range", c.Redis.Port)
+	}
+	seen := map[string]bool{}
+	for _, n := range c.Redis.Nodes {
+		_, port, err := net.SplitHostPort(n)
+		check(err == nil && port != "", "redis.nodes: %q is not host:port", n)
+		check(!seen[n], "redis.nodes: %q is listed twice", n)
+		seen[n] = true
+	}
+	switch c.Icons.Storage {
+	case "local":
+		check(c.Icons.Dir != "", "icons.dir must be set for local storage")
+	case "mysql":
+	case "memory":
+		check(c.Store == "memory", "icons.storage memory needs the memory store")
+	case "s3":
+		check(c.Icons.S3.Endpoint != "", "icons.s3.endpoint must be set for s3 storage")
+		check(c.Icons.S3.Bucket != "", "icons.s3.bucket must be set for s3 storage")
+		check(c.Icons.S3.Region != "", "icons.s3.region must be set for s3 storage")
+	default:
+		errs = append(errs, fmt.Sprintf("icons.storage must be local, mysql, s3 or memory, not %q", c.Icons.Storage))
+	}
+	check(c.Icons.GCGrace.Duration > 0, "icons.gc_grace must be positive")
+	if c.Telemetry.OTLPEndpoint != "" {
+		u, err := url.Parse(c.Telemetry.OTLPEndpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"telemetry.otlp_endpoint must be an http(s) URL, not %q", c.Telemetry.OTLPEndpoint)
+	}
+	check(c.Telemetry.ServiceName != "", "telemetry.service_name must be set")
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Print writes the configuration as JSON with secrets replaced.
+func (c Config) Print(w io.Writer) error {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "[redacted]"
+		}
+	}
+	redact(&c.SessionSecret)
+	redact(&c.PeerSecret)
+	redact(&c.NewRelicKey)
+	redact(&c.DB.Password)
+	redact(&c.Redis.Password)
+	redact(&c.Icons.S3.AccessKey)
+	redact(&c.Icons.S3.SecretKey)
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
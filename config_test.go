@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBoolOverrides(t *testing.T) {
+	os.Setenv("ISUBATA_SESSION_SECRET", "test")
+	defer os.Unsetenv("ISUBATA_SESSION_SECRET")
+	for _, tt := range []struct {
+		args []string
+		env  string
+		want bool
+		err  string
+	}{
+		{args: []string{"-require-2fa"}, want: true},
+		{args: []string{"-require-2fa=false"}, want: false},
+		{args: []string{"-require-2fa=yes"}, err: "-require-2fa:"},
+		{env: "TRUE", want: true},
+		{env: "0", want: false},
+		{env: "on", err: "ISUBATA_REQUIRE_2FA:"},
+	} {
+		if tt.env != "" {
+			os.Setenv("ISUBATA_REQUIRE_2FA", tt.env)
+		} else {
+			os.Unsetenv("ISUBATA_REQUIRE_2FA")
+		}
+		c, _, _, err := loadConfig(tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%v %q: got %v, want an error starting with %s", tt.args, tt.env, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v %q: %v", tt.args, tt.env, err)
+		} else if c.Require2FA != tt.want {
+			t.Errorf("%v %q: require_2fa %v, want %v", tt.args, tt.env, c.Require2FA, tt.want)
+		}
+	}
+	os.Unsetenv("ISUBATA_REQUIRE_2FA")
+}
+
+func TestSessionSecretRequired(t *testing.T) {
+	for _, secret := range []string{"", "secretonymoris"} {
+		os.Setenv("ISUBATA_SESSION_SECRET", secret)
+		_, _, _, err := loadConfig(nil)
+		if err == nil || !strings.Contains(err.Error(), "session_secret") {
+			t.Errorf("secret %q: got %v, want a session_secret error", secret, err)
+		}
+	}
+	os.Unsetenv("ISUBATA_SESSION_SECRET")
+}
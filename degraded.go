@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// When a Redis node is unreachable the message and read-state stores fall
+// back to MySQL for its channels instead of failing. A circuit breaker per
+// node keeps requests from waiting on a dead connection: after a few
+// consecutive failures calls fail fast until a probe succeeds. Meanwhile
+// read positions and 2FA failures are kept in process and channels whose
+// cached list missed a write are remembered; once the node is back those
+// lists are rebuilt from MySQL and the read positions written out. If the
+// node lost its data while it was down, every list it holds is rebuilt.
+
+const (
+	redisBreakerThreshold = 3
+	redisBreakerCooldown  = 5 * time.Second
+	// Stale marks and outage read positions live only in the process that
+	// took the write. Another host whose breaker closes first reads the
+	// channel's incomplete list, and shows wrong unread counts, until the
+	// writing host's next backfill, roughly redisBreakerCooldown plus
+	// redisBackfillInterval after the node is back. If that host stops
+	// first the marks are lost, and the list stays short until the next
+	// isubata cache rebuild. Keeping the marks in MySQL would cost a query
+	// on every cached read.
+	redisBackfillInterval = 5 * time.Second
+
+	// cacheReadyKey is set on each node once its message lists were
+	// filled from MySQL; its absence after an outage means the node came
+	// back empty.
+	cacheReadyKey = "messagecache:ready"
+)
+
+var errRedisUnavailable = errors.New("redis unavailable")
+
+type circuitBreaker struct {
+	name      string
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+	// trial is set while the one call let through after the cooldown is
+	// in flight.
+	trial bool
+	// outage is set when the breaker opens and cleared by a backfill.
+	outage bool
+}
+
+// Allow reports whether a call may be attempted.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Done records the outcome of an allowed call.
+func (b *circuitBreaker) Done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil || err == redis.Nil {
+		b.failures = 0
+		b.setOpen(false)
+		return
+	}
+	b.failures++
+	if b.open || b.failures >= redisBreakerThreshold {
+		b.setOpen(true)
+	}
+}
+
+// Probe records a health check, which is conclusive either way.
+func (b *circuitBreaker) Probe(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+	} else {
+		b.failures = redisBreakerThreshold
+	}
+	b.setOpen(err != nil)
+}
+
+func (b *circuitBreaker) setOpen(open bool) {
+	if open {
+		b.openUntil = time.Now().Add(redisBreakerCooldown)
+	}
+	if b.open == open {
+		return
+	}
+	b.open = open
+	if open {
+		log.Println("Redis circuit opened for", b.name+"; serving from MySQL")
+		b.outage = true
+	} else {
+		log.Println("Redis circuit closed for", b.name)
+	}
+}
+
+func (b *circuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// recovered reports whether the breaker closed again after an outage
+// that has not been backfilled yet.
+func (b *circuitBreaker) recovered() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.outage && !b.open
+}
+
+func (b *circuitBreaker) clearOutage() {
+	b.mu.Lock()
+	b.outage = false
+	b.mu.Unlock()
+}
+
+// call runs fn unless the node's breaker is open and records its outcome.
+func (n *redisNode) call(fn func() error) error {
+	if !n.breaker.Allow() {
+		return errRedisUnavailable
+	}
+	err := fn()
+	n.breaker.Done(err)
+	return err
+}
+
+type readKey struct {
+	userID, channelID int64
+}
+
+// degradedState holds what could not be written to Redis.
+type degradedState struct {
+	sync.Mutex
+	// stale channels' lists missed a write.
+	stale map[int64]bool
+	// reads are read positions recorded during the outage.
+	reads map[readKey]int64
+}
+
+var degraded = &degradedState{
+	stale: map[int64]bool{},
+	reads: map[readKey]int64{},
+}
+
+func markStale(channelID int64) {
+	degraded.Lock()
+	degraded.stale[channelID] = true
+	degraded.Unlock()
+}
+
+// isStale reports whether the channel's cached list cannot be trusted.
+func isStale(channelID int64) bool {
+	degraded.Lock()
+	defer degraded.Unlock()
+	return degraded.stale[channelID]
+}
+
+func localReadState(userID, channelID int64) (int64, bool) {
+	degraded.Lock()
+	defer degraded.Unlock()
+	n, ok := degraded.reads[readKey{userID, channelID}]
+	return n, ok
+}
+
+func setLocalReadState(userID, channelID, read int64) {
+	degraded.Lock()
+	degraded.reads[readKey{userID, channelID}] = read
+	degraded.Unlock()
+}
+
+// isDegraded reports whether requests are being served without a Redis
+// node or its contents are still being restored.
+func isDegraded() bool {
+	for _, n := range shards.nodes {
+		if n.breaker.Open() || n.breaker.recovered() {
+			return true
+		}
+	}
+	degraded.Lock()
+	defer degraded.Unlock()
+	return len(degraded.stale) > 0 || len(degraded.reads) > 0
+}
+
+// backfillRedis restores what was missed on nodes whose breaker is closed
+// again.
+func backfillRedis() {
+	// Stale marks are taken before rebuilding so that a write failing
+	// meanwhile marks its channel again.
+	degraded.Lock()
+	var stale []int64
+	for ch := range degraded.stale {
+		if !redisShard(ch).breaker.Open() {
+			stale = append(stale, ch)
+			delete(degraded.stale, ch)
+		}
+	}
+	reads := map[readKey]int64{}
+	for k, v := range degraded.reads {
+		if !redisShard(k.channelID).breaker.Open() {
+			reads[k] = v
+		}
+	}
+	degraded.Unlock()
+	var recovered []*redisNode
+	for _, n := range shards.nodes {
+		if n.breaker.recovered() {
+			recovered = append(recovered, n)
+		}
+	}
+	if len(recovered) == 0 && len(stale) == 0 && len(reads) == 0 {
+		return
+	}
+	restore := func(err error) {
+		if err != errCacheLocked { // another host is rebuilding
+			log.Println("Failed to backfillRedis:", err)
+		}
+		for _, ch := range stale {
+			markStale(ch)
+		}
+	}
+
+	var emptied []*redisNode
+	for _, n := range recovered {
+		c, err := n.Exists(cacheReadyKey).Result()
+		if err != nil {
+			restore(err)
+			return
+		}
+		if c == 0 {
+			log.Println("Redis node", n.addr, "lost its message cache; rebuilding its channels")
+			emptied = append(emptied, n)
+		}
+	}
+	if len(emptied) > 0 {
+		ids, err := channelStore.IDs(nil)
+		if err != nil {
+			restore(err)
+			return
+		}
+		seen := map[int64]bool{}
+		for _, ch := range stale {
+			seen[ch] = true
+		}
+		for _, ch := range ids {
+			for _, n := range emptied {
+				if redisShard(ch) == n && !seen[ch] {
+					stale = append(stale, ch)
+				}
+			}
+		}
+	}
+	if err := rebuildMessageCache(ioutil.Discard, stale, false); err != nil {
+		restore(err)
+		return
+	}
+	for _, n := range emptied {
+		if err := n.Set(cacheReadyKey, time.Now().Unix(), 0).Err(); err != nil {
+			log.Println("Failed to backfillRedis:", err)
+			return
+		}
+	}
+
+	byNode := map[*redisNode]redis.Pipeliner{}
+	for k, v := range reads {
+		n := redisShard(k.channelID)
+		if byNode[n] == nil {
+			byNode[n] = n.Pipeline()
+		}
+		byNode[n].Set(keyHaveread(k.userID, k.channelID), v, 0)
+	}
+	for _, pipe := range byNode {
+		if _, err := pipe.Exec(); err != nil {
+			log.Println("Failed to backfillRedis:", err)
+			return
+		}
+	}
+
+	degraded.Lock()
+	for k, v := range reads {
+		if degraded.reads[k] == v {
+			delete(degraded.reads, k)
+		}
+	}
+	degraded.Unlock()
+	for _, n := range recovered {
+		n.breaker.clearOutage()
+	}
+	log.Println("Backfilled Redis:", len(stale), "channels,", len(reads), "read positions")
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// avatarMaxDimension bounds width and height so that a small file
+	// cannot expand into a huge bitmap when decoded.
+	avatarMaxDimension = 2048
+	avatarMaxPixels    = 1024 * 1024 * 2
+)
+
+var (
+	errAvatarFormat   = errors.New("avatar: unsupported or mismatched image format")
+	errAvatarTooLarge = errors.New("avatar: image dimensions too large")
+)
+
+var avatarFormatExts = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// avatarExt inspects the image header and returns the extension to store
+// the avatar under. clientExt is the extension of the uploaded filename,
+// which must agree with the detected format.
+func avatarExt(r io.Reader, clientExt string) (string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", errAvatarFormat
+	}
+	ext, ok := avatarFormatExts[format]
+	if !ok {
+		return "", errAvatarFormat
+	}
+	if clientExt != ext && !(format == "jpeg" && clientExt == ".jpeg") {
+		return "", errAvatarFormat
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 ||
+		cfg.Width > avatarMaxDimension || cfg.Height > avatarMaxDimension ||
+		cfg.Width*cfg.Height > avatarMaxPixels {
+		return "", errAvatarTooLarge
+	}
+	return ext, nil
+}
+
+// Avatars are normalized to an avatarSize square on upload and
+// additionally rendered at each of avatarThumbnailSizes.
+const avatarSize = 256
+
+var avatarThumbnailSizes = []int{32, 64, 128}
+
+var errIconNotFound = errors.New("icon: not found")
+
+func validIconSize(size int) bool {
+	if size == avatarSize {
+		return true
+	}
+	for _, s := range avatarThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// iconVariantName returns the file name of the size x size rendition of
+// the icon name, e.g. "abc.png" -> "abc_64.png".
+func iconVariantName(name string, size int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), size, ext)
+}
+
+// normalizeAvatar center-crops the upload to a square, scales it to
+// avatarSize and re-encodes it, which also drops any embedded metadata.
+// GIFs are stored as PNG.
+func normalizeAvatar(r io.ReadSeeker, clientExt string) ([]byte, string, error) {
+	ext, err := avatarExt(r, clientExt)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", errAvatarFormat
+	}
+	if ext == ".gif" {
+		ext = ".png"
+	}
+	out, err := encodeIcon(resizeImage(cropSquare(img), avatarSize), ext)
+	return out, ext, err
+}
+
+// isNormalizedAvatar reports whether data is already the output of
+// normalizeAvatar, as is the case for icons pushed by peers.
+func isNormalizedAvatar(r io.Reader) bool {
+	cfg, format, err := image.DecodeConfig(r)
+	return err == nil && (format == "jpeg" || format == "png") &&
+		cfg.Width == avatarSize && cfg.Height == avatarSize
+}
+
+func encodeIcon(img image.Image, ext string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if ext == ".jpg" || ext == ".jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// renderIconVariants renders every thumbnail size of the icon name.
+func renderIconVariants(name string, r io.Reader) (map[string][]byte, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	img = cropSquare(img)
+	ext := path.Ext(name)
+	if ext == ".gif" {
+		ext = ".png"
+	}
+	variants := make(map[string][]byte, len(avatarThumbnailSizes))
+	for _, size := range avatarThumbnailSizes {
+		out, err := encodeIcon(resizeImage(img, size), ext)
+		if err != nil {
+			return nil, err
+		}
+		variants[iconVariantName(name, size)] = out
+	}
+	return variants, nil
+}
+
+func writeIconVariants(name string, r io.Reader) error {
+	variants, err := renderIconVariants(name, r)
+	if err != nil {
+		return err
+	}
+	for vname, vdata := range variants {
+		if err := iconStore.Put(vname, vdata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeIcon saves an uploaded icon and its thumbnails.
+func storeIcon(name string, data []byte) error {
+	if err := iconStore.Put(name, data); err != nil {
+		return err
+	}
+	return writeIconVariants(name, bytes.NewReader(data))
+}
+
+// storeIconFile stores a verified upload under name. The local store
+// takes over the spooled file by renaming it into place, and the
+// thumbnails are then rendered from the still open file, so the upload
+// is only read into memory for the other stores.
+func storeIconFile(name string, f *spooledFile) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if l, ok := iconStore.(*localBlobStore); ok && filepath.Dir(f.Name()) == filepath.Clean(l.dir) {
+		if err := l.Adopt(name, f.Name()); err != nil {
+			return err
+		}
+		return writeIconVariants(name, f)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if err := iconStore.Put(name, data); err != nil {
+		return err
+	}
+	return writeIconVariants(name, bytes.NewReader(data))
+}
+
+// saveAvatar stores a normalized avatar and queues it for peers.
+func saveAvatar(txn *Transaction, name string, data []byte) error {
+	if err := storeIcon(name, data); err != nil {
+		return err
+	}
+	if iconStore.Shared() {
+		return nil
+	}
+	return enqueueReplication(name, txn.RequestID())
+}
+
+// loadIcon reads an icon from iconStore, then from peers if askPeers is
+// set, and finally from the seeded icons in MySQL.
+func loadIcon(txn *Transaction, name string, askPeers bool) ([]byte, error) {
+	data, err := iconStore.Get(name)
+	if err != errIconNotFound || iconStore == seedStore {
+		return data, err
+	}
+	if askPeers && !iconStore.Shared() {
+		data, err = fetchIconFromPeers(txn, name)
+		if err != errIconNotFound {
+			return data, err
+		}
+	}
+	txn.Warn("UNEXPECTED load icon from mysql:", name)
+	s := StartMySQLSegment(txn, "image", "SELECT")
+	data, err = seedStore.Get(name)
+	s.End()
+	return data, err
+}
+
+// ensureIconVariant makes sure the thumbnail of name at size exists in
+// iconStore, rendering it from the original if needed. This covers icons
+// that predate thumbnails, such as the preloaded ones and default.png.
+func ensureIconVariant(txn *Transaction, name string, size int, askPeers bool) error {
+	vname := iconVariantName(name, size)
+	if ok, err := iconStore.Exists(vname); ok || err != nil {
+		return err
+	}
+	data, err := loadIcon(txn, name, askPeers)
+	if err != nil {
+		return err
+	}
+	variants, err := renderIconVariants(name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return iconStore.Put(vname, variants[vname])
+}
+
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, image.Pt(x0, y0), draw.Src)
+	return dst
+}
+
+// resizeImage scales a square image to size x size. Downscaling averages
+// all source pixels covered by each destination pixel; upscaling samples
+// the nearest source pixel.
+func resizeImage(img image.Image, size int) image.Image {
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw == size && sh == size {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0 := y * sh / size
+		sy1 := (y + 1) * sh / size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < size; x++ {
+			sx0 := x * sw / size
+			sx1 := (x + 1) * sw / size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := sy0; sy < sy1; sy++ {
+				off := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					r += uint32(src.Pix[off])
+					g += uint32(src.Pix[off+1])
+					b += uint32(src.Pix[off+2])
+					a += uint32(src.Pix[off+3])
+					off += 4
+					n++
+				}
+			}
+			off := dst.PixOffset(x, y)
+			dst.Pix[off] = uint8(r / n)
+			dst.Pix[off+1] = uint8(g / n)
+			dst.Pix[off+2] = uint8(b / n)
+			dst.Pix[off+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// iconETag returns a strong validator for the icon. Names are derived
+// from the SHA-1 of the content (plus the size suffix for thumbnails), so
+// the name alone identifies the bytes.
+func iconETag(name string) string {
+	return `"` + name + `"`
+}
+
+func setIconCacheHeaders(h http.Header, etag string) {
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	h.Set("ETag", etag)
+}
+
+// etagMatch implements the weak comparison used for If-None-Match.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
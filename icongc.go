@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Icon garbage collection. Every run lists the icons in iconStore and the
+// image table and compares them with user.avatar_icon. An unreferenced
+// icon is first recorded in icon_gc_mark and only deleted, together with
+// its thumbnails and its copies on peers, once it has stayed unreferenced
+// for iconGCGrace. Only one host runs the collector at a time.
+
+const (
+	// seedImageMaxID is the last image row of the initial data set.
+	seedImageMaxID = 1001
+	defaultIcon    = "default.png"
+
+	iconGCInterval = time.Hour
+	iconGCLockKey  = "icongc:lock"
+	iconGCLockTTL  = 30 * time.Minute
+	iconGCMaxNames = 100
+)
+
+var (
+	iconGCGrace  = 24 * time.Hour
+	iconGCDryRun bool
+)
+
+type IconGCRun struct {
+	ID         int64     `db:"id"`
+	StartedAt  time.Time `db:"started_at"`
+	FinishedAt time.Time `db:"finished_at"`
+	DryRun     bool      `db:"dry_run"`
+	Scanned    int       `db:"scanned"`
+	Marked     int       `db:"marked"`
+	Deleted    int       `db:"deleted"`
+	Bytes      int64     `db:"bytes"`
+	Names      string    `db:"names"`
+	Error      string    `db:"error"`
+}
+
+// iconOriginal maps a thumbnail name back to the icon it was rendered from.
+func iconOriginal(name string) string {
+	loc := iconVariantPattern.FindStringIndex(name)
+	if loc == nil {
+		return name
+	}
+	return name[:loc[0]] + name[strings.LastIndexByte(name, '.'):]
+}
+
+func referencedIcons() (map[string]bool, error) {
+	var names []string
+	if err := db.Select(&names, "SELECT DISTINCT avatar_icon FROM user"); err != nil {
+		return nil, err
+	}
+	var seeds []string
+	if err := db.Select(&seeds, "SELECT name FROM image WHERE id <= ?", seedImageMaxID); err != nil {
+		return nil, err
+	}
+	refs := map[string]bool{defaultIcon: true}
+	for _, n := range append(names, seeds...) {
+		refs[n] = true
+	}
+	return refs, nil
+}
+
+func blobSize(store BlobStore, name string) int64 {
+	if l, ok := store.(*localBlobStore); ok {
+		if fi, err := os.Stat(l.path(name)); err == nil {
+			return fi.Size()
+		}
+		return 0
+	}
+	data, err := store.Get(name)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
+
+// deleteIconFromPeers asks every peer to drop its copy of name.
+func deleteIconFromPeers(name string) {
+	for _, host := range peers() {
+		req, err := http.NewRequest(http.MethodDelete, "http://"+host+"/icons/"+name, nil)
+		if err != nil {
+			log.Println("Failed to deleteIconFromPeers:", err)
+			continue
+		}
+		req.Header.Set(peerHeader, me)
+		signPeerRequest(req, nil)
+		resp, err := replicationClient.Do(req)
+		if err != nil {
+			log.Println("Failed to deleteIconFromPeers:", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			log.Println("Failed to deleteIconFromPeers:", host, name, resp.Status)
+		}
+	}
+}
+
+// runIconGC performs one collection pass and records it in icon_gc_run.
+func runIconGC(dryRun bool) (*IconGCRun, error) {
+	run := &IconGCRun{StartedAt: time.Now(), DryRun: dryRun}
+	err := collectIcons(run)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Error = truncateRunes(err.Error(), 255)
+	}
+	res, ierr := db.Exec(
+		"INSERT INTO icon_gc_run (started_at, finished_at, dry_run, scanned, marked, deleted, bytes, names, error)"+
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		run.StartedAt, run.FinishedAt, run.DryRun, run.Scanned, run.Marked, run.Deleted, run.Bytes, run.Names, run.Error)
+	if ierr != nil {
+		log.Println("Failed to record icon gc run:", ierr)
+	} else {
+		run.ID, _ = res.LastInsertId()
+	}
+	log.Printf("icon gc: dry_run=%v scanned=%d marked=%d deleted=%d reclaimed=%d bytes err=%v",
+		run.DryRun, run.Scanned, run.Marked, run.Deleted, run.Bytes, err)
+	return run, err
+}
+
+func collectIcons(run *IconGCRun) error {
+	ok, err := rd.SetNX(iconGCLockKey, me, iconGCLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("another icon gc is running")
+	}
+	defer rd.Del(iconGCLockKey)
+
+	refs, err := referencedIcons()
+	if err != nil {
+		return err
+	}
+
+	// Candidates from the store and from image rows outside the seed set.
+	candidates := map[string]bool{}
+	names, err := iconStore.List()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		candidates[n] = true
+	}
+	if iconStore != seedStore {
+		var rows []string
+		if err := db.Select(&rows, "SELECT name FROM image WHERE id > ?", seedImageMaxID); err != nil {
+			return err
+		}
+		for _, n := range rows {
+			candidates[n] = true
+		}
+	}
+	run.Scanned = len(candidates)
+
+	var deleted []string
+	for name := range candidates {
+		if refs[iconOriginal(name)] {
+			if !run.DryRun {
+				db.Exec("DELETE FROM icon_gc_mark WHERE name = ?", name)
+			}
+			continue
+		}
+
+		var markedAt time.Time
+		err := db.Get(&markedAt, "SELECT marked_at FROM icon_gc_mark WHERE name = ?", name)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == sql.ErrNoRows {
+			// Not marked yet: start the grace period now.
+			run.Marked++
+			if !run.DryRun {
+				_, err := db.Exec("INSERT IGNORE INTO icon_gc_mark (name, marked_at) VALUES (?, NOW())", name)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if time.Since(markedAt) < iconGCGrace {
+			continue
+		}
+
+		size := blobSize(iconStore, name)
+		run.Deleted++
+		run.Bytes += size
+		if len(deleted) < iconGCMaxNames {
+			deleted = append(deleted, name)
+		}
+		if run.DryRun {
+			continue
+		}
+		if err := iconStore.Delete(name); err != nil {
+			return err
+		}
+		if _, err := db.Exec("DELETE FROM image WHERE name = ? AND id > ?", name, seedImageMaxID); err != nil {
+			return err
+		}
+		if !iconStore.Shared() {
+			deleteIconFromPeers(name)
+		}
+		db.Exec("DELETE FROM icon_gc_mark WHERE name = ?", name)
+	}
+	run.Names = strings.Join(deleted, "\n")
+	return nil
+}
+
+func startIconGC() {
+	runPeriodically(iconGCInterval, func() {
+		runIconGC(iconGCDryRun)
+	})
+}
+
+// request handlers
+
+// deleteIcon lets the collecting host remove an icon and its thumbnails
+// from this host.
+func deleteIcon(c echo.Context) error {
+	name := c.Param("file_name")
+	if err := iconStore.Delete(name); err != nil {
+		log.Println("Failed to deleteIcon1:", err)
+		return err
+	}
+	for _, size := range avatarThumbnailSizes {
+		if err := iconStore.Delete(iconVariantName(name, size)); err != nil {
+			log.Println("Failed to deleteIcon2:", err)
+			return err
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getAdminIconGC(c echo.Context) error {
+	txn := app.StartTransaction("getAdminIconGC", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	runs := []IconGCRun{}
+	s := StartMySQLSegment(txn, "icon_gc_run", "SELECT")
+	err = db.Select(&runs, "SELECT * FROM icon_gc_run ORDER BY id DESC LIMIT 20")
+	s.End()
+	if err != nil {
+		txn.Error("Failed to getAdminIconGC1:", err)
+		return err
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		txn.Error("Failed to getAdminIconGC2:", err)
+		return err
+	}
+
+	return c.Render(http.StatusOK, "admin_icon_gc", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  channels,
+		"User":      self,
+		"Runs":      runs,
+		"Grace":     iconGCGrace.String(),
+		"DryRun":    iconGCDryRun,
+	})
+}
+
+func postAdminIconGC(c echo.Context) error {
+	txn := app.StartTransaction("postAdminIconGC", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	dry := c.FormValue("dry_run") == "1"
+	if !dry {
+		channels, err := queryChannelInfos(txn)
+		if err != nil {
+			return err
+		}
+		ok, err := confirmed(c, self, channels, "参照されていないアイコンを削除します。")
+		if !ok {
+			return err
+		}
+	}
+	run, err := runIconGC(dry)
+	if err != nil {
+		txn.Error("Failed to postAdminIconGC:", err)
+	}
+	audit(txn, c, auditAdminIconGC, self, "icon", 0, "",
+		fmt.Sprintf("dry_run=%v deleted=%d bytes=%d", run.DryRun, run.Deleted, run.Bytes))
+	return c.Redirect(http.StatusSeeOther, "/admin/icons/gc")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Generated avatars: a 5x5 grid, mirrored left to right, with the cells
+// and colour taken from the SHA-1 of the user name. The same name always
+// renders to the same PNG and therefore to the same icon name.
+
+const (
+	identiconGrid    = 5
+	identiconPadding = 28
+	identiconCell    = (avatarSize - 2*identiconPadding) / identiconGrid
+)
+
+var identiconBackground = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+
+func identicon(name string) image.Image {
+	sum := sha1.Sum([]byte(name))
+
+	hue := float64(uint16(sum[0])<<8|uint16(sum[1])) / 65536 * 360
+	sat := 0.45 + float64(sum[2])/255*0.2
+	lum := 0.45 + float64(sum[3])/255*0.15
+	fg := hslToRGB(hue, sat, lum)
+
+	img := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{identiconBackground}, image.ZP, draw.Src)
+
+	half := (identiconGrid + 1) / 2
+	for row := 0; row < identiconGrid; row++ {
+		for col := 0; col < half; col++ {
+			// One bit per cell of the left half, from byte 4 onwards.
+			bit := row*half + col
+			if sum[4+bit/8]>>(uint(bit)%8)&1 == 0 {
+				continue
+			}
+			fillIdenticonCell(img, row, col, fg)
+			fillIdenticonCell(img, row, identiconGrid-1-col, fg)
+		}
+	}
+	return img
+}
+
+func fillIdenticonCell(img *image.RGBA, row, col int, c color.RGBA) {
+	x0 := identiconPadding + col*identiconCell
+	y0 := identiconPadding + row*identiconCell
+	r := image.Rect(x0, y0, x0+identiconCell, y0+identiconCell)
+	draw.Draw(img, r, &image.Uniform{c}, image.ZP, draw.Src)
+}
+
+func hslToRGB(h, s, l float64) color.RGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return color.RGBA{
+		uint8(math.Floor((r+m)*255 + 0.5)),
+		uint8(math.Floor((g+m)*255 + 0.5)),
+		uint8(math.Floor((b+m)*255 + 0.5)),
+		0xff,
+	}
+}
+
+// generateAvatar renders and stores the identicon for name and returns
+// its icon name.
+func generateAvatar(txn *Transaction, name string) (string, error) {
+	data, err := encodeIcon(identicon(name), ".png")
+	if err != nil {
+		return "", err
+	}
+	iconName := fmt.Sprintf("%x.png", sha1.Sum(data))
+	if err := saveAvatar(txn, iconName, data); err != nil {
+		return "", err
+	}
+	return iconName, nil
+}
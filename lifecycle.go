@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// The server starts listening before MySQL and Redis are reachable.
+// connectDependencies brings them up in the background; until it is done
+// every route except the health checks answers 503. On SIGTERM /readyz
+// starts failing so the load balancer takes the host out of rotation,
+// then in-flight requests are drained, background workers stopped and
+// the pools closed.
+
+const healthCheckInterval = 2 * time.Second
+
+// Dependency names reported by /readyz.
+const (
+	depMySQL  = "mysql"
+	depRedis  = "redis"
+	depSchema = "schema"
+)
+
+type DependencyStatus struct {
+	OK    bool      `json:"ok"`
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+var health = struct {
+	sync.RWMutex
+	deps     map[string]*DependencyStatus
+	started  bool
+	draining bool
+}{
+	deps: map[string]*DependencyStatus{
+		depMySQL:  {Error: "connecting", Since: time.Now()},
+		depRedis:  {Error: "connecting", Since: time.Now()},
+		depSchema: {Error: "pending", Since: time.Now()},
+	},
+}
+
+var (
+	// shutdownCh is closed when background workers should stop.
+	shutdownCh = make(chan struct{})
+	workers    sync.WaitGroup
+)
+
+func setDependency(name string, err error) {
+	health.Lock()
+	defer health.Unlock()
+	st := health.deps[name]
+	ok := err == nil
+	if st.OK != ok {
+		st.Since = time.Now()
+		if ok {
+			logEntry(levelInfo, Fields{"dependency": name}, "Dependency up")
+		} else {
+			logEntry(levelWarn, Fields{"dependency": name, "error": err}, "Dependency down")
+		}
+	}
+	st.OK = ok
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+	}
+}
+
+func pingMySQL() error {
+	return db.Ping()
+}
+
+// pingRedis pings every node, updating its circuit breaker, and returns
+// the first failure.
+func pingRedis() error {
+	var first error
+	for _, n := range shards.nodes {
+		err := n.Ping().Err()
+		n.breaker.Probe(err)
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", n.addr, err)
+		}
+	}
+	return first
+}
+
+// waitFor retries ping until it succeeds or shutdown begins.
+func waitFor(name string, ping func() error) bool {
+	for {
+		err := ping()
+		setDependency(name, err)
+		if err == nil {
+			return true
+		}
+		logEntry(levelWarn, Fields{"dependency": name, "error": err}, "Waiting for dependency")
+		select {
+		case <-shutdownCh:
+			return false
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// connectDependencies waits for MySQL, checks the schema and then starts
+// serving and the background workers. Redis is not waited for: without it
+// the app serves from MySQL in degraded mode (see degraded.go). The memory
+// stores need neither and start serving at once.
+func connectDependencies() {
+	if memoryStores {
+		health.Lock()
+		health.deps = map[string]*DependencyStatus{}
+		health.Unlock()
+	} else {
+		if !waitFor(depMySQL, pingMySQL) {
+			return
+		}
+		if err := checkSchema(); err != nil {
+			setDependency(depSchema, err)
+			log.Fatalln("Failed to checkSchema:", err)
+		}
+		setDependency(depSchema, nil)
+		setDependency(depRedis, pingRedis())
+	}
+
+	// Workers are started under the lock so that none can start after
+	// serve has begun shutting down.
+	health.Lock()
+	defer health.Unlock()
+	if health.draining {
+		return
+	}
+	health.started = true
+	log.Println("Ready to serve.")
+
+	refreshLogLevel()
+	runPeriodically(logLevelRefreshRate, refreshLogLevel)
+	if memoryStores {
+		// The other workers only deal with MySQL and Redis.
+		return
+	}
+	startReplicationWorker()
+	startWebhookWorker()
+	startIconGC()
+	runPeriodically(healthCheckInterval, func() {
+		setDependency(depMySQL, pingMySQL())
+		setDependency(depRedis, pingRedis())
+	})
+	runPeriodically(redisBackfillInterval, backfillRedis)
+}
+
+// runPeriodically calls fn every interval until shutdown. Shutdown waits
+// for a call in progress to finish.
+func runPeriodically(interval time.Duration, fn func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-shutdownCh:
+				return
+			case <-t.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// requireStarted answers 503 until the dependencies are up.
+func requireStarted(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Path() {
+		case "/healthz", "/readyz", "/metrics", "/openapi.json":
+			return next(c)
+		}
+		health.RLock()
+		started := health.started
+		health.RUnlock()
+		if !started {
+			c.Response().Header().Set("Retry-After", "3")
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "starting")
+		}
+		return next(c)
+	}
+}
+
+// request handlers
+
+// getHealthz is the liveness check: the process is up and serving.
+func getHealthz(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+// getReadyz reports whether this host should receive traffic. A Redis
+// outage does not take it out of rotation; it is reported as degraded.
+func getReadyz(c echo.Context) error {
+	health.RLock()
+	deps := make(map[string]DependencyStatus, len(health.deps))
+	ready := health.started && !health.draining
+	for name, st := range health.deps {
+		deps[name] = *st
+		if name != depRedis {
+			ready = ready && st.OK
+		}
+	}
+	draining := health.draining
+	health.RUnlock()
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, map[string]interface{}{
+		"ready":        ready,
+		"draining":     draining,
+		"degraded":     isDegraded(),
+		"dependencies": deps,
+	})
+}
+
+// serve runs e until SIGTERM or SIGINT and then shuts down gracefully.
+func serve(e *echo.Echo) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.Start(config.Listen)
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errCh:
+		log.Fatalln("Failed to start server:", err)
+	case s := <-sig:
+		log.Println("Received", s, "- shutting down")
+	}
+
+	health.Lock()
+	health.draining = true
+	health.Unlock()
+	// Give the load balancer time to see /readyz fail before the
+	// listener closes.
+	time.Sleep(config.ShutdownDelay.Duration)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Println("Failed to drain requests:", err)
+	}
+	close(shutdownCh)
+	workers.Wait()
+	db.Close()
+	shards.close()
+	log.Println("Shutdown complete.")
+}
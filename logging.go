@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	glog "github.com/labstack/gommon/log"
+)
+
+// Logs are JSON lines on stderr. Lines written while handling a request
+// carry its request ID (taken from X-Request-ID or generated), route,
+// user ID once known and the latency so far; the request ID is forwarded
+// to peers on icon replication calls. The level is shared by all hosts
+// through app_setting and can be changed from the admin page.
+
+const (
+	requestIDHeader = "X-Request-ID"
+
+	settingLogLevel     = "log_level"
+	logLevelRefreshRate = 5 * time.Second
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+var (
+	currentLogLevel = int32(levelInfo)
+	// defaultLogLevel applies while no level is stored in app_setting.
+	defaultLogLevel = levelInfo
+
+	logMu  sync.Mutex
+	logOut = os.Stderr
+)
+
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+func setLogLevel(l logLevel) {
+	if old := logLevel(atomic.SwapInt32(&currentLogLevel, int32(l))); old != l {
+		logEntry(levelInfo, Fields{"from": old.String(), "to": l.String()}, "Log level changed")
+	}
+}
+
+// refreshLogLevel picks up a level changed on another host.
+func refreshLogLevel() {
+	v, err := getSetting(nil, settingLogLevel)
+	if err != nil {
+		logEntry(levelWarn, nil, "Failed to refreshLogLevel:", err)
+		return
+	}
+	l := defaultLogLevel
+	if v != "" {
+		if l, err = parseLogLevel(v); err != nil {
+			logEntry(levelWarn, nil, "Failed to refreshLogLevel:", err)
+			return
+		}
+	}
+	setLogLevel(l)
+}
+
+type Fields map[string]interface{}
+
+// logEntry writes one line at level with fields. The message is
+// formatted like log.Println.
+func logEntry(level logLevel, fields Fields, args ...interface{}) {
+	if level < getLogLevel() {
+		return
+	}
+	entry := make(Fields, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"level":"error","msg":%q}`, "Failed to encode log entry: "+err.Error()))
+	}
+	logMu.Lock()
+	logOut.Write(append(b, '\n'))
+	logMu.Unlock()
+}
+
+// stdLogWriter turns lines written through the standard log package,
+// which carry no request context, into JSON entries.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		msg := string(line)
+		level := levelInfo
+		if strings.HasPrefix(msg, "Failed to") {
+			level = levelError
+		}
+		logEntry(level, nil, msg)
+	}
+	return len(p), nil
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
+
+// quietEcho stops echo's own text output. Handler errors are reported on
+// the request line instead.
+func quietEcho(e *echo.Echo) {
+	e.HideBanner = true
+	e.Logger.SetLevel(glog.OFF)
+}
+
+// requestLog is the logging context of one request.
+type requestLog struct {
+	id     string
+	method string
+	route  string
+	start  time.Time
+	userID int64 // atomic
+}
+
+func (r *requestLog) fields() Fields {
+	f := Fields{
+		"request_id": r.id,
+		"method":     r.method,
+		"route":      r.route,
+		"latency_ms": float64(time.Since(r.start)) / float64(time.Millisecond),
+	}
+	if id := atomic.LoadInt64(&r.userID); id != 0 {
+		f["user_id"] = id
+	}
+	return f
+}
+
+type requestLogKey struct{}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestLogFrom(ctx context.Context) *requestLog {
+	r, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	return r
+}
+
+// setLogUser records the signed-in user on the request's log lines.
+func setLogUser(c echo.Context, userID int64) {
+	if r := requestLogFrom(c.Request().Context()); r != nil {
+		atomic.StoreInt64(&r.userID, userID)
+	}
+}
+
+// logRequests assigns the request ID and writes one line per request
+// once it is done.
+func logRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		r := &requestLog{id: id, method: req.Method, route: routeLabel(c), start: time.Now()}
+		c.Response().Header().Set(requestIDHeader, id)
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestLogKey{}, r)))
+
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+		status := c.Response().Status
+		level := levelInfo
+		if status >= 500 {
+			level = levelError
+		}
+		f := r.fields()
+		f["uri"] = req.RequestURI
+		f["status"] = status
+		f["bytes_out"] = c.Response().Size
+		f["remote_ip"] = clientIP(c)
+		if err != nil {
+			f["error"] = err
+		}
+		logEntry(level, f, "request")
+		return nil
+	}
+}
+
+// Transaction log methods. A nil *Transaction logs without request
+// fields.
+
+func (txn *Transaction) logFields() Fields {
+	if txn == nil || txn.req == nil {
+		return nil
+	}
+	return txn.req.fields()
+}
+
+func (txn *Transaction) Debug(args ...interface{}) { logEntry(levelDebug, txn.logFields(), args...) }
+func (txn *Transaction) Info(args ...interface{})  { logEntry(levelInfo, txn.logFields(), args...) }
+func (txn *Transaction) Warn(args ...interface{})  { logEntry(levelWarn, txn.logFields(), args...) }
+func (txn *Transaction) Error(args ...interface{}) { logEntry(levelError, txn.logFields(), args...) }
+
+// RequestID returns the ID of the request the transaction belongs to, or
+// "" outside a request.
+func (txn *Transaction) RequestID() string {
+	if txn == nil || txn.req == nil {
+		return ""
+	}
+	return txn.req.id
+}
+
+// request handlers
+
+func postAdminLogLevel(c echo.Context) error {
+	txn := app.StartTransaction("postAdminLogLevel", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	level, err := parseLogLevel(c.FormValue("level"))
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if err := setSetting(txn, settingLogLevel, level.String()); err != nil {
+		txn.Error("Failed to postAdminLogLevel:", err)
+		return err
+	}
+	setLogLevel(level)
+	audit(txn, c, auditAdminLogLevel, self, "setting", 0, settingLogLevel, level.String())
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/labstack/echo"
+)
+
+// A small Prometheus registry: counters and histograms with labels plus
+// gauges read at scrape time, exposed in the text format on /metrics.
+
+type metric interface {
+	write(b *bytes.Buffer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	metrics = append(metrics, m)
+	metricsMu.Unlock()
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *metricDesc) header(b *bytes.Buffer, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+// labelPairs renders {a="x",b="y"} with extra appended as-is.
+func (d *metricDesc) labelPairs(values []string, extra string) string {
+	var pairs []string
+	for i, l := range d.labels {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, l, v))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counter struct {
+	metricDesc
+	mu     sync.Mutex
+	values map[string][]string
+	counts map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{
+		metricDesc: metricDesc{name, help, labels},
+		values:     map[string][]string{},
+		counts:     map[string]float64{},
+	}
+	registerMetric(c)
+	return c
+}
+
+func (c *counter) Add(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	c.mu.Lock()
+	c.values[key] = labelValues
+	c.counts[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counter) write(b *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(b, "counter")
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %s\n", c.name, c.labelPairs(c.values[k], ""), formatFloat(c.counts[k]))
+	}
+}
+
+type histogramSeries struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type histogram struct {
+	metricDesc
+	bounds []float64
+	mu     sync.Mutex
+	values map[string][]string
+	series map[string]*histogramSeries
+}
+
+var defaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newHistogram(name, help string, labels ...string) *histogram {
+	h := &histogram{
+		metricDesc: metricDesc{name, help, labels},
+		bounds:     defaultBuckets,
+		values:     map[string][]string{},
+		series:     map[string]*histogramSeries{},
+	}
+	registerMetric(h)
+	return h
+}
+
+func (h *histogram) Observe(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{buckets: make([]uint64, len(h.bounds))}
+		h.series[key] = s
+		h.values[key] = labelValues
+	}
+	for i, bound := range h.bounds {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Since observes the seconds elapsed since start.
+func (h *histogram) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogram) write(b *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(b, "histogram")
+	for _, k := range sortedKeys(h.values) {
+		s, values := h.series[k], h.values[k]
+		for i, bound := range h.bounds {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name,
+				h.labelPairs(values, `le="`+formatFloat(bound)+`"`), s.buckets[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, h.labelPairs(values, `le="+Inf"`), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", h.name, h.labelPairs(values, ""), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, h.labelPairs(values, ""), s.count)
+	}
+}
+
+// funcMetric reports the value of fn at scrape time, as a gauge or as a
+// counter maintained elsewhere.
+type funcMetric struct {
+	metricDesc
+	kind string
+	fn   func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	registerMetric(&funcMetric{metricDesc{name: name, help: help}, "gauge", fn})
+}
+
+func newCounterFunc(name, help string, fn func() float64) {
+	registerMetric(&funcMetric{metricDesc{name: name, help: help}, "counter", fn})
+}
+
+func (m *funcMetric) write(b *bytes.Buffer) {
+	m.header(b, m.kind)
+	fmt.Fprintf(b, "%s %s\n", m.name, formatFloat(m.fn()))
+}
+
+// Application metrics.
+var (
+	httpRequestDuration = newHistogram("isubata_http_request_duration_seconds",
+		"HTTP request latency by route.", "method", "route", "status")
+	dbQueryDuration = newHistogram("isubata_db_query_duration_seconds",
+		"MySQL query latency by table and operation.", "table", "operation")
+	redisCommandDuration = newHistogram("isubata_redis_command_duration_seconds",
+		"Redis command latency.", "command")
+	redisCommandErrors = newCounter("isubata_redis_command_errors_total",
+		"Redis commands that failed, excluding nil replies.", "command")
+	messagesPosted = newCounter("isubata_messages_posted_total",
+		"Messages posted.")
+	messagesDelivered = newCounter("isubata_messages_delivered_total",
+		"Messages returned to polling clients.")
+	webhookDeliveries = newCounter("isubata_webhook_deliveries_total",
+		"Webhook delivery attempts by resulting status.", "status")
+)
+
+func init() {
+	newGaugeFunc("isubata_degraded", "1 while serving without a Redis node or restoring one.", func() float64 {
+		if isDegraded() {
+			return 1
+		}
+		return 0
+	})
+	newGaugeFunc("isubata_db_open_connections", "Open MySQL connections.", func() float64 {
+		if db == nil {
+			return 0
+		}
+		return float64(db.Stats().OpenConnections)
+	})
+	newGaugeFunc("isubata_redis_pool_connections", "Open Redis connections.", func() float64 {
+		return redisPoolStat(func(s *redis.PoolStats) uint32 { return s.TotalConns })
+	})
+	newCounterFunc("isubata_redis_pool_hits_total", "Redis pool checkouts served by an idle connection.", func() float64 {
+		return redisPoolStat(func(s *redis.PoolStats) uint32 { return s.Hits })
+	})
+	newCounterFunc("isubata_redis_pool_timeouts_total", "Redis pool checkouts that timed out.", func() float64 {
+		return redisPoolStat(func(s *redis.PoolStats) uint32 { return s.Timeouts })
+	})
+}
+
+// redisPoolStat sums a pool statistic over the Redis nodes.
+func redisPoolStat(stat func(*redis.PoolStats) uint32) float64 {
+	if shards == nil {
+		return 0
+	}
+	var sum float64
+	for _, n := range shards.nodes {
+		sum += float64(stat(n.PoolStats()))
+	}
+	return sum
+}
+
+// instrumentRedis times every command sent through a Redis client. A
+// pipeline is timed as a whole under the command "pipeline"; failures
+// are counted per command.
+func instrumentRedis(rd *redis.Client) {
+	rd.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			start := time.Now()
+			err := old(cmd)
+			redisCommandDuration.Since(start, cmd.Name())
+			if err != nil && err != redis.Nil {
+				redisCommandErrors.Inc(cmd.Name())
+			}
+			return err
+		}
+	})
+	rd.WrapProcessPipeline(func(old func(cmds []redis.Cmder) error) func(cmds []redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			start := time.Now()
+			err := old(cmds)
+			redisCommandDuration.Since(start, "pipeline")
+			for _, cmd := range cmds {
+				if err := cmd.Err(); err != nil && err != redis.Nil {
+					redisCommandErrors.Inc(cmd.Name())
+				}
+			}
+			return err
+		}
+	})
+}
+
+// request handlers
+
+func getMetrics(c echo.Context) error {
+	var b bytes.Buffer
+	metricsMu.Lock()
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	metricsMu.Unlock()
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", b.Bytes())
+}
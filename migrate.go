@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The schema is a list of numbered migrations applied in order and
+// recorded in schema_migrations. `isubata migrate` applies or reverts
+// them; at startup the server refuses to run against a database migrated
+// by a newer build, and applies pending migrations itself only when
+// auto_migrate is set. Hosts serialize migrations with a MySQL advisory
+// lock.
+//
+// Version 1 describes the original isubata tables and later ones the
+// tables this fork used to create on startup, so statements that fail
+// because the object already exists are treated as applied. A database
+// set up before migrations existed is thereby adopted by `migrate up`.
+
+type migration struct {
+	version int
+	name    string
+	up      []string
+	// down is nil for migrations that cannot be reverted.
+	down []string
+}
+
+var migrations = []migration{
+	{1, "original_schema", []string{
+		`CREATE TABLE IF NOT EXISTS user (
+			id BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+			name VARCHAR(191) UNIQUE,
+			salt VARCHAR(20),
+			password VARCHAR(40),
+			display_name TEXT,
+			avatar_icon TEXT,
+			created_at DATETIME NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS image (
+			id BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+			name VARCHAR(191),
+			data LONGBLOB
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS channel (
+			id BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+			name TEXT NOT NULL,
+			description MEDIUMTEXT,
+			updated_at DATETIME NOT NULL,
+			created_at DATETIME NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS message (
+			id BIGINT UNSIGNED PRIMARY KEY AUTO_INCREMENT,
+			channel_id BIGINT,
+			user_id BIGINT,
+			content TEXT,
+			created_at DATETIME NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, nil},
+	{2, "two_factor_auth", []string{
+		`CREATE TABLE IF NOT EXISTS user_totp (
+			user_id BIGINT NOT NULL PRIMARY KEY,
+			secret VARCHAR(64) NOT NULL,
+			last_step BIGINT NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS user_recovery_code (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			code_hash CHAR(64) NOT NULL,
+			used_at DATETIME NULL,
+			INDEX (user_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS user_recovery_code`,
+		`DROP TABLE IF EXISTS user_totp`,
+	}},
+	{3, "moderation", []string{
+		`CREATE TABLE IF NOT EXISTS user_status (
+			user_id BIGINT NOT NULL PRIMARY KEY,
+			is_admin TINYINT(1) NOT NULL DEFAULT 0,
+			banned TINYINT(1) NOT NULL DEFAULT 0,
+			suspended_until DATETIME NULL,
+			reason VARCHAR(255) NOT NULL DEFAULT '',
+			sessions_revoked_at DATETIME NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS app_setting (
+			name VARCHAR(64) NOT NULL PRIMARY KEY,
+			value VARCHAR(255) NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS app_setting`,
+		`DROP TABLE IF EXISTS user_status`,
+	}},
+	{4, "audit_log", []string{
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			created_at DATETIME NOT NULL,
+			action VARCHAR(64) NOT NULL,
+			actor_id BIGINT NOT NULL DEFAULT 0,
+			actor_name VARCHAR(191) NOT NULL DEFAULT '',
+			target_type VARCHAR(32) NOT NULL DEFAULT '',
+			target_id BIGINT NOT NULL DEFAULT 0,
+			target_name VARCHAR(255) NOT NULL DEFAULT '',
+			ip VARCHAR(64) NOT NULL DEFAULT '',
+			user_agent VARCHAR(255) NOT NULL DEFAULT '',
+			detail TEXT NOT NULL,
+			INDEX (created_at),
+			INDEX (action, id),
+			INDEX (actor_name, id),
+			INDEX (target_name(191), id),
+			INDEX (ip, id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS audit_log`,
+	}},
+	{5, "icon_replication", []string{
+		`CREATE TABLE IF NOT EXISTS icon_replication (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			icon_name VARCHAR(128) NOT NULL,
+			source VARCHAR(128) NOT NULL,
+			host VARCHAR(128) NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_error VARCHAR(255) NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			UNIQUE (icon_name, source, host),
+			INDEX (source, status, next_attempt_at)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS icon_replication`,
+	}},
+	{6, "icon_gc", []string{
+		`CREATE TABLE IF NOT EXISTS icon_gc_mark (
+			name VARCHAR(128) NOT NULL PRIMARY KEY,
+			marked_at DATETIME NOT NULL
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS icon_gc_run (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			started_at DATETIME NOT NULL,
+			finished_at DATETIME NOT NULL,
+			dry_run TINYINT(1) NOT NULL,
+			scanned INT NOT NULL,
+			marked INT NOT NULL,
+			deleted INT NOT NULL,
+			bytes BIGINT NOT NULL,
+			names TEXT NOT NULL,
+			error VARCHAR(255) NOT NULL DEFAULT ''
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS icon_gc_run`,
+		`DROP TABLE IF EXISTS icon_gc_mark`,
+	}},
+	{7, "replication_request_id", []string{
+		`ALTER TABLE icon_replication ADD COLUMN request_id VARCHAR(64) NOT NULL DEFAULT '' AFTER last_error`,
+	}, []string{
+		`ALTER TABLE icon_replication DROP COLUMN request_id`,
+	}},
+	{8, "outgoing_webhooks", []string{
+		`ALTER TABLE channel ADD COLUMN owner_id BIGINT NOT NULL DEFAULT 0 AFTER description`,
+		`CREATE TABLE IF NOT EXISTS webhook (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			channel_id BIGINT NOT NULL,
+			url VARCHAR(2048) NOT NULL,
+			secret VARCHAR(64) NOT NULL,
+			events VARCHAR(255) NOT NULL,
+			active TINYINT(1) NOT NULL DEFAULT 1,
+			failures INT NOT NULL DEFAULT 0,
+			disabled_reason VARCHAR(255) NOT NULL DEFAULT '',
+			created_by BIGINT NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			INDEX (channel_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS webhook_delivery (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			webhook_id BIGINT NOT NULL,
+			source VARCHAR(128) NOT NULL,
+			event VARCHAR(32) NOT NULL,
+			payload MEDIUMTEXT NOT NULL,
+			status VARCHAR(16) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			response_status INT NOT NULL DEFAULT 0,
+			last_error VARCHAR(255) NOT NULL DEFAULT '',
+			request_id VARCHAR(64) NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			INDEX (source, status, next_attempt_at),
+			INDEX (webhook_id, id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS webhook_delivery`,
+		`DROP TABLE IF EXISTS webhook`,
+		`ALTER TABLE channel DROP COLUMN owner_id`,
+	}},
+	{9, "incoming_webhooks", []string{
+		`CREATE TABLE IF NOT EXISTS incoming_webhook (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			channel_id BIGINT NOT NULL,
+			name VARCHAR(191) NOT NULL,
+			token_hash CHAR(64) NOT NULL,
+			user_id BIGINT NOT NULL,
+			created_by BIGINT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_used_at DATETIME NULL,
+			INDEX (channel_id)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS incoming_webhook_user (
+			webhook_id BIGINT NOT NULL,
+			persona CHAR(40) NOT NULL,
+			user_id BIGINT NOT NULL,
+			PRIMARY KEY (webhook_id, persona)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	}, []string{
+		`DROP TABLE IF EXISTS incoming_webhook_user`,
+		`DROP TABLE IF EXISTS incoming_webhook`,
+	}},
+	// Concurrent puts of one icon could both insert it. Copies of a name
+	// hold the same icon, so the oldest is kept.
+	{10, "unique_image_name", []string{
+		`DELETE i1 FROM image i1 JOIN image i2 ON i1.name = i2.name AND i1.id > i2.id`,
+		`ALTER TABLE image ADD UNIQUE KEY image_name (name)`,
+	}, []string{
+		`ALTER TABLE image DROP INDEX image_name`,
+	}},
+}
+
+const (
+	migrationLockName = "isubata:migrate"
+	migrationLockWait = 60 // seconds
+)
+
+var errMigrationLocked = errors.New("another host is migrating the database")
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// alreadyDone reports whether err means the object a statement creates or
+// drops is already in the desired state.
+func alreadyDone(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return false
+	}
+	switch merr.Number {
+	case 1050, // table already exists
+		1060, // duplicate column name
+		1061, // duplicate key name
+		1091: // can't drop column or key; it does not exist
+		return true
+	}
+	return false
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// appliedMigrations returns the applied versions and when they were
+// applied. A database without schema_migrations has none.
+func appliedMigrations(q queryer) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(context.Background(), "SELECT version, applied_at FROM schema_migrations")
+	if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1146 { // table doesn't exist
+		return map[int]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+func maxVersion(applied map[int]time.Time) int {
+	max := 0
+	for v := range applied {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock.
+func withMigrationLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLockName, migrationLockWait).Scan(&got); err != nil {
+		return err
+	}
+	if !got.Valid || got.Int64 != 1 {
+		return errMigrationLocked
+	}
+	defer conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", migrationLockName).Scan(&got)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at DATETIME NOT NULL
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func runMigrationStatements(conn *sql.Conn, m migration, stmts []string) error {
+	for i, stmt := range stmts {
+		_, err := conn.ExecContext(context.Background(), stmt)
+		if alreadyDone(err) {
+			log.Printf("migration %d (%s): statement %d already applied: %v", m.version, m.name, i+1, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("migration %d (%s), statement %d: %v", m.version, m.name, i+1, err)
+		}
+	}
+	return nil
+}
+
+// migrateUp applies every pending migration up to target and returns the
+// versions applied.
+func migrateUp(target int) ([]int, error) {
+	var done []int
+	err := withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if m.version > target {
+				break
+			}
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if err := runMigrationStatements(conn, m, m.up); err != nil {
+				return err
+			}
+			_, err := conn.ExecContext(context.Background(),
+				"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, NOW())", m.version, m.name)
+			if err != nil {
+				return err
+			}
+			log.Printf("Applied migration %d (%s)", m.version, m.name)
+			done = append(done, m.version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// migrateDown reverts the newest steps applied migrations and returns the
+// versions reverted.
+func migrateDown(steps int) ([]int, error) {
+	var done []int
+	err := withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			if m.down == nil {
+				return fmt.Errorf("migration %d (%s) cannot be reverted", m.version, m.name)
+			}
+			if err := runMigrationStatements(conn, m, m.down); err != nil {
+				return err
+			}
+			_, err := conn.ExecContext(context.Background(), "DELETE FROM schema_migrations WHERE version = ?", m.version)
+			if err != nil {
+				return err
+			}
+			log.Printf("Reverted migration %d (%s)", m.version, m.name)
+			done = append(done, m.version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// printMigrationStatus lists every known migration, and any applied one
+// this build does not know, with when it was applied.
+func printMigrationStatus(w io.Writer) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.version] = true
+		status := "pending"
+		if at, ok := applied[m.version]; ok {
+			status = at.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.version, m.name, status)
+	}
+	var unknown []int
+	for v := range applied {
+		if !known[v] {
+			unknown = append(unknown, v)
+		}
+	}
+	sort.Ints(unknown)
+	for _, v := range unknown {
+		fmt.Fprintf(tw, "%d\t?\t%s (unknown to this build)\n", v, applied[v].Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
+
+// checkSchema refuses databases migrated by a newer build and applies
+// pending migrations when auto_migrate is set.
+func checkSchema() error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	if v := maxVersion(applied); v > latestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", v, latestSchemaVersion())
+	}
+	pending := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return nil
+	}
+	if !config.AutoMigrate {
+		return fmt.Errorf("%d pending migrations; run `isubata migrate up`", pending)
+	}
+	_, err = migrateUp(latestSchemaVersion())
+	return err
+}
+
+// cmdMigrate implements `isubata migrate up [version] | down [steps] | status`.
+func cmdMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [version] | down [steps] | status")
+	}
+	if err := db.Ping(); err != nil {
+		return err
+	}
+	arg := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		return strconv.Atoi(args[1])
+	}
+	switch args[0] {
+	case "up":
+		target, err := arg(latestSchemaVersion())
+		if err != nil {
+			return err
+		}
+		done, err := migrateUp(target)
+		if err == nil && len(done) == 0 {
+			log.Println("Database is up to date.")
+		}
+		return err
+	case "down":
+		steps, err := arg(1)
+		if err != nil {
+			return err
+		}
+		_, err = migrateDown(steps)
+		return err
+	case "status":
+		return printMigrationStatus(os.Stdout)
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// /openapi.json describes every registered route as OpenAPI 3.0. Routes
+// are documented in routeDocs below; JSON schemas are derived from the Go
+// types the handlers encode. The document is built when the server starts
+// and it refuses to start if a route has no entry or an entry has no
+// route, so the two cannot drift apart. `isubata openapi` prints the
+// document, and fails the same way, for generating clients or for CI.
+
+// Doc-only shapes of JSON that page handlers build as maps.
+
+// PageMessage is a message as returned by GET /message.
+type PageMessage struct {
+	ID   int64 `json:"id"`
+	User User  `json:"user"`
+	// Date is in "2006/01/02 15:04:05" format, server local time.
+	Date    string `json:"date"`
+	Content string `json:"content"`
+}
+
+type UnreadCount struct {
+	ChannelID int64 `json:"channel_id"`
+	Unread    int64 `json:"unread"`
+}
+
+type Readiness struct {
+	Ready        bool                        `json:"ready"`
+	Draining     bool                        `json:"draining"`
+	Degraded     bool                        `json:"degraded"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// PageError is echo's error body outside /api/v1.
+type PageError struct {
+	Message string `json:"message"`
+}
+
+// routeDoc documents one route.
+type routeDoc struct {
+	summary string
+	// auth is "session", "admin", "peer" or "" for none.
+	auth   string
+	params []docParam
+	// form fields are sent urlencoded, or as multipart with a file.
+	form      []docParam
+	multipart bool
+	// body is a value of the JSON request body's type.
+	body      interface{}
+	responses []docResponse
+}
+
+type docParam struct {
+	in, name, typ, desc string
+	required            bool
+}
+
+type docResponse struct {
+	status      int
+	desc        string
+	contentType string
+	// body is a value of the response type, or a listOf or arrayOf one.
+	body interface{}
+}
+
+// listOf is an APIList whose items are of the given type.
+type listOf struct{ item interface{} }
+
+// arrayOf is a JSON array of the given type.
+type arrayOf struct{ item interface{} }
+
+func pathParam(name, typ, desc string) docParam {
+	return docParam{in: "path", name: name, typ: typ, desc: desc, required: true}
+}
+
+func queryParam(name, typ, desc string) docParam {
+	return docParam{in: "query", name: name, typ: typ, desc: desc}
+}
+
+func field(name, typ, desc string) docParam {
+	return docParam{name: name, typ: typ, desc: desc}
+}
+
+func requiredField(name, typ, desc string) docParam {
+	return docParam{name: name, typ: typ, desc: desc, required: true}
+}
+
+func htmlPage(desc string) docResponse {
+	return docResponse{status: http.StatusOK, desc: desc, contentType: echo.MIMETextHTMLCharsetUTF8}
+}
+
+func redirect(desc string) docResponse {
+	return docResponse{status: http.StatusSeeOther, desc: desc}
+}
+
+func jsonResponse(status int, desc string, body interface{}) docResponse {
+	return docResponse{status: status, desc: desc, contentType: echo.MIMEApplicationJSON, body: body}
+}
+
+func noContent(desc string) docResponse {
+	return docResponse{status: http.StatusNoContent, desc: desc}
+}
+
+var (
+	channelIDParam   = pathParam("channel_id", "integer", "Channel ID.")
+	userIDParam      = pathParam("user_id", "integer", "User ID.")
+	webhookIDParam   = pathParam("webhook_id", "integer", "Webhook ID.")
+	confirmField     = field("confirm", "string", `"1" to skip the confirmation page.`)
+	backField        = field("back", "string", "Admin page to return to.")
+	offsetParam      = queryParam("offset", "integer", "Items to skip.")
+	limitParam       = queryParam("limit", "integer", fmt.Sprintf("Items per page, 1 to %d (default %d).", apiMaxLimit, apiDefaultLimit))
+	confirmationPage = htmlPage("Confirmation page, unless confirm=1.")
+)
+
+// routeDocs is keyed by "METHOD /path" as registered with echo.
+var routeDocs = map[string]routeDoc{
+	// operations
+	"GET /healthz": {summary: "Liveness check.",
+		responses: []docResponse{{status: http.StatusOK, desc: "The process is up.", contentType: echo.MIMETextPlainCharsetUTF8}}},
+	"GET /readyz": {summary: "Readiness check; 503 while starting, draining or without MySQL.",
+		responses: []docResponse{
+			jsonResponse(http.StatusOK, "Ready for traffic.", Readiness{}),
+			jsonResponse(http.StatusServiceUnavailable, "Not ready.", Readiness{}),
+		}},
+	"GET /metrics": {summary: "Prometheus metrics.",
+		responses: []docResponse{{status: http.StatusOK, desc: "Text exposition format.", contentType: "text/plain; version=0.0.4"}}},
+	"GET /initialize": {summary: "Reset the data to the benchmark's initial state.",
+		responses: []docResponse{noContent("Reset.")}},
+	"GET /openapi.json": {summary: "This document.",
+		responses: []docResponse{jsonResponse(http.StatusOK, "OpenAPI 3.0 document.", map[string]interface{}{})}},
+
+	// pages
+	"GET /": {summary: "Top page; redirects to channel 1 when logged in.",
+		responses: []docResponse{htmlPage("Top page."), redirect("Logged in.")}},
+	"GET /register": {summary: "Registration form.", responses: []docResponse{htmlPage("Form.")}},
+	"POST /register": {summary: "Register and log in.",
+		form: []docParam{requiredField("name", "string", "User name."), requiredField("password", "string", "Password.")},
+		responses: []docResponse{
+			redirect("Registered; to /."),
+			{status: http.StatusConflict, desc: "Name taken."},
+		}},
+	"GET /login": {summary: "Login form.", responses: []docResponse{htmlPage("Form.")}},
+	"POST /login": {summary: "Log in.",
+		form:      []docParam{requiredField("name", "string", "User name."), requiredField("password", "string", "Password.")},
+		responses: []docResponse{redirect("Logged in, or to /login/2fa for the second factor.")}},
+	"GET /logout":    {summary: "Log out.", responses: []docResponse{redirect("To /.")}},
+	"GET /login/2fa": {summary: "Second factor form.", responses: []docResponse{htmlPage("Form.")}},
+	"POST /login/2fa": {summary: "Complete a login with a TOTP or recovery code.",
+		form: []docParam{requiredField("code", "string", "TOTP or recovery code.")},
+		responses: []docResponse{
+			redirect("Logged in."),
+			{status: http.StatusTooManyRequests, desc: "Too many failed codes."},
+		}},
+	"GET /channel/:channel_id": {summary: "Channel page.", auth: "session",
+		params: []docParam{channelIDParam}, responses: []docResponse{htmlPage("Channel page.")}},
+	"GET /channel/:channel_id/webhooks": {summary: "Outgoing webhooks of a channel with their recent deliveries.", auth: "session",
+		params:    []docParam{channelIDParam},
+		responses: []docResponse{htmlPage("Webhook settings; for the channel owner and admins.")}},
+	"POST /channel/:channel_id/webhooks": {summary: "Register an outgoing webhook.", auth: "session",
+		params: []docParam{channelIDParam},
+		form: []docParam{
+			requiredField("url", "string", "https:// URL to POST events to."),
+			field("events", "string", "Event to send; repeat for several. All if none: "+strings.Join(webhookEvents, ", ")+"."),
+		},
+		responses: []docResponse{redirect("Registered; to the settings page.")}},
+	"POST /channel/:channel_id/webhooks/:webhook_id/delete": {summary: "Delete an outgoing webhook and its delivery log.", auth: "session",
+		params:    []docParam{channelIDParam, webhookIDParam},
+		responses: []docResponse{redirect("Deleted; to the settings page.")}},
+	"POST /channel/:channel_id/webhooks/:webhook_id/enable": {summary: "Re-enable a disabled outgoing webhook.", auth: "session",
+		params:    []docParam{channelIDParam, webhookIDParam},
+		responses: []docResponse{redirect("Enabled; to the settings page.")}},
+	"POST /channel/:channel_id/incoming_webhooks": {summary: "Create an incoming webhook posting as a new bot user.", auth: "session",
+		params:    []docParam{channelIDParam},
+		form:      []docParam{requiredField("name", "string", "Display name of the bot user.")},
+		responses: []docResponse{htmlPage("Settings page showing the webhook URL, once.")}},
+	"POST /channel/:channel_id/incoming_webhooks/:webhook_id/delete": {summary: "Delete an incoming webhook; its bot users and messages stay.", auth: "session",
+		params:    []docParam{channelIDParam, webhookIDParam},
+		responses: []docResponse{redirect("Deleted; to the settings page.")}},
+	"POST /hooks/:webhook_id/:token": {summary: "Post a message through an incoming webhook, Slack-style.",
+		params: []docParam{
+			pathParam("webhook_id", "integer", "Incoming webhook ID."),
+			pathParam("token", "string", "Secret token from the webhook URL."),
+		},
+		body: IncomingWebhookPayload{},
+		form: []docParam{requiredField("payload", "string", "The JSON payload, as Slack also accepts.")},
+		responses: []docResponse{
+			{status: http.StatusOK, desc: `"ok"`, contentType: echo.MIMETextPlainCharsetUTF8},
+			{status: http.StatusBadRequest, desc: "invalid_payload or no_text.", contentType: echo.MIMETextPlainCharsetUTF8},
+			{status: http.StatusNotFound, desc: "no_service for an unknown webhook or wrong token; channel_not_found.", contentType: echo.MIMETextPlainCharsetUTF8},
+		}},
+	"GET /message": {summary: "Messages newer than last_message_id, oldest first; marks the channel read.", auth: "session",
+		params: []docParam{
+			{in: "query", name: "channel_id", typ: "integer", desc: "Channel ID.", required: true},
+			{in: "query", name: "last_message_id", typ: "integer", desc: "Newest message ID already seen.", required: true},
+		},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Up to 100 messages.", arrayOf{PageMessage{}})}},
+	"POST /message": {summary: "Post a message.", auth: "session",
+		form: []docParam{
+			requiredField("channel_id", "integer", "Channel ID."),
+			requiredField("message", "string", "Message text."),
+		},
+		responses: []docResponse{noContent("Posted.")}},
+	"GET /fetch": {summary: "Unread counts of every channel; answers after a second.", auth: "session",
+		responses: []docResponse{jsonResponse(http.StatusOK, "Unread counts.", arrayOf{UnreadCount{}})}},
+	"GET /history/:channel_id": {summary: "Message history page.", auth: "session",
+		params:    []docParam{channelIDParam, queryParam("page", "integer", "Page number, from 1.")},
+		responses: []docResponse{htmlPage("History page.")}},
+	"GET /profile/:user_name": {summary: "Profile page.", auth: "session",
+		params:    []docParam{pathParam("user_name", "string", "User name.")},
+		responses: []docResponse{htmlPage("Profile page.")}},
+	"POST /profile": {summary: "Update the display name or avatar.", auth: "session", multipart: true,
+		form: []docParam{
+			field("display_name", "string", "New display name."),
+			field("avatar_icon", "file", "JPEG, PNG or GIF avatar."),
+			field("reset_avatar", "string", `"1" to go back to a generated avatar.`),
+		},
+		responses: []docResponse{redirect("Updated; to /.")}},
+	"GET /2fa/setup": {summary: "Two-factor setup page.", auth: "session", responses: []docResponse{htmlPage("Setup page.")}},
+	"POST /2fa/setup": {summary: "Enable two-factor authentication.", auth: "session",
+		form:      []docParam{requiredField("code", "string", "Current TOTP code for the new secret.")},
+		responses: []docResponse{htmlPage("Recovery codes.")}},
+	"GET /2fa/qr.png": {summary: "QR code of the pending TOTP secret.", auth: "session",
+		responses: []docResponse{{status: http.StatusOK, desc: "PNG image.", contentType: "image/png"}}},
+	"POST /2fa/recovery": {summary: "Replace the recovery codes.", auth: "session",
+		form:      []docParam{requiredField("code", "string", "TOTP or recovery code.")},
+		responses: []docResponse{htmlPage("New recovery codes.")}},
+	"POST /2fa/disable": {summary: "Disable two-factor authentication.", auth: "session",
+		form:      []docParam{requiredField("code", "string", "TOTP or recovery code.")},
+		responses: []docResponse{redirect("Disabled; to the profile.")}},
+	"GET /add_channel": {summary: "Channel creation form.", auth: "session", responses: []docResponse{htmlPage("Form.")}},
+	"POST /add_channel": {summary: "Create a channel.", auth: "session",
+		form: []docParam{
+			requiredField("name", "string", "Channel name."),
+			requiredField("description", "string", "Channel description."),
+		},
+		responses: []docResponse{redirect("Created; to the channel.")}},
+	"GET /icons/:file_name": {summary: "Avatar image.",
+		params: []docParam{
+			pathParam("file_name", "string", "Icon file name."),
+			queryParam("s", "integer", "Size in pixels of a resized variant."),
+		},
+		responses: []docResponse{
+			{status: http.StatusOK, desc: "Image.", contentType: "image/*"},
+			{status: http.StatusNotModified, desc: "Matches If-None-Match."},
+		}},
+
+	// admin
+	"GET /admin": {summary: "Admin top.", auth: "admin", responses: []docResponse{redirect("To /admin/users.")}},
+	"GET /admin/users": {summary: "User administration page.", auth: "admin",
+		params: []docParam{
+			queryParam("q", "string", "Name filter."),
+			queryParam("page", "integer", "Page number, from 1."),
+		},
+		responses: []docResponse{htmlPage("Users.")}},
+	"POST /admin/users/:user_id/suspend": {summary: "Suspend a user.", auth: "admin",
+		params: []docParam{userIDParam},
+		form: []docParam{
+			requiredField("days", "integer", "Suspension length."),
+			field("reason", "string", "Reason."),
+			confirmField, backField,
+		},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/users/:user_id/ban": {summary: "Ban a user.", auth: "admin",
+		params:    []docParam{userIDParam},
+		form:      []docParam{field("reason", "string", "Reason."), confirmField, backField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/users/:user_id/reinstate": {summary: "Lift a suspension or ban.", auth: "admin",
+		params: []docParam{userIDParam}, form: []docParam{confirmField, backField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/users/:user_id/revoke_sessions": {summary: "Log a user out everywhere.", auth: "admin",
+		params: []docParam{userIDParam}, form: []docParam{confirmField, backField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/users/:user_id/role": {summary: "Grant or revoke admin.", auth: "admin",
+		params:    []docParam{userIDParam},
+		form:      []docParam{field("grant", "string", `"1" to grant, anything else to revoke.`), confirmField, backField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/users/:user_id/reset_name": {summary: "Reset a display name to the user name.", auth: "admin",
+		params: []docParam{userIDParam}, form: []docParam{confirmField, backField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/users/:user_id/reset_avatar": {summary: "Reset an avatar to a generated one.", auth: "admin",
+		params: []docParam{userIDParam}, form: []docParam{confirmField, backField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/messages/:message_id/delete": {summary: "Delete a message.", auth: "admin",
+		params:    []docParam{pathParam("message_id", "integer", "Message ID.")},
+		form:      []docParam{confirmField, field("back", "string", "History page to return to.")},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/channels/:channel_id/delete": {summary: "Delete a channel and its messages.", auth: "admin",
+		params: []docParam{channelIDParam}, form: []docParam{confirmField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/settings": {summary: "Change site settings.", auth: "admin",
+		form:      []docParam{field("require_2fa", "string", `"1" to require two-factor authentication.`), confirmField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"POST /admin/log_level": {summary: "Change the log level of every host.", auth: "admin",
+		form:      []docParam{requiredField("level", "string", "debug, info, warn or error.")},
+		responses: []docResponse{redirect("Done.")}},
+	"GET /admin/replication": {summary: "Icon replication status page.", auth: "admin",
+		params:    []docParam{queryParam("repaired", "integer", "Jobs requeued by a repair, to report.")},
+		responses: []docResponse{htmlPage("Status.")}},
+	"POST /admin/replication/repair": {summary: "Requeue missing icon replications.", auth: "admin",
+		responses: []docResponse{redirect("To the status page.")}},
+	"GET /admin/icons/gc": {summary: "Icon garbage collection page.", auth: "admin", responses: []docResponse{htmlPage("Status.")}},
+	"POST /admin/icons/gc": {summary: "Run the icon garbage collection.", auth: "admin",
+		form:      []docParam{field("dry_run", "string", `"1" to only report.`), confirmField},
+		responses: []docResponse{confirmationPage, redirect("Done.")}},
+	"GET /admin/audit": {summary: "Audit log page.", auth: "admin",
+		params:    append(auditFilterParams(), queryParam("page", "integer", "Page number, from 1.")),
+		responses: []docResponse{htmlPage("Audit log.")}},
+	"GET /admin/audit.json": {summary: "Audit log export, newest first.", auth: "admin",
+		params:    append(auditFilterParams(), queryParam("limit", "integer", fmt.Sprintf("At most %d entries.", auditExportMax))),
+		responses: []docResponse{jsonResponse(http.StatusOK, "Entries.", arrayOf{AuditEntry{}})}},
+
+	// peers
+	"POST /icons/:file_name": {summary: "Receive a replicated icon.", auth: "peer", multipart: true,
+		params:    []docParam{pathParam("file_name", "string", "Icon file name.")},
+		form:      []docParam{requiredField("avatar_icon", "file", "Icon data.")},
+		responses: []docResponse{{status: http.StatusOK, desc: "Stored."}}},
+	"DELETE /icons/:file_name": {summary: "Delete a garbage-collected icon.", auth: "peer",
+		params:    []docParam{pathParam("file_name", "string", "Icon file name.")},
+		responses: []docResponse{noContent("Deleted.")}},
+	"GET /internal/icons": {summary: "Names of the original icons stored on this host.", auth: "peer",
+		responses: []docResponse{jsonResponse(http.StatusOK, "Icon names.", arrayOf{""})}},
+
+	// api
+	"POST /api/v1/session": {summary: "Log in.", body: apiCredentials{},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Logged in; sets the session cookie.", APIMe{})}},
+	"DELETE /api/v1/session": {summary: "Log out.", responses: []docResponse{noContent("Logged out.")}},
+	"POST /api/v1/users": {summary: "Register and log in.", body: apiCredentials{},
+		responses: []docResponse{jsonResponse(http.StatusCreated, "Registered.", APIUser{})}},
+	"GET /api/v1/users/:user_name": {summary: "A user's profile.", auth: "session",
+		params:    []docParam{pathParam("user_name", "string", "User name.")},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Profile.", APIUser{})}},
+	"GET /api/v1/me": {summary: "The logged-in user.", auth: "session",
+		responses: []docResponse{jsonResponse(http.StatusOK, "Profile.", APIMe{})}},
+	"PATCH /api/v1/me": {summary: "Update the logged-in user.", auth: "session", body: apiProfileUpdate{},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Updated profile.", APIMe{})}},
+	"PUT /api/v1/me/avatar": {summary: "Upload an avatar.", auth: "session", multipart: true,
+		form:      []docParam{requiredField("avatar_icon", "file", "JPEG, PNG or GIF image.")},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Updated profile.", APIMe{})}},
+	"DELETE /api/v1/me/avatar": {summary: "Go back to a generated avatar.", auth: "session",
+		responses: []docResponse{jsonResponse(http.StatusOK, "Updated profile.", APIMe{})}},
+	"GET /api/v1/channels": {summary: "Channels by ID.", auth: "session",
+		params:    []docParam{offsetParam, limitParam},
+		responses: []docResponse{jsonResponse(http.StatusOK, "A page of channels.", listOf{APIChannel{}})}},
+	"POST /api/v1/channels": {summary: "Create a channel.", auth: "session", body: apiChannelCreate{},
+		responses: []docResponse{jsonResponse(http.StatusCreated, "Created.", APIChannel{})}},
+	"GET /api/v1/channels/:channel_id": {summary: "A channel.", auth: "session",
+		params:    []docParam{channelIDParam},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Channel.", APIChannel{})}},
+	"GET /api/v1/channels/:channel_id/messages": {summary: "Messages, newest first.", auth: "session",
+		params: []docParam{
+			channelIDParam, offsetParam, limitParam,
+			queryParam("after", "integer", "Only messages newer than this ID, for polling; offset is ignored."),
+		},
+		responses: []docResponse{jsonResponse(http.StatusOK, "A page of messages.", listOf{APIMessage{}})}},
+	"POST /api/v1/channels/:channel_id/messages": {summary: "Post a message.", auth: "session",
+		params: []docParam{channelIDParam}, body: apiMessageCreate{},
+		responses: []docResponse{jsonResponse(http.StatusCreated, "Posted.", APIMessage{})}},
+	"GET /api/v1/channels/:channel_id/read": {summary: "Read state of a channel.", auth: "session",
+		params:    []docParam{channelIDParam},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Read state.", APIReadState{})}},
+	"PUT /api/v1/channels/:channel_id/read": {summary: "Mark every message of a channel read.", auth: "session",
+		params:    []docParam{channelIDParam},
+		responses: []docResponse{jsonResponse(http.StatusOK, "Read state.", APIReadState{})}},
+	"GET /api/v1/read": {summary: "Read state of every channel.", auth: "session",
+		responses: []docResponse{jsonResponse(http.StatusOK, "Read states.", struct {
+			Items []APIReadState `json:"items"`
+		}{})}},
+}
+
+func auditFilterParams() []docParam {
+	return []docParam{
+		queryParam("action", "string", "Action."),
+		queryParam("actor", "string", "Actor name."),
+		queryParam("target", "string", "Target name."),
+		queryParam("ip", "string", "Client IP."),
+		queryParam("since", "string", "From this date (2006-01-02) or RFC 3339 time."),
+		queryParam("until", "string", "Before this date (2006-01-02) or RFC 3339 time."),
+	}
+}
+
+// schemaBuilder derives JSON schemas from Go types, collecting named
+// structs under components/schemas. err records the first type it could
+// not describe.
+type schemaBuilder struct {
+	schemas map[string]interface{}
+	err     error
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (b *schemaBuilder) schema(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case listOf:
+		return map[string]interface{}{"allOf": []interface{}{
+			b.schemaOf(reflect.TypeOf(APIList{})),
+			map[string]interface{}{"properties": map[string]interface{}{
+				"items": map[string]interface{}{"type": "array", "items": b.schema(v.item)},
+			}},
+		}}
+	case arrayOf:
+		return map[string]interface{}{"type": "array", "items": b.schema(v.item)}
+	}
+	return b.schemaOf(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schemaOf(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		s := b.schemaOf(t.Elem())
+		if _, ok := s["$ref"]; !ok {
+			s["nullable"] = true
+		}
+		return s
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": b.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaOf(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		name := strings.TrimPrefix(t.Name(), "api")
+		name = strings.ToUpper(name[:1]) + name[1:]
+		if _, ok := b.schemas[name]; !ok {
+			b.schemas[name] = nil // recursion guard
+			b.schemas[name] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	if b.err == nil {
+		b.err = fmt.Errorf("openapi: unsupported type %s", t)
+	}
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var required []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			if f.Anonymous && parts[0] == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			name := parts[0]
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = b.schemaOf(f.Type)
+			omit := len(parts) > 1 && parts[1] == "omitempty"
+			if !omit && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+var echoParam = regexp.MustCompile(`:([a-z_]+)`)
+
+func paramSchema(typ string) map[string]interface{} {
+	switch typ {
+	case "integer":
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case "file":
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	}
+	return map[string]interface{}{"type": typ}
+}
+
+// routeTag groups operations in the document.
+func routeTag(path string) string {
+	switch {
+	case strings.HasPrefix(path, apiPrefix+"/"):
+		return "api"
+	case strings.HasPrefix(path, "/admin"):
+		return "admin"
+	case strings.HasPrefix(path, "/hooks/"):
+		return "webhooks"
+	case path == "/healthz" || path == "/readyz" || path == "/metrics" || path == "/initialize" || path == "/openapi.json":
+		return "operations"
+	}
+	return "pages"
+}
+
+// buildOpenAPI describes routes, failing if routes and routeDocs differ.
+func buildOpenAPI(routes []*echo.Route) (map[string]interface{}, error) {
+	b := &schemaBuilder{schemas: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+	seen := map[string]bool{}
+	var undocumented []string
+	for _, r := range routes {
+		path := r.Path
+		if strings.HasSuffix(path, "*") {
+			continue // group catch-alls answering 404
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		key := r.Method + " " + path
+		doc, ok := routeDocs[key]
+		if !ok {
+			undocumented = append(undocumented, key)
+			continue
+		}
+		seen[key] = true
+		oapiPath := echoParam.ReplaceAllString(path, "{$1}")
+		if paths[oapiPath] == nil {
+			paths[oapiPath] = map[string]interface{}{}
+		}
+		op := b.operation(r, path, doc)
+		paths[oapiPath][strings.ToLower(r.Method)] = op
+	}
+	var stale []string
+	for key := range routeDocs {
+		if !seen[key] {
+			stale = append(stale, key)
+		}
+	}
+	if len(undocumented) > 0 || len(stale) > 0 {
+		sort.Strings(undocumented)
+		sort.Strings(stale)
+		var msgs []string
+		if len(undocumented) > 0 {
+			msgs = append(msgs, "routes missing from routeDocs: "+strings.Join(undocumented, ", "))
+		}
+		if len(stale) > 0 {
+			msgs = append(msgs, "routeDocs entries without a route: "+strings.Join(stale, ", "))
+		}
+		return nil, fmt.Errorf("openapi: %s", strings.Join(msgs, "; "))
+	}
+	// Bodies POSTed to outgoing webhooks, which no route returns.
+	b.schema(WebhookPayload{})
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "isubata",
+			"version": strings.TrimPrefix(apiPrefix, "/api/"),
+			"description": "Chat server. Routes under " + apiPrefix + " are the JSON API; the others " +
+				"serve the HTML pages and their form posts, operations and peer-to-peer traffic.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session"},
+				"peer": map[string]interface{}{"type": "apiKey", "in": "header", "name": peerSignatureHeader,
+					"description": "HMAC signature by another app host, with " + peerTimestampHeader +
+						" and " + peerNonceHeader + "."},
+			},
+		},
+	}, nil
+}
+
+func (b *schemaBuilder) operation(r *echo.Route, path string, doc routeDoc) map[string]interface{} {
+	name := r.Name
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	op := map[string]interface{}{
+		"operationId": name,
+		"summary":     doc.summary,
+		"tags":        []string{routeTag(path)},
+	}
+	switch doc.auth {
+	case "session":
+		op["security"] = []interface{}{map[string]interface{}{"session": []string{}}}
+	case "admin":
+		op["security"] = []interface{}{map[string]interface{}{"session": []string{}}}
+		op["description"] = "Admins only."
+	case "peer":
+		op["security"] = []interface{}{map[string]interface{}{"peer": []string{}}}
+	}
+
+	var params []interface{}
+	for _, p := range doc.params {
+		params = append(params, map[string]interface{}{
+			"name":        p.name,
+			"in":          p.in,
+			"description": p.desc,
+			"required":    p.required,
+			"schema":      paramSchema(p.typ),
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	content := map[string]interface{}{}
+	if doc.body != nil {
+		content[echo.MIMEApplicationJSON] = map[string]interface{}{"schema": b.schema(doc.body)}
+	}
+	if len(doc.form) > 0 {
+		props := map[string]interface{}{}
+		var required []string
+		for _, f := range doc.form {
+			s := paramSchema(f.typ)
+			s["description"] = f.desc
+			props[f.name] = s
+			if f.required {
+				required = append(required, f.name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		ct := echo.MIMEApplicationForm
+		if doc.multipart {
+			ct = echo.MIMEMultipartForm
+		}
+		content[ct] = map[string]interface{}{"schema": s}
+	}
+	if len(content) > 0 {
+		op["requestBody"] = map[string]interface{}{"required": doc.body != nil, "content": content}
+	}
+
+	responses := map[string]interface{}{}
+	for _, resp := range doc.responses {
+		r := map[string]interface{}{"description": resp.desc}
+		if resp.contentType != "" {
+			media := map[string]interface{}{}
+			if resp.body != nil {
+				media["schema"] = b.schema(resp.body)
+			}
+			r["content"] = map[string]interface{}{resp.contentType: media}
+		}
+		if resp.status == http.StatusSeeOther {
+			r["headers"] = map[string]interface{}{
+				"Location": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+			}
+		}
+		responses[strconv.Itoa(resp.status)] = r
+	}
+	errBody := interface{}(PageError{})
+	if routeTag(path) == "api" {
+		errBody = APIErrorBody{}
+	}
+	responses["default"] = map[string]interface{}{
+		"description": "Error.",
+		"content": map[string]interface{}{
+			echo.MIMEApplicationJSON: map[string]interface{}{"schema": b.schema(errBody)},
+		},
+	}
+	op["responses"] = responses
+	return op
+}
+
+var openAPIDoc []byte
+
+// initOpenAPI builds the document served at /openapi.json.
+func initOpenAPI(e *echo.Echo) error {
+	doc, err := buildOpenAPI(e.Routes())
+	if err != nil {
+		return err
+	}
+	openAPIDoc, err = json.MarshalIndent(doc, "", "  ")
+	return err
+}
+
+func getOpenAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, openAPIDoc)
+}
+
+// cmdOpenAPI implements `isubata openapi`, which prints the document.
+func cmdOpenAPI(args []string) error {
+	e := echo.New()
+	registerRoutes(e)
+	if err := initOpenAPI(e); err != nil {
+		return err
+	}
+	_, err := os.Stdout.Write(append(openAPIDoc, '\n'))
+	return err
+}
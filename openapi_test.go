@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestRouteDocsMatchRoutes(t *testing.T) {
+	e := echo.New()
+	registerRoutes(e)
+	doc, err := buildOpenAPI(e.Routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := doc["paths"].(map[string]map[string]interface{})
+	if _, ok := paths["/channel/{channel_id}"]["get"]; !ok {
+		t.Errorf("GET /channel/{channel_id} missing from paths")
+	}
+}
+
+func TestUndocumentedRoute(t *testing.T) {
+	e := echo.New()
+	registerRoutes(e)
+	e.GET("/undocumented", getIndex)
+	_, err := buildOpenAPI(e.Routes())
+	if err == nil || !strings.Contains(err.Error(), "GET /undocumented") {
+		t.Fatalf("got %v, want an error naming GET /undocumented", err)
+	}
+}
+
+func TestUnsupportedSchemaType(t *testing.T) {
+	b := &schemaBuilder{schemas: map[string]interface{}{}}
+	b.schema(struct {
+		C chan int `json:"c"`
+	}{})
+	if b.err == nil {
+		t.Fatal("no error for a chan field")
+	}
+}
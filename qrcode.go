@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Minimal QR code encoder (byte mode, error correction level M,
+// versions 1-10) used to render TOTP enrollment URIs.
+
+type qrVersion struct {
+	ecPerBlock int
+	groups     [][2]int // {number of blocks, data codewords per block}
+	align      []int
+}
+
+var qrVersionsM = []qrVersion{
+	{10, [][2]int{{1, 16}}, nil},
+	{16, [][2]int{{1, 28}}, []int{6, 18}},
+	{26, [][2]int{{1, 44}}, []int{6, 22}},
+	{18, [][2]int{{2, 32}}, []int{6, 26}},
+	{24, [][2]int{{2, 43}}, []int{6, 30}},
+	{16, [][2]int{{4, 27}}, []int{6, 34}},
+	{18, [][2]int{{4, 31}}, []int{6, 22, 38}},
+	{22, [][2]int{{2, 38}, {2, 39}}, []int{6, 24, 42}},
+	{22, [][2]int{{3, 36}, {2, 37}}, []int{6, 26, 46}},
+	{26, [][2]int{{4, 43}, {1, 44}}, []int{6, 28, 50}},
+}
+
+var errQRTooLong = errors.New("qrcode: data too long")
+
+type qrCode struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+func (v qrVersion) dataCodewords() int {
+	n := 0
+	for _, g := range v.groups {
+		n += g[0] * g[1]
+	}
+	return n
+}
+
+func qrEncode(data []byte) (*qrCode, error) {
+	ver := 0
+	for i, v := range qrVersionsM {
+		ccBits := 8
+		if i+1 >= 10 {
+			ccBits = 16
+		}
+		if 4+ccBits+8*len(data) <= 8*v.dataCodewords() {
+			ver = i + 1
+			break
+		}
+	}
+	if ver == 0 {
+		return nil, errQRTooLong
+	}
+	v := qrVersionsM[ver-1]
+
+	// Bit stream: mode indicator, character count, data, terminator, padding.
+	var bits []bool
+	appendBits := func(val, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (val>>uint(i))&1 != 0)
+		}
+	}
+	appendBits(0x4, 4)
+	if ver >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	capacity := 8 * v.dataCodewords()
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			codewords[i>>3] |= 1 << uint(7-i&7)
+		}
+	}
+
+	// Split into blocks, compute error correction and interleave.
+	var blocks, ecBlocks [][]byte
+	divisor := rsDivisor(v.ecPerBlock)
+	k := 0
+	for _, g := range v.groups {
+		for i := 0; i < g[0]; i++ {
+			blk := codewords[k : k+g[1]]
+			k += g[1]
+			blocks = append(blocks, blk)
+			ecBlocks = append(ecBlocks, rsRemainder(blk, divisor))
+		}
+	}
+	var final []byte
+	for i := 0; ; i++ {
+		added := false
+		for _, blk := range blocks {
+			if i < len(blk) {
+				final = append(final, blk[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, blk := range ecBlocks {
+			final = append(final, blk[i])
+		}
+	}
+
+	size := ver*4 + 17
+	q := &qrCode{size: size}
+	q.modules = make([][]bool, size)
+	q.isFunction = make([][]bool, size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.isFunction[i] = make([]bool, size)
+	}
+	q.drawFunctionPatterns(ver, v.align)
+	q.drawCodewords(final)
+
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		p := q.penalty()
+		if bestPenalty < 0 || p < bestPenalty {
+			bestMask, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(bestMask)
+	q.drawFormatBits(bestMask)
+	return q, nil
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(ver int, align []int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	n := len(align)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(align[i]+dx, align[j]+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve format areas; the real bits are written after masking.
+	q.drawFormatBits(0)
+
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 != 0
+			a := q.size - 11 + i%3
+			b := i / 3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+func (q *qrCode) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= q.size || y < 0 || y >= q.size {
+				continue
+			}
+			dist := maxInt(absInt(dx), absInt(dy))
+			q.set(x, y, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (q *qrCode) drawFormatBits(mask int) {
+	// Error correction level M is encoded as 0b00.
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>uint(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.isFunction[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+func (q *qrCode) penalty() int {
+	p := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += run - 2
+				}
+				run = 1
+			}
+			for x := 0; x+7 <= q.size; x++ {
+				match := true
+				for k, d := range finderLike {
+					if at(x+k, y, transpose) != d {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				lightBefore, lightAfter := x >= 4, x+11 <= q.size
+				for k := 1; k <= 4; k++ {
+					if lightBefore && at(x-k, y, transpose) {
+						lightBefore = false
+					}
+					if lightAfter && at(x+6+k, y, transpose) {
+						lightAfter = false
+					}
+				}
+				if lightBefore || lightAfter {
+					p += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	p += absInt(dark*20-total*10) / total * 10
+	return p
+}
+
+// PNG renders the code with the standard four-module quiet zone.
+func (q *qrCode) PNG(scale int) ([]byte, error) {
+	const quiet = 4
+	dim := (q.size + quiet*2) * scale
+	img := image.NewGray(image.Rect(0, 0, dim, dim))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+quiet)*scale+dx, (y+quiet)*scale+dy, color.Gray{Y: 0})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func rsMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = rsMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = rsMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= rsMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
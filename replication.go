@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Icons uploaded to a host with a non-shared store are copied to every
+// peer through the icon_replication table. Each host delivers the jobs it
+// enqueued itself, since only it is guaranteed to have the file.
+
+const (
+	replicationPollInterval   = time.Second
+	replicationRepairInterval = 10 * time.Minute
+	replicationBatch          = 50
+	replicationWorkers        = 4
+	replicationMaxAttempts    = 10
+	replicationMaxBackoff     = 10 * time.Minute
+	replicationDoneRetention  = 24 * time.Hour
+
+	// peerHeader marks requests between app hosts so that getIcon does not
+	// in turn ask its own peers.
+	peerHeader = "X-Isubata-Peer"
+)
+
+var (
+	replicationClient = &http.Client{Timeout: 10 * time.Second}
+
+	iconVariantPattern = regexp.MustCompile(`_\d+\.[a-z]+$`)
+	iconHashPattern    = regexp.MustCompile(`^([0-9a-f]{40})\.[a-z]+$`)
+)
+
+type ReplicationJob struct {
+	ID            int64     `db:"id"`
+	IconName      string    `db:"icon_name"`
+	Source        string    `db:"source"`
+	Host          string    `db:"host"`
+	Status        string    `db:"status"`
+	Attempts      int       `db:"attempts"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	LastError     string    `db:"last_error"`
+	RequestID     string    `db:"request_id"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+type ReplicationHostStatus struct {
+	Host      string `db:"host"`
+	Pending   int    `db:"pending"`
+	Failed    int    `db:"failed"`
+	Done      int    `db:"done"`
+	LastError string `db:"last_error"`
+}
+
+// peers returns the other app hosts.
+func peers() []string {
+	var res []string
+	for _, h := range hosts {
+		if h != "" && h != me {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// enqueueReplicationTo schedules name to be pushed to host. A job that
+// already exists is reset to pending. requestID, if any, is sent along
+// with the push so that both hosts' logs can be correlated.
+func enqueueReplicationTo(name, host, requestID string) error {
+	_, err := db.Exec(
+		"INSERT INTO icon_replication (icon_name, source, host, status, attempts, next_attempt_at, last_error, request_id, created_at, updated_at)"+
+			" VALUES (?, ?, ?, 'pending', 0, NOW(), '', ?, NOW(), NOW())"+
+			" ON DUPLICATE KEY UPDATE status = 'pending', attempts = 0, next_attempt_at = NOW(), request_id = VALUES(request_id), updated_at = NOW()",
+		name, me, host, requestID)
+	return err
+}
+
+// requeueReplicationTo is enqueueReplicationTo for repairs. Only a job
+// that was done is reset: a pending one keeps its attempts so that it can
+// still fail, and a failed one stays failed until the icon is uploaded
+// again.
+func requeueReplicationTo(name, host string) error {
+	// MySQL assigns left to right, so status has to be updated last.
+	_, err := db.Exec(
+		"INSERT INTO icon_replication (icon_name, source, host, status, attempts, next_attempt_at, last_error, request_id, created_at, updated_at)"+
+			" VALUES (?, ?, ?, 'pending', 0, NOW(), '', '', NOW(), NOW())"+
+			" ON DUPLICATE KEY UPDATE attempts = IF(status = 'done', 0, attempts),"+
+			" next_attempt_at = IF(status = 'done', NOW(), next_attempt_at),"+
+			" updated_at = IF(status = 'done', NOW(), updated_at),"+
+			" status = IF(status = 'done', 'pending', status)",
+		name, me, host)
+	return err
+}
+
+// enqueueReplication schedules name to be pushed to every peer.
+func enqueueReplication(name, requestID string) error {
+	for _, host := range peers() {
+		if err := enqueueReplicationTo(name, host, requestID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushIcon uploads an icon to a peer's POST /icons/:file_name.
+func pushIcon(host, name string, data []byte, requestID string) error {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("avatar_icon", name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+host+"/icons/"+name, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(peerHeader, me)
+	req.Header.Set(requestIDHeader, requestID)
+	signPeerRequest(req, body.Bytes())
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func replicationBackoff(attempts int) time.Duration {
+	d := time.Second << uint(attempts)
+	if d <= 0 || d > replicationMaxBackoff {
+		return replicationMaxBackoff
+	}
+	return d
+}
+
+func deliverReplication(job ReplicationJob) {
+	// Jobs enqueued by repairReplication have no originating request.
+	if job.RequestID == "" {
+		job.RequestID = newRequestID()
+	}
+	fields := Fields{"request_id": job.RequestID, "icon": job.IconName, "host": job.Host}
+	data, err := iconStore.Get(job.IconName)
+	if err == nil {
+		err = pushIcon(job.Host, job.IconName, data, job.RequestID)
+	}
+	if err == nil {
+		_, err = db.Exec("UPDATE icon_replication SET status = 'done', attempts = attempts + 1, last_error = '', updated_at = NOW() WHERE id = ?",
+			job.ID)
+		if err != nil {
+			logEntry(levelError, fields, "Failed to deliverReplication1:", err)
+		}
+		return
+	}
+
+	logEntry(levelError, fields, "Failed to replicate:", err)
+	status := "pending"
+	if job.Attempts+1 >= replicationMaxAttempts || err == errIconNotFound {
+		status = "failed"
+	}
+	next := time.Now().Add(replicationBackoff(job.Attempts))
+	_, err = db.Exec("UPDATE icon_replication SET status = ?, attempts = attempts + 1, next_attempt_at = ?, last_error = ?, updated_at = NOW() WHERE id = ?",
+		status, next, truncateRunes(err.Error(), 255), job.ID)
+	if err != nil {
+		logEntry(levelError, fields, "Failed to deliverReplication2:", err)
+	}
+}
+
+// runReplicationOnce delivers the jobs that are due, several at a time.
+func runReplicationOnce() error {
+	var jobs []ReplicationJob
+	err := db.Select(&jobs,
+		"SELECT * FROM icon_replication WHERE source = ? AND status = 'pending' AND next_attempt_at <= NOW() ORDER BY next_attempt_at LIMIT ?",
+		me, replicationBatch)
+	if err != nil {
+		return err
+	}
+	sem := make(chan struct{}, replicationWorkers)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job ReplicationJob) {
+			defer wg.Done()
+			deliverReplication(job)
+			<-sem
+		}(job)
+	}
+	wg.Wait()
+	return nil
+}
+
+// listPeerIcons asks a peer for the original icons it has.
+func listPeerIcons(host string) (map[string]bool, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/internal/icons", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerHeader, me)
+	signPeerRequest(req, nil)
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list icons on %s: %s", host, resp.Status)
+	}
+	var names []string
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return set, nil
+}
+
+func listOriginalIcons() ([]string, error) {
+	names, err := iconStore.List()
+	if err != nil {
+		return nil, err
+	}
+	res := names[:0]
+	for _, n := range names {
+		if !iconVariantPattern.MatchString(n) {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+// repairReplication compares this host's icons with every peer and
+// enqueues whatever a peer is missing and would accept; icons stored
+// before avatars were normalized are refused by postIcon. It returns the
+// number of jobs enqueued.
+func repairReplication() (int, error) {
+	if iconStore.Shared() {
+		return 0, nil
+	}
+	local, err := listOriginalIcons()
+	if err != nil {
+		return 0, err
+	}
+	enqueued := 0
+	pushable := map[string]bool{}
+	for _, host := range peers() {
+		remote, err := listPeerIcons(host)
+		if err != nil {
+			log.Println("Failed to repairReplication:", err)
+			continue
+		}
+		for _, name := range local {
+			if remote[name] {
+				continue
+			}
+			ok, checked := pushable[name]
+			if !checked {
+				data, err := iconStore.Get(name)
+				if err == errIconNotFound {
+					continue
+				} else if err != nil {
+					return enqueued, err
+				}
+				ok = isNormalizedAvatar(bytes.NewReader(data))
+				pushable[name] = ok
+			}
+			if !ok {
+				continue
+			}
+			if err := requeueReplicationTo(name, host); err != nil {
+				return enqueued, err
+			}
+			enqueued++
+		}
+	}
+	_, err = db.Exec("DELETE FROM icon_replication WHERE source = ? AND status = 'done' AND updated_at < ?",
+		me, time.Now().Add(-replicationDoneRetention))
+	return enqueued, err
+}
+
+// startReplicationWorker delivers queued icons and periodically repairs
+// divergence between hosts.
+func startReplicationWorker() {
+	if iconStore.Shared() {
+		return
+	}
+	runPeriodically(replicationPollInterval, func() {
+		if err := runReplicationOnce(); err != nil {
+			log.Println("Failed to runReplicationOnce:", err)
+		}
+	})
+	runPeriodically(replicationRepairInterval, func() {
+		if n, err := repairReplication(); err != nil {
+			log.Println("Failed to repairReplication:", err)
+		} else if n > 0 {
+			log.Println("repairReplication enqueued", n, "icons")
+		}
+	})
+}
+
+// fetchIconFromPeers pulls an icon this host is missing from the first
+// peer that has it, and keeps a local copy.
+func fetchIconFromPeers(txn *Transaction, name string) ([]byte, error) {
+	for _, host := range peers() {
+		req, err := http.NewRequest(http.MethodGet, "http://"+host+"/icons/"+name, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(peerHeader, me)
+		if id := txn.RequestID(); id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		resp, err := replicationClient.Do(req)
+		if err != nil {
+			txn.Error("Failed to fetchIconFromPeers:", err)
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, avatarMaxBytes+1))
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || len(data) > avatarMaxBytes {
+			continue
+		}
+		if m := iconHashPattern.FindStringSubmatch(name); m != nil && fmt.Sprintf("%x", sha1.Sum(data)) != m[1] {
+			txn.Error("Failed to fetchIconFromPeers: hash mismatch from", host, name)
+			continue
+		}
+		if err := storeIcon(name, data); err != nil {
+			txn.Error("Failed to fetchIconFromPeers:", err)
+		}
+		return data, nil
+	}
+	return nil, errIconNotFound
+}
+
+// request handlers
+
+func getInternalIcons(c echo.Context) error {
+	names, err := listOriginalIcons()
+	if err != nil {
+		log.Println("Failed to getInternalIcons:", err)
+		return err
+	}
+	return c.JSON(http.StatusOK, names)
+}
+
+func getAdminReplication(c echo.Context) error {
+	txn := app.StartTransaction("getAdminReplication", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	statuses := []ReplicationHostStatus{}
+	s := StartMySQLSegment(txn, "icon_replication", "SELECT")
+	err = db.Select(&statuses,
+		"SELECT host,"+
+			" SUM(status = 'pending') AS pending, SUM(status = 'failed') AS failed, SUM(status = 'done') AS done,"+
+			" COALESCE(SUBSTRING_INDEX(GROUP_CONCAT(NULLIF(last_error, '') ORDER BY updated_at DESC SEPARATOR '\\n'), '\\n', 1), '') AS last_error"+
+			" FROM icon_replication WHERE source = ? GROUP BY host ORDER BY host", me)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to getAdminReplication1:", err)
+		return err
+	}
+
+	failures := []ReplicationJob{}
+	s2 := StartMySQLSegment(txn, "icon_replication", "SELECT")
+	err = db.Select(&failures,
+		"SELECT * FROM icon_replication WHERE source = ? AND status <> 'done' AND attempts > 0 ORDER BY updated_at DESC LIMIT 50", me)
+	s2.End()
+	if err != nil {
+		txn.Error("Failed to getAdminReplication2:", err)
+		return err
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		txn.Error("Failed to getAdminReplication3:", err)
+		return err
+	}
+
+	return c.Render(http.StatusOK, "admin_replication", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  channels,
+		"User":      self,
+		"Me":        me,
+		"Peers":     strings.Join(peers(), ", "),
+		"Shared":    iconStore.Shared(),
+		"Statuses":  statuses,
+		"Failures":  failures,
+		"Repaired":  c.QueryParam("repaired"),
+	})
+}
+
+func postAdminReplicationRepair(c echo.Context) error {
+	txn := app.StartTransaction("postAdminReplicationRepair", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+	n, err := repairReplication()
+	if err != nil {
+		txn.Error("Failed to postAdminReplicationRepair:", err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/admin/replication?repaired=%d", n))
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Channel-scoped keys (messages:<ch> and haveread:<user>:<ch>) are spread
+// over the nodes in redis.nodes by consistent hashing of the channel ID,
+// so adding a node moves only about 1/n of the channels. Everything else
+// (locks, nonces, 2FA counters) lives on the first node, rd.
+// `isubata reshard` moves the keys of channels that changed nodes.
+
+// ringReplicas is the number of points each node has on the ring.
+const ringReplicas = 160
+
+type redisNode struct {
+	*redis.Client
+	addr    string
+	breaker *circuitBreaker
+}
+
+type ringPoint struct {
+	hash uint32
+	node int
+}
+
+type redisRing struct {
+	nodes  []*redisNode
+	points []ringPoint
+}
+
+var shards *redisRing
+
+// newRedisClient connects to one node.
+func newRedisClient(addr string) *redis.Client {
+	c := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: config.Redis.Password,
+		DB:       0,
+		// Fail fast so that an outage trips the circuit breaker
+		// instead of stalling requests.
+		DialTimeout:  time.Second,
+		ReadTimeout:  500 * time.Millisecond,
+		WriteTimeout: 500 * time.Millisecond,
+		PoolTimeout:  time.Second,
+	})
+	instrumentRedis(c)
+	return c
+}
+
+// newRedisRing places the nodes on the ring. connect is called once per
+// address.
+func newRedisRing(addrs []string, connect func(addr string) *redis.Client) *redisRing {
+	r := &redisRing{}
+	for i, addr := range addrs {
+		r.nodes = append(r.nodes, &redisNode{
+			Client:  connect(addr),
+			addr:    addr,
+			breaker: &circuitBreaker{name: addr},
+		})
+		for j := 0; j < ringReplicas; j++ {
+			r.points = append(r.points, ringPoint{ringHash(fmt.Sprintf("%s#%d", addr, j)), i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// ringHash is FNV-1a followed by the murmur3 finalizer; FNV alone spreads
+// short, similar keys like channel IDs unevenly over the ring.
+func ringHash(s string) uint32 {
+	h := uint32(hash(s))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// node returns the node holding the channel's keys.
+func (r *redisRing) node(channelID int64) *redisNode {
+	if len(r.nodes) == 1 {
+		return r.nodes[0]
+	}
+	h := ringHash(strconv.FormatInt(channelID, 10))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i].node]
+}
+
+// byNode groups channels by the node holding them, keeping their order.
+func (r *redisRing) byNode(channelIDs []int64) map[*redisNode][]int64 {
+	groups := map[*redisNode][]int64{}
+	for _, ch := range channelIDs {
+		n := r.node(ch)
+		groups[n] = append(groups[n], ch)
+	}
+	return groups
+}
+
+func (r *redisRing) close() {
+	for _, n := range r.nodes {
+		n.Close()
+	}
+}
+
+func redisShard(channelID int64) *redisNode {
+	return shards.node(channelID)
+}
+
+// haveReadChannel returns the channel of a haveread:<user>:<ch> key.
+func haveReadChannel(key string) (int64, bool) {
+	i := strings.LastIndexByte(key, ':')
+	if i < 0 {
+		return 0, false
+	}
+	ch, err := strconv.ParseInt(key[i+1:], 10, 64)
+	return ch, err == nil
+}
+
+// scanKeys calls fn with each batch of keys on the node matching pattern.
+func scanKeys(n *redisNode, pattern string, fn func(keys []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := n.Scan(cursor, pattern, cacheBatch).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// copyReadStates copies the read positions of moved channels from their
+// old nodes to their new ones. A position already on the new node is
+// kept if it is further along.
+func copyReadStates(old *redisRing, moved map[int64]bool) (int, error) {
+	copied := 0
+	for _, from := range old.nodes {
+		err := scanKeys(from, "haveread:*", func(keys []string) error {
+			var move []string
+			for _, k := range keys {
+				if ch, ok := haveReadChannel(k); ok && moved[ch] && old.node(ch) == from {
+					move = append(move, k)
+				}
+			}
+			if len(move) == 0 {
+				return nil
+			}
+			src, err := getInt64s(from, move)
+			if err != nil {
+				return err
+			}
+			for to, keys := range groupKeys(move) {
+				dst, err := getInt64s(to, keys)
+				if err != nil {
+					return err
+				}
+				pipe := to.Pipeline()
+				n := 0
+				for _, k := range keys {
+					if v, ok := src[k]; ok && v > dst[k] {
+						pipe.Set(k, v, 0)
+						n++
+					}
+				}
+				if n == 0 {
+					continue
+				}
+				if _, err := pipe.Exec(); err != nil {
+					return err
+				}
+				copied += n
+			}
+			return nil
+		})
+		if err != nil {
+			return copied, fmt.Errorf("%s: %v", from.addr, err)
+		}
+	}
+	return copied, nil
+}
+
+// groupKeys groups haveread keys by the node that now holds them.
+func groupKeys(keys []string) map[*redisNode][]string {
+	groups := map[*redisNode][]string{}
+	for _, k := range keys {
+		ch, _ := haveReadChannel(k)
+		n := redisShard(ch)
+		groups[n] = append(groups[n], k)
+	}
+	return groups
+}
+
+// getInt64s reads integer keys in one round trip, omitting missing ones.
+func getInt64s(n *redisNode, keys []string) (map[string]int64, error) {
+	pipe := n.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, k := range keys {
+		cmds[i] = pipe.Get(k)
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	vals := make(map[string]int64, len(keys))
+	for i, k := range keys {
+		v, err := cmds[i].Int64()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		vals[k] = v
+	}
+	return vals, nil
+}
+
+// deleteMovedKeys removes the keys of moved channels from their old
+// nodes.
+func deleteMovedKeys(old *redisRing, moved map[int64]bool) (int, error) {
+	deleted := 0
+	for _, from := range old.nodes {
+		var del []string
+		for ch := range moved {
+			if old.node(ch) == from {
+				del = append(del, keyMessages(ch))
+			}
+		}
+		err := scanKeys(from, "haveread:*", func(keys []string) error {
+			for _, k := range keys {
+				if ch, ok := haveReadChannel(k); ok && moved[ch] && old.node(ch) == from {
+					del = append(del, k)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("%s: %v", from.addr, err)
+		}
+		for len(del) > 0 {
+			batch := del
+			if len(batch) > cacheBatch {
+				batch = batch[:cacheBatch]
+			}
+			n, err := from.Del(batch...).Result()
+			if err != nil {
+				return deleted, fmt.Errorf("%s: %v", from.addr, err)
+			}
+			deleted += int(n)
+			del = del[len(batch):]
+		}
+	}
+	return deleted, nil
+}
+
+// cmdReshard implements `isubata reshard [-cleanup] <old nodes>`, where
+// the configured redis.nodes is the new node list and <old nodes> the
+// comma-separated list it replaces. To add nodes without downtime:
+//
+//  1. run `isubata reshard <old nodes>` with the new list while the app
+//     still uses the old one, copying the keys of channels that move;
+//  2. roll out the new list to the app hosts;
+//  3. run `isubata reshard -rolled-out <old nodes>` to pick up what was
+//     written to the old nodes during the rollout;
+//  4. run `isubata reshard -cleanup <old nodes>` to delete the moved keys
+//     from their old nodes.
+//
+// Message lists are rebuilt from MySQL, so running it again is harmless.
+// Between steps 2 and 3 a moved channel can miss messages posted through
+// hosts still on the old list, so step 3 is recorded in app_setting and
+// -cleanup refuses to run for a move that step 3 has not covered.
+func cmdReshard(args []string) error {
+	fs := flag.NewFlagSet("reshard", flag.ContinueOnError)
+	cleanup := fs.Bool("cleanup", false, "delete moved keys from their old nodes")
+	rolledOut := fs.Bool("rolled-out", false, "the app hosts use the new node list; allows -cleanup afterwards")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *cleanup && *rolledOut {
+		return errors.New("usage: reshard [-rolled-out | -cleanup] host:port,...")
+	}
+	var oldAddrs []string
+	for _, a := range strings.Split(fs.Arg(0), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			oldAddrs = append(oldAddrs, a)
+		}
+	}
+	if len(oldAddrs) == 0 {
+		return errors.New("no old nodes given")
+	}
+	old := newRedisRing(oldAddrs, func(addr string) *redis.Client {
+		for _, n := range shards.nodes {
+			if n.addr == addr {
+				return n.Client
+			}
+		}
+		return newRedisClient(addr)
+	})
+
+	if err := db.Ping(); err != nil {
+		return err
+	}
+	for _, r := range []*redisRing{old, shards} {
+		for _, n := range r.nodes {
+			if err := n.Ping().Err(); err != nil {
+				return fmt.Errorf("%s: %v", n.addr, err)
+			}
+		}
+	}
+	ids, err := cacheChannels(nil)
+	if err != nil {
+		return err
+	}
+	moved := map[int64]bool{}
+	var movedIDs []int64
+	for _, ch := range ids {
+		if old.node(ch).addr != redisShard(ch).addr {
+			moved[ch] = true
+			movedIDs = append(movedIDs, ch)
+		}
+	}
+	fmt.Printf("%d of %d channels move\n", len(movedIDs), len(ids))
+	if len(movedIDs) == 0 {
+		return nil
+	}
+
+	move := reshardMove(old, shards)
+	if *cleanup {
+		copied, err := getSetting(nil, reshardCopiedSetting)
+		if err != nil {
+			return err
+		}
+		if copied != reshardMoveID(move) {
+			return fmt.Errorf("no copy after the rollout is recorded for %s; roll out the new node list and run reshard -rolled-out first", move)
+		}
+		n, err := deleteMovedKeys(old, moved)
+		fmt.Printf("deleted %d keys from old nodes\n", n)
+		if err != nil {
+			return err
+		}
+		return setSetting(nil, reshardCopiedSetting, "")
+	}
+	if err := rebuildMessageCache(os.Stdout, movedIDs, false); err != nil {
+		return err
+	}
+	n, err := copyReadStates(old, moved)
+	fmt.Printf("copied %d read positions\n", n)
+	if err != nil || !*rolledOut {
+		return err
+	}
+	return setSetting(nil, reshardCopiedSetting, reshardMoveID(move))
+}
+
+// reshardCopiedSetting holds the reshardMoveID of the move whose
+// post-rollout copy is done.
+const reshardCopiedSetting = "reshard_copied"
+
+// reshardMove describes a move from one node list to another.
+func reshardMove(from, to *redisRing) string {
+	addrs := func(r *redisRing) string {
+		var a []string
+		for _, n := range r.nodes {
+			a = append(a, n.addr)
+		}
+		return strings.Join(a, ",")
+	}
+	return addrs(from) + " -> " + addrs(to)
+}
+
+// reshardMoveID keeps a move within app_setting's value column.
+func reshardMoveID(move string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(move)))
+}
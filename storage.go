@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobStore holds icon files by name. Missing blobs are reported as
+// errIconNotFound.
+type BlobStore interface {
+	Get(name string) ([]byte, error)
+	Exists(name string) (bool, error)
+	Put(name string, data []byte) error
+	Delete(name string) error
+	List() ([]string, error)
+	// Shared reports whether every host sees the same store, in which
+	// case uploads need not be pushed to peers.
+	Shared() bool
+}
+
+var (
+	iconStore BlobStore
+	// seedStore holds the icons shipped with the initial data set.
+	seedStore BlobStore
+)
+
+// newBlobStore selects the icon store from c.Storage ("local", "mysql",
+// "s3" or "memory").
+func newBlobStore(c IconConfig) (BlobStore, error) {
+	switch c.Storage {
+	case "local":
+		return &localBlobStore{dir: c.Dir}, nil
+	case "memory":
+		return &memoryBlobStore{blobs: map[string][]byte{}}, nil
+	case "mysql":
+		return &mysqlBlobStore{}, nil
+	case "s3":
+		return &s3BlobStore{
+			endpoint:  strings.TrimSuffix(c.S3.Endpoint, "/"),
+			bucket:    c.S3.Bucket,
+			region:    c.S3.Region,
+			accessKey: c.S3.AccessKey,
+			secretKey: c.S3.SecretKey,
+			client:    &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown icon storage: %q", c.Storage)
+	}
+}
+
+// localBlobStore keeps blobs as files in a directory on this host.
+type localBlobStore struct {
+	dir string
+}
+
+func (s *localBlobStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
+
+func (s *localBlobStore) Get(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, errIconNotFound
+	}
+	return data, err
+}
+
+func (s *localBlobStore) Exists(name string) (bool, error) {
+	_, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localBlobStore) Put(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return s.Adopt(name, tmp.Name())
+}
+
+// Adopt moves the file at tmpPath, which must be in the store directory,
+// into place as name.
+func (s *localBlobStore) Adopt(name, tmpPath string) error {
+	os.Chmod(tmpPath, 0777)
+	return os.Rename(tmpPath, s.path(name))
+}
+
+func (s *localBlobStore) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localBlobStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *localBlobStore) Shared() bool { return false }
+
+// Reset empties the directory.
+func (s *localBlobStore) Reset() error {
+	os.RemoveAll(s.dir)
+	return os.Mkdir(s.dir, 0777)
+}
+
+// memoryBlobStore keeps blobs in process, for the memory stores. There is
+// a single host then, so it counts as shared.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func (s *memoryBlobStore) Get(name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blobs[name]
+	if !ok {
+		return nil, errIconNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryBlobStore) Exists(name string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[name]
+	return ok, nil
+}
+
+func (s *memoryBlobStore) Put(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[name] = data
+	return nil
+}
+
+func (s *memoryBlobStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *memoryBlobStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.blobs))
+	for name := range s.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *memoryBlobStore) Shared() bool { return true }
+
+// mysqlBlobStore keeps blobs in the image table.
+type mysqlBlobStore struct{}
+
+func (s *mysqlBlobStore) Get(name string) ([]byte, error) {
+	var data []byte
+	err := db.QueryRow("SELECT data FROM image WHERE name = ?", name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, errIconNotFound
+	}
+	return data, err
+}
+
+func (s *mysqlBlobStore) Exists(name string) (bool, error) {
+	var n int
+	err := db.Get(&n, "SELECT COUNT(*) FROM image WHERE name = ?", name)
+	return n > 0, err
+}
+
+func (s *mysqlBlobStore) Put(name string, data []byte) error {
+	// Names are unique; a blob that is already stored is left alone.
+	_, err := db.Exec("INSERT IGNORE INTO image (name, data) VALUES (?, ?)", name, data)
+	return err
+}
+
+func (s *mysqlBlobStore) Delete(name string) error {
+	_, err := db.Exec("DELETE FROM image WHERE name = ?", name)
+	return err
+}
+
+func (s *mysqlBlobStore) List() ([]string, error) {
+	names := []string{}
+	err := db.Select(&names, "SELECT name FROM image")
+	return names, err
+}
+
+func (s *mysqlBlobStore) Shared() bool { return true }
+
+// s3BlobStore keeps blobs in an S3-compatible bucket using path-style
+// addressing, so it also works against MinIO and similar local servers.
+type s3BlobStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3BlobStore) Shared() bool { return true }
+
+func (s *s3BlobStore) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := s.endpoint + "/" + s.bucket
+	if key != "" {
+		u += "/" + url.PathEscape(key)
+	}
+	rawQuery := strings.Replace(query.Encode(), "+", "%20", -1)
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (s *s3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(body))
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders bytes.Buffer
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonRequest)))
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+s.secretKey), date)
+	key = mac(key, s.region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+	signature := hex.EncodeToString(mac(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func s3Error(op string, resp *http.Response) error {
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("s3 %s: %s: %s", op, resp.Status, bytes.TrimSpace(msg))
+}
+
+func (s *s3BlobStore) Get(name string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errIconNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("get", resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3BlobStore) Exists(name string) (bool, error) {
+	resp, err := s.do(http.MethodHead, name, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("s3 head: %s", resp.Status)
+}
+
+func (s *s3BlobStore) Put(name string, data []byte) error {
+	resp, err := s.do(http.MethodPut, name, nil, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("delete", resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) List() ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error("list", resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			names = append(names, c.Key)
+		}
+		if !result.IsTruncated {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// resetIconStore restores iconStore to the initial data set from the
+// image table. With the MySQL store the table already is that data set.
+func resetIconStore() error {
+	if iconStore == seedStore {
+		return nil
+	}
+	if l, ok := iconStore.(*localBlobStore); ok {
+		if err := l.Reset(); err != nil {
+			return err
+		}
+	} else {
+		names, err := iconStore.List()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := iconStore.Delete(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	rows, err := db.Query("SELECT name, data FROM image")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var data []byte
+		if err := rows.Scan(&name, &data); err != nil {
+			return err
+		}
+		if err := iconStore.Put(name, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
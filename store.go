@@ -0,0 +1,698 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// Handlers reach users, channels, messages, read positions, settings,
+// 2FA secrets and the audit log through these stores. The production stores keep rows in
+// MySQL and the message lists and read positions in Redis; memory stores
+// keep everything in process (see store_memory.go).
+//
+// With the memory stores the app needs neither MySQL nor Redis, but only
+// chatting and 2FA work: the admin area, webhooks and icon replication
+// keep their own tables and answer 503 (requireMySQLStore).
+
+var (
+	errDuplicateName = errors.New("store: name already taken")
+	errTOTPEnabled   = errors.New("store: 2fa already enabled")
+)
+
+type UserStore interface {
+	// Get returns nil without an error when the user does not exist.
+	Get(txn *Transaction, userID int64) (*User, error)
+	GetByName(txn *Transaction, name string) (*User, error)
+	// Create returns errDuplicateName if the name is taken.
+	Create(txn *Transaction, name, salt, password, displayName, avatarIcon string) (int64, error)
+	SetDisplayName(txn *Transaction, userID int64, displayName string) error
+	SetAvatarIcon(txn *Transaction, userID int64, avatarIcon string) error
+	// Status returns the account status, a zero one if none is recorded.
+	Status(txn *Transaction, userID int64) (*UserStatus, error)
+}
+
+type ChannelStore interface {
+	// List returns every channel ordered by ID.
+	List(txn *Transaction) ([]ChannelInfo, error)
+	IDs(txn *Transaction) ([]int64, error)
+	// Create makes a channel owned by ownerID, or by nobody if it is 0.
+	Create(txn *Transaction, name, description string, ownerID int64) (int64, error)
+	// Delete removes the channel together with its messages.
+	Delete(txn *Transaction, channelID int64) error
+}
+
+// UserMessage is a message with the public fields of its author.
+type UserMessage struct {
+	Message
+	User User
+}
+
+type MessageStore interface {
+	Add(txn *Transaction, channelID, userID int64, content string) (int64, error)
+	// Get returns nil without an error when the message does not exist.
+	Get(txn *Transaction, messageID int64) (*Message, error)
+	Delete(txn *Transaction, m *Message) error
+	// Count returns the number of messages in the channel.
+	Count(txn *Transaction, channelID int64) (int64, error)
+	// Counts returns the number of messages in each channel.
+	Counts(txn *Transaction, channelIDs []int64) (map[int64]int64, error)
+	// Page returns up to limit messages, newest first, skipping the
+	// newest offset.
+	Page(txn *Transaction, channelID, offset, limit int64) ([]Message, error)
+	// Since returns up to limit messages newer than lastID, newest first.
+	Since(txn *Transaction, channelID, lastID int64, limit int) ([]UserMessage, error)
+}
+
+// ReadStateStore remembers, per user and channel, the message count the
+// user had seen.
+type ReadStateStore interface {
+	Get(txn *Transaction, userID, channelID int64) (int64, error)
+	// GetAll returns the user's read position in each channel.
+	GetAll(txn *Transaction, userID int64, channelIDs []int64) (map[int64]int64, error)
+	Set(txn *Transaction, userID, channelID, read int64) error
+}
+
+// SettingStore holds the settings admins change at runtime.
+type SettingStore interface {
+	// Get returns "" when the setting was never set.
+	Get(txn *Transaction, name string) (string, error)
+	Set(txn *Transaction, name, value string) error
+}
+
+// TOTPStore keeps 2FA secrets and the hashes of recovery codes.
+type TOTPStore interface {
+	// Get returns nil without an error when the user has no 2FA.
+	Get(txn *Transaction, userID int64) (*UserTOTP, error)
+	// Enable stores the secret, with step as its last used step, and the
+	// recovery codes. It returns errTOTPEnabled if the user has 2FA.
+	Enable(txn *Transaction, userID int64, secret string, step int64, codeHashes []string) error
+	// ResetRecoveryCodes replaces the user's recovery codes.
+	ResetRecoveryCodes(txn *Transaction, userID int64, codeHashes []string) error
+	// UseStep records step as used and reports whether it was later than
+	// the last used one.
+	UseStep(txn *Transaction, userID, step int64) (bool, error)
+	// UseRecoveryCode marks an unused recovery code as used and reports
+	// whether one matched.
+	UseRecoveryCode(txn *Transaction, userID int64, codeHash string) (bool, error)
+	// Disable removes the secret and the recovery codes.
+	Disable(txn *Transaction, userID int64) error
+}
+
+// AuditStore records audit entries. The admin pages read them back from
+// MySQL.
+type AuditStore interface {
+	Add(txn *Transaction, e *AuditEntry) error
+}
+
+var (
+	userStore      UserStore
+	channelStore   ChannelStore
+	messageStore   MessageStore
+	readStateStore ReadStateStore
+	settingStore   SettingStore
+	totpStore      TOTPStore
+	auditStore     AuditStore
+
+	// memoryStores is set when the memory stores are in use.
+	memoryStores bool
+)
+
+// initStores selects the stores: "mysql" or "memory".
+func initStores(kind string) error {
+	switch kind {
+	case "mysql":
+		userStore = &mysqlUserStore{}
+		channelStore = &mysqlChannelStore{}
+		messageStore = &mysqlMessageStore{}
+		readStateStore = &redisReadStateStore{}
+		settingStore = &mysqlSettingStore{}
+		totpStore = &mysqlTOTPStore{}
+		auditStore = &mysqlAuditStore{}
+		memoryStores = false
+	case "memory":
+		m := newMemoryStore()
+		userStore = (*memoryUserStore)(m)
+		channelStore = (*memoryChannelStore)(m)
+		messageStore = (*memoryMessageStore)(m)
+		readStateStore = (*memoryReadStateStore)(m)
+		settingStore = (*memorySettingStore)(m)
+		totpStore = (*memoryTOTPStore)(m)
+		auditStore = (*memoryAuditStore)(m)
+		memoryStores = true
+		// Handlers assume a channel to land on after login.
+		channelStore.Create(nil, "general", "memory store", 0)
+	default:
+		return fmt.Errorf("unknown ISUBATA_STORE: %q", kind)
+	}
+	return nil
+}
+
+// requireMySQLStore answers 503 for routes whose features keep their
+// state in MySQL directly when the memory stores are in use.
+func requireMySQLStore(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if memoryStores {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, "not available with the memory store")
+		}
+		return next(c)
+	}
+}
+
+// MySQL and Redis
+
+type mysqlUserStore struct{}
+
+func (s *mysqlUserStore) get(txn *Transaction, query string, arg interface{}) (*User, error) {
+	u := User{}
+	seg := StartMySQLSegment(txn, "user", "SELECT")
+	err := db.Get(&u, query, arg)
+	seg.End()
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *mysqlUserStore) Get(txn *Transaction, userID int64) (*User, error) {
+	return s.get(txn, "SELECT * FROM user WHERE id = ?", userID)
+}
+
+func (s *mysqlUserStore) GetByName(txn *Transaction, name string) (*User, error) {
+	return s.get(txn, "SELECT * FROM user WHERE name = ?", name)
+}
+
+func (s *mysqlUserStore) Create(txn *Transaction, name, salt, password, displayName, avatarIcon string) (int64, error) {
+	seg := StartMySQLSegment(txn, "user", "INSERT")
+	res, err := db.Exec(
+		"INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
+			" VALUES (?, ?, ?, ?, ?, NOW())",
+		name, salt, password, displayName, avatarIcon)
+	seg.End()
+	if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // Duplicate entry xxxx for key zzzz
+		return 0, errDuplicateName
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *mysqlUserStore) SetDisplayName(txn *Transaction, userID int64, displayName string) error {
+	seg := StartMySQLSegment(txn, "user", "UPDATE")
+	_, err := db.Exec("UPDATE user SET display_name = ? WHERE id = ?", displayName, userID)
+	seg.End()
+	return err
+}
+
+func (s *mysqlUserStore) SetAvatarIcon(txn *Transaction, userID int64, avatarIcon string) error {
+	seg := StartMySQLSegment(txn, "user", "UPDATE")
+	_, err := db.Exec("UPDATE user SET avatar_icon = ? WHERE id = ?", avatarIcon, userID)
+	seg.End()
+	return err
+}
+
+func (s *mysqlUserStore) Status(txn *Transaction, userID int64) (*UserStatus, error) {
+	st := UserStatus{}
+	seg := StartMySQLSegment(txn, "user_status", "SELECT")
+	err := db.Get(&st, "SELECT * FROM user_status WHERE user_id = ?", userID)
+	seg.End()
+	if err == sql.ErrNoRows {
+		return &UserStatus{UserID: userID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+type mysqlChannelStore struct{}
+
+func (s *mysqlChannelStore) List(txn *Transaction) ([]ChannelInfo, error) {
+	channels := []ChannelInfo{}
+	seg := StartMySQLSegment(txn, "channel", "SELECT")
+	err := db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	seg.End()
+	return channels, err
+}
+
+func (s *mysqlChannelStore) IDs(txn *Transaction) ([]int64, error) {
+	res := []int64{}
+	seg := StartMySQLSegment(txn, "channel", "SELECT")
+	err := db.Select(&res, "SELECT id FROM channel")
+	seg.End()
+	return res, err
+}
+
+func (s *mysqlChannelStore) Create(txn *Transaction, name, description string, ownerID int64) (int64, error) {
+	seg := StartMySQLSegment(txn, "channel", "INSERT")
+	res, err := db.Exec(
+		"INSERT INTO channel (name, description, owner_id, updated_at, created_at) VALUES (?, ?, ?, NOW(), NOW())",
+		name, description, ownerID)
+	seg.End()
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *mysqlChannelStore) Delete(txn *Transaction, channelID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	seg := StartMySQLSegment(txn, "message", "DELETE")
+	_, err = tx.Exec("DELETE FROM message WHERE channel_id = ?", channelID)
+	seg.End()
+	if err != nil {
+		return err
+	}
+	seg = StartMySQLSegment(txn, "channel", "DELETE")
+	_, err = tx.Exec("DELETE FROM channel WHERE id = ?", channelID)
+	seg.End()
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	n := redisShard(channelID)
+	err = n.call(func() error { return n.Del(keyMessages(channelID)).Err() })
+	if err != nil {
+		markStale(channelID)
+	}
+	return nil
+}
+
+// mysqlMessageStore keeps messages in MySQL and mirrors each channel in a
+// Redis list of unified messages, newest first, on the channel's shard
+// (see shard.go). While the shard is down or a channel's list is stale,
+// reads go to MySQL (see degraded.go).
+type mysqlMessageStore struct{}
+
+func (s *mysqlMessageStore) Add(txn *Transaction, channelID, userID int64, content string) (int64, error) {
+	seg := StartMySQLSegment(txn, "message", "INSERT")
+	res, err := db.Exec(
+		"INSERT INTO message (channel_id, user_id, content, created_at) VALUES (?, ?, ?, NOW())",
+		channelID, userID, content)
+	seg.End()
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	n := redisShard(channelID)
+	err = n.call(func() error {
+		return n.LPush(keyMessages(channelID), unifyMessage(id, userID, content, time.Now())).Err()
+	})
+	if err != nil {
+		markStale(channelID)
+	}
+	return id, nil
+}
+
+func (s *mysqlMessageStore) Get(txn *Transaction, messageID int64) (*Message, error) {
+	var m Message
+	seg := StartMySQLSegment(txn, "message", "SELECT")
+	err := db.Get(&m, "SELECT * FROM message WHERE id = ?", messageID)
+	seg.End()
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *mysqlMessageStore) Delete(txn *Transaction, m *Message) error {
+	seg := StartMySQLSegment(txn, "message", "DELETE")
+	_, err := db.Exec("DELETE FROM message WHERE id = ?", m.ID)
+	seg.End()
+	if err != nil {
+		return err
+	}
+	n := redisShard(m.ChannelID)
+	err = n.call(func() error {
+		unifieds, err := n.LRange(keyMessages(m.ChannelID), 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		prefix := fmt.Sprintf("%d@", m.ID)
+		for _, u := range unifieds {
+			if strings.HasPrefix(u, prefix) {
+				return n.LRem(keyMessages(m.ChannelID), 1, u).Err()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		markStale(m.ChannelID)
+	}
+	return nil
+}
+
+func (s *mysqlMessageStore) Count(txn *Transaction, channelID int64) (int64, error) {
+	counts, err := s.Counts(txn, []int64{channelID})
+	return counts[channelID], err
+}
+
+func (s *mysqlMessageStore) Counts(txn *Transaction, channelIDs []int64) (map[int64]int64, error) {
+	counts := make(map[int64]int64, len(channelIDs))
+	var uncached []int64
+	for n, chs := range shards.byNode(channelIDs) {
+		var cached []int64
+		for _, ch := range chs {
+			if isStale(ch) {
+				uncached = append(uncached, ch)
+			} else {
+				cached = append(cached, ch)
+			}
+		}
+		if len(cached) == 0 {
+			continue
+		}
+		cmds := make([]*redis.IntCmd, len(cached))
+		err := n.call(func() error {
+			pipe := n.Pipeline()
+			for i, ch := range cached {
+				cmds[i] = pipe.LLen(keyMessages(ch))
+			}
+			_, err := pipe.Exec()
+			return err
+		})
+		if err != nil {
+			uncached = append(uncached, cached...)
+			continue
+		}
+		for i, ch := range cached {
+			counts[ch] = cmds[i].Val()
+		}
+	}
+	if len(uncached) == 0 {
+		return counts, nil
+	}
+
+	query, args, err := sqlx.In("SELECT channel_id, COUNT(*) FROM message WHERE channel_id IN (?) GROUP BY channel_id", uncached)
+	if err != nil {
+		return nil, err
+	}
+	seg := StartMySQLSegment(txn, "message", "SELECT")
+	defer seg.End()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for _, ch := range uncached {
+		counts[ch] = 0
+	}
+	for rows.Next() {
+		var ch, n int64
+		if err := rows.Scan(&ch, &n); err != nil {
+			return nil, err
+		}
+		counts[ch] = n
+	}
+	return counts, rows.Err()
+}
+
+func (s *mysqlMessageStore) Page(txn *Transaction, channelID, offset, limit int64) ([]Message, error) {
+	var unifieds []string
+	err := errRedisUnavailable
+	if !isStale(channelID) {
+		n := redisShard(channelID)
+		err = n.call(func() error {
+			var err error
+			unifieds, err = n.LRange(keyMessages(channelID), offset, offset+limit-1).Result()
+			return err
+		})
+	}
+	if err != nil {
+		msgs := []Message{}
+		seg := StartMySQLSegment(txn, "message", "SELECT")
+		err := db.Select(&msgs, "SELECT * FROM message WHERE channel_id = ? ORDER BY id DESC LIMIT ? OFFSET ?",
+			channelID, limit, offset)
+		seg.End()
+		return msgs, err
+	}
+	msgs := make([]Message, 0, len(unifieds))
+	for _, u := range unifieds {
+		id, uid, content, at := splitMessage(u)
+		createdAt, _ := time.ParseInLocation("2006/01/02 15:04:05", at, time.Local)
+		msgs = append(msgs, Message{
+			ID:        id,
+			ChannelID: channelID,
+			UserID:    uid,
+			Content:   content,
+			CreatedAt: createdAt,
+		})
+	}
+	return msgs, nil
+}
+
+func (s *mysqlMessageStore) Since(txn *Transaction, channelID, lastID int64, limit int) ([]UserMessage, error) {
+	seg := StartMySQLSegment(txn, "message", "SELECT")
+	defer seg.End()
+	rows, err := db.Query("SELECT m.id, m.user_id, m.created_at, m.content, u.name, u.display_name, u.avatar_icon "+
+		"FROM message AS m INNER JOIN user AS u ON m.user_id = u.id "+
+		"WHERE m.id > ? AND m.channel_id = ? ORDER BY m.id DESC LIMIT ?", lastID, channelID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	msgs := make([]UserMessage, 0, limit)
+	for rows.Next() {
+		m := UserMessage{Message: Message{ChannelID: channelID}}
+		err := rows.Scan(&m.ID, &m.UserID, &m.CreatedAt, &m.Content, &m.User.Name, &m.User.DisplayName, &m.User.AvatarIcon)
+		if err != nil {
+			return nil, err
+		}
+		m.User.ID = m.UserID
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// redisReadStateStore keeps read positions on the channel's Redis shard,
+// and in process while the shard is down until they can be written back.
+type redisReadStateStore struct{}
+
+func (s *redisReadStateStore) Get(txn *Transaction, userID, channelID int64) (int64, error) {
+	reads, err := s.GetAll(txn, userID, []int64{channelID})
+	return reads[channelID], err
+}
+
+func (s *redisReadStateStore) GetAll(txn *Transaction, userID int64, channelIDs []int64) (map[int64]int64, error) {
+	reads := make(map[int64]int64, len(channelIDs))
+	var remote, unknown []int64
+	for _, ch := range channelIDs {
+		if n, ok := localReadState(userID, ch); ok {
+			reads[ch] = n
+		} else {
+			remote = append(remote, ch)
+		}
+	}
+	for n, chs := range shards.byNode(remote) {
+		cmds := make([]*redis.StringCmd, len(chs))
+		err := n.call(func() error {
+			pipe := n.Pipeline()
+			for i, ch := range chs {
+				cmds[i] = pipe.Get(keyHaveread(userID, ch))
+			}
+			_, err := pipe.Exec()
+			return err
+		})
+		if err != nil && err != redis.Nil {
+			unknown = append(unknown, chs...)
+			continue
+		}
+		for i, ch := range chs {
+			v, err := cmds[i].Int64()
+			if err != nil && err != redis.Nil {
+				return nil, err
+			}
+			reads[ch] = v
+		}
+	}
+	if len(unknown) == 0 {
+		return reads, nil
+	}
+	// The positions are unknown until the shard is back. Report those
+	// channels as read rather than all of them as unread.
+	counts, err := messageStore.Counts(txn, unknown)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range unknown {
+		reads[ch] = counts[ch]
+	}
+	return reads, nil
+}
+
+func (s *redisReadStateStore) Set(txn *Transaction, userID, channelID, read int64) error {
+	if _, ok := localReadState(userID, channelID); !ok {
+		n := redisShard(channelID)
+		err := n.call(func() error {
+			return n.Set(keyHaveread(userID, channelID), read, 0).Err()
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	setLocalReadState(userID, channelID, read)
+	return nil
+}
+
+type mysqlSettingStore struct{}
+
+func (s *mysqlSettingStore) Get(txn *Transaction, name string) (string, error) {
+	var value string
+	seg := StartMySQLSegment(txn, "app_setting", "SELECT")
+	err := db.Get(&value, "SELECT value FROM app_setting WHERE name = ?", name)
+	seg.End()
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (s *mysqlSettingStore) Set(txn *Transaction, name, value string) error {
+	seg := StartMySQLSegment(txn, "app_setting", "INSERT")
+	_, err := db.Exec("INSERT INTO app_setting (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+		name, value)
+	seg.End()
+	return err
+}
+
+type mysqlTOTPStore struct{}
+
+func (s *mysqlTOTPStore) Get(txn *Transaction, userID int64) (*UserTOTP, error) {
+	t := UserTOTP{}
+	seg := StartMySQLSegment(txn, "user_totp", "SELECT")
+	err := db.Get(&t, "SELECT * FROM user_totp WHERE user_id = ?", userID)
+	seg.End()
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *mysqlTOTPStore) Enable(txn *Transaction, userID int64, secret string, step int64, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	seg := StartMySQLSegment(txn, "user_totp", "INSERT")
+	_, err = tx.Exec("INSERT INTO user_totp (user_id, secret, last_step, created_at) VALUES (?, ?, ?, NOW())",
+		userID, secret, step)
+	seg.End()
+	if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // Duplicate entry xxxx for key zzzz
+		return errTOTPEnabled
+	}
+	if err != nil {
+		return err
+	}
+	if err := setRecoveryCodes(txn, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mysqlTOTPStore) ResetRecoveryCodes(txn *Transaction, userID int64, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := setRecoveryCodes(txn, tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func setRecoveryCodes(txn *Transaction, tx *sql.Tx, userID int64, codeHashes []string) error {
+	seg := StartMySQLSegment(txn, "user_recovery_code", "DELETE")
+	_, err := tx.Exec("DELETE FROM user_recovery_code WHERE user_id = ?", userID)
+	seg.End()
+	if err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		seg := StartMySQLSegment(txn, "user_recovery_code", "INSERT")
+		_, err := tx.Exec("INSERT INTO user_recovery_code (user_id, code_hash) VALUES (?, ?)", userID, h)
+		seg.End()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mysqlTOTPStore) UseStep(txn *Transaction, userID, step int64) (bool, error) {
+	seg := StartMySQLSegment(txn, "user_totp", "UPDATE")
+	res, err := db.Exec("UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?",
+		step, userID, step)
+	seg.End()
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *mysqlTOTPStore) UseRecoveryCode(txn *Transaction, userID int64, codeHash string) (bool, error) {
+	seg := StartMySQLSegment(txn, "user_recovery_code", "UPDATE")
+	res, err := db.Exec(
+		"UPDATE user_recovery_code SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1",
+		userID, codeHash)
+	seg.End()
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *mysqlTOTPStore) Disable(txn *Transaction, userID int64) error {
+	seg := StartMySQLSegment(txn, "user_totp", "DELETE")
+	_, err := db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+	seg.End()
+	if err != nil {
+		return err
+	}
+	seg = StartMySQLSegment(txn, "user_recovery_code", "DELETE")
+	_, err = db.Exec("DELETE FROM user_recovery_code WHERE user_id = ?", userID)
+	seg.End()
+	return err
+}
+
+type mysqlAuditStore struct{}
+
+func (s *mysqlAuditStore) Add(txn *Transaction, e *AuditEntry) error {
+	seg := StartMySQLSegment(txn, "audit_log", "INSERT")
+	_, err := db.Exec(
+		"INSERT INTO audit_log (created_at, action, actor_id, actor_name, target_type, target_id, target_name, ip, user_agent, detail)"+
+			" VALUES (NOW(), ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Action, e.ActorID, e.ActorName, e.TargetType, e.TargetID, e.TargetName, e.IP, e.UserAgent, e.Detail)
+	seg.End()
+	return err
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore backs all the stores with process-local state, for running
+// the app without MySQL and Redis behind them and for handler tests.
+type memoryStore struct {
+	mu sync.RWMutex
+
+	users      map[int64]*User
+	userNames  map[string]int64
+	lastUserID int64
+	channels   map[int64]*ChannelInfo
+	lastChanID int64
+	messages   map[int64]*Message
+	byChannel  map[int64][]int64 // message IDs, oldest first
+	lastMsgID  int64
+	readStates map[[2]int64]int64
+	settings   map[string]string
+	totp       map[int64]*UserTOTP
+	recovery   map[int64]map[string]bool // code hash -> used
+	audit      []AuditEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:      map[int64]*User{},
+		userNames:  map[string]int64{},
+		channels:   map[int64]*ChannelInfo{},
+		messages:   map[int64]*Message{},
+		byChannel:  map[int64][]int64{},
+		readStates: map[[2]int64]int64{},
+		settings:   map[string]string{},
+		totp:       map[int64]*UserTOTP{},
+		recovery:   map[int64]map[string]bool{},
+	}
+}
+
+type memoryUserStore memoryStore
+
+func (s *memoryUserStore) Get(txn *Transaction, userID int64) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	cp := *u
+	return &cp, nil
+}
+
+func (s *memoryUserStore) GetByName(txn *Transaction, name string) (*User, error) {
+	s.mu.RLock()
+	id, ok := s.userNames[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return s.Get(txn, id)
+}
+
+func (s *memoryUserStore) Create(txn *Transaction, name, salt, password, displayName, avatarIcon string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.userNames[name]; ok {
+		return 0, errDuplicateName
+	}
+	s.lastUserID++
+	s.users[s.lastUserID] = &User{
+		ID:          s.lastUserID,
+		Name:        name,
+		Salt:        salt,
+		Password:    password,
+		DisplayName: displayName,
+		AvatarIcon:  avatarIcon,
+		CreatedAt:   time.Now(),
+	}
+	s.userNames[name] = s.lastUserID
+	return s.lastUserID, nil
+}
+
+func (s *memoryUserStore) SetDisplayName(txn *Transaction, userID int64, displayName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		u.DisplayName = displayName
+	}
+	return nil
+}
+
+func (s *memoryUserStore) SetAvatarIcon(txn *Transaction, userID int64, avatarIcon string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		u.AvatarIcon = avatarIcon
+	}
+	return nil
+}
+
+// Accounts cannot be suspended with the memory stores.
+func (s *memoryUserStore) Status(txn *Transaction, userID int64) (*UserStatus, error) {
+	return &UserStatus{UserID: userID}, nil
+}
+
+type memoryChannelStore memoryStore
+
+func (s *memoryChannelStore) List(txn *Transaction) ([]ChannelInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	channels := make([]ChannelInfo, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, *ch)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].ID < channels[j].ID })
+	return channels, nil
+}
+
+func (s *memoryChannelStore) IDs(txn *Transaction) ([]int64, error) {
+	channels, _ := s.List(txn)
+	ids := make([]int64, len(channels))
+	for i, ch := range channels {
+		ids[i] = ch.ID
+	}
+	return ids, nil
+}
+
+func (s *memoryChannelStore) Create(txn *Transaction, name, description string, ownerID int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastChanID++
+	now := time.Now()
+	s.channels[s.lastChanID] = &ChannelInfo{
+		ID:          s.lastChanID,
+		Name:        name,
+		Description: description,
+		OwnerID:     ownerID,
+		UpdatedAt:   now,
+		CreatedAt:   now,
+	}
+	return s.lastChanID, nil
+}
+
+func (s *memoryChannelStore) Delete(txn *Transaction, channelID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.byChannel[channelID] {
+		delete(s.messages, id)
+	}
+	delete(s.byChannel, channelID)
+	delete(s.channels, channelID)
+	return nil
+}
+
+type memoryMessageStore memoryStore
+
+func (s *memoryMessageStore) Add(txn *Transaction, channelID, userID int64, content string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastMsgID++
+	s.messages[s.lastMsgID] = &Message{
+		ID:        s.lastMsgID,
+		ChannelID: channelID,
+		UserID:    userID,
+		Content:   content,
+		CreatedAt: time.Now(),
+	}
+	s.byChannel[channelID] = append(s.byChannel[channelID], s.lastMsgID)
+	return s.lastMsgID, nil
+}
+
+func (s *memoryMessageStore) Get(txn *Transaction, messageID int64) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.messages[messageID]
+	if !ok {
+		return nil, nil
+	}
+	cp := *m
+	return &cp, nil
+}
+
+func (s *memoryMessageStore) Delete(txn *Transaction, m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, m.ID)
+	ids := s.byChannel[m.ChannelID]
+	for i, id := range ids {
+		if id == m.ID {
+			s.byChannel[m.ChannelID] = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryMessageStore) Count(txn *Transaction, channelID int64) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.byChannel[channelID])), nil
+}
+
+func (s *memoryMessageStore) Counts(txn *Transaction, channelIDs []int64) (map[int64]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[int64]int64, len(channelIDs))
+	for _, ch := range channelIDs {
+		counts[ch] = int64(len(s.byChannel[ch]))
+	}
+	return counts, nil
+}
+
+func (s *memoryMessageStore) Page(txn *Transaction, channelID, offset, limit int64) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.byChannel[channelID]
+	msgs := []Message{}
+	for i := int64(len(ids)) - 1 - offset; i >= 0 && int64(len(msgs)) < limit; i-- {
+		msgs = append(msgs, *s.messages[ids[i]])
+	}
+	return msgs, nil
+}
+
+func (s *memoryMessageStore) Since(txn *Transaction, channelID, lastID int64, limit int) ([]UserMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.byChannel[channelID]
+	msgs := []UserMessage{}
+	for i := len(ids) - 1; i >= 0 && ids[i] > lastID && len(msgs) < limit; i-- {
+		m := s.messages[ids[i]]
+		u, ok := s.users[m.UserID]
+		if !ok {
+			continue
+		}
+		msgs = append(msgs, UserMessage{
+			Message: *m,
+			User:    User{ID: u.ID, Name: u.Name, DisplayName: u.DisplayName, AvatarIcon: u.AvatarIcon},
+		})
+	}
+	return msgs, nil
+}
+
+type memoryReadStateStore memoryStore
+
+func (s *memoryReadStateStore) Get(txn *Transaction, userID, channelID int64) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readStates[[2]int64{userID, channelID}], nil
+}
+
+func (s *memoryReadStateStore) GetAll(txn *Transaction, userID int64, channelIDs []int64) (map[int64]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reads := make(map[int64]int64, len(channelIDs))
+	for _, ch := range channelIDs {
+		reads[ch] = s.readStates[[2]int64{userID, ch}]
+	}
+	return reads, nil
+}
+
+func (s *memoryReadStateStore) Set(txn *Transaction, userID, channelID, read int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readStates[[2]int64{userID, channelID}] = read
+	return nil
+}
+
+type memorySettingStore memoryStore
+
+func (s *memorySettingStore) Get(txn *Transaction, name string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings[name], nil
+}
+
+func (s *memorySettingStore) Set(txn *Transaction, name, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[name] = value
+	return nil
+}
+
+type memoryTOTPStore memoryStore
+
+func (s *memoryTOTPStore) Get(txn *Transaction, userID int64) (*UserTOTP, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.totp[userID]
+	if !ok {
+		return nil, nil
+	}
+	cp := *t
+	return &cp, nil
+}
+
+func (s *memoryTOTPStore) Enable(txn *Transaction, userID int64, secret string, step int64, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.totp[userID]; ok {
+		return errTOTPEnabled
+	}
+	s.totp[userID] = &UserTOTP{UserID: userID, Secret: secret, LastStep: step, CreatedAt: time.Now()}
+	s.setRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+func (s *memoryTOTPStore) ResetRecoveryCodes(txn *Transaction, userID int64, codeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRecoveryCodes(userID, codeHashes)
+	return nil
+}
+
+func (s *memoryTOTPStore) setRecoveryCodes(userID int64, codeHashes []string) {
+	codes := make(map[string]bool, len(codeHashes))
+	for _, h := range codeHashes {
+		codes[h] = false
+	}
+	s.recovery[userID] = codes
+}
+
+func (s *memoryTOTPStore) UseStep(txn *Transaction, userID, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[userID]
+	if !ok || t.LastStep >= step {
+		return false, nil
+	}
+	t.LastStep = step
+	return true, nil
+}
+
+func (s *memoryTOTPStore) UseRecoveryCode(txn *Transaction, userID int64, codeHash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	used, ok := s.recovery[userID][codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	s.recovery[userID][codeHash] = true
+	return true, nil
+}
+
+func (s *memoryTOTPStore) Disable(txn *Transaction, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.totp, userID)
+	delete(s.recovery, userID)
+	return nil
+}
+
+type memoryAuditStore memoryStore
+
+func (s *memoryAuditStore) Add(txn *Transaction, e *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *e
+	cp.ID = int64(len(s.audit)) + 1
+	cp.CreatedAt = time.Now()
+	s.audit = append(s.audit, cp)
+	return nil
+}
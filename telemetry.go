@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/newrelic/go-agent"
+)
+
+// Telemetry is vendor neutral. Every request gets a server span (W3C
+// traceparent is honoured) and its latency recorded in Prometheus
+// metrics; handlers name it with app.StartTransaction and wrap MySQL
+// calls in StartMySQLSegment. Finished spans go to an OTLP/HTTP endpoint
+// when one is configured, and transactions are mirrored to New Relic when
+// a license key is set. With telemetry disabled all of this is a no-op.
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+
+	spanQueueSize  = 2048
+	spanBatchSize  = 512
+	spanFlushEvery = 5 * time.Second
+)
+
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      bool
+}
+
+func newSpanID(n int) string {
+	b := make([]byte, n)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent extracts the trace and parent span IDs from a W3C
+// traceparent header ("00-<trace>-<span>-<flags>").
+func parseTraceparent(h string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+type Telemetry struct {
+	disabled bool
+	nr       newrelic.Application
+	spans    chan *Span
+}
+
+var app = &Telemetry{disabled: true}
+
+// newTelemetry sets up the exporters selected by c.
+func newTelemetry(c TelemetryConfig, newRelicKey string) *Telemetry {
+	t := &Telemetry{disabled: c.Disabled}
+	if t.disabled {
+		return t
+	}
+	if newRelicKey != "" {
+		nr, err := newrelic.NewApplication(newrelic.NewConfig(c.ServiceName, newRelicKey))
+		if err != nil {
+			log.Println("New Relic disabled:", err)
+		} else {
+			t.nr = nr
+		}
+	}
+	if c.OTLPEndpoint != "" {
+		t.spans = make(chan *Span, spanQueueSize)
+		workers.Add(1)
+		go t.exportSpans(c.OTLPEndpoint, c.ServiceName)
+	}
+	return t
+}
+
+type spanContextKey struct{}
+
+// Middleware opens the server span for a request and records its latency
+// by route once the handler returns.
+func (t *Telemetry) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if t.disabled {
+			return next(c)
+		}
+		req := c.Request()
+		start := time.Now()
+		route := routeLabel(c)
+		span := &Span{
+			TraceID: newSpanID(16),
+			SpanID:  newSpanID(8),
+			Name:    req.Method + " " + route,
+			Kind:    spanKindServer,
+			Start:   start,
+			Attributes: map[string]string{
+				"http.method": req.Method,
+				"http.route":  route,
+				"http.target": req.URL.RequestURI(),
+			},
+		}
+		if r := requestLogFrom(req.Context()); r != nil {
+			span.Attributes["http.request_id"] = r.id
+		}
+		if traceID, parentID, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+			span.TraceID, span.ParentID = traceID, parentID
+		}
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), spanContextKey{}, span)))
+
+		err := next(c)
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		} else if err != nil {
+			status = http.StatusInternalServerError
+		}
+		span.Attributes["http.status_code"] = strconv.Itoa(status)
+		span.Error = status >= 500
+		httpRequestDuration.Since(start, req.Method, route, strconv.Itoa(status))
+		t.finish(span)
+		return err
+	}
+}
+
+// routeUnmatched is the route of requests that matched none.
+const routeUnmatched = "unmatched"
+
+var notFoundHandler = reflect.ValueOf(echo.NotFoundHandler).Pointer()
+
+// routeLabel returns the route pattern that matched the request. Echo
+// reports the raw URL path when none did, which would give every probed
+// URL its own metric series.
+func routeLabel(c echo.Context) string {
+	if reflect.ValueOf(c.Handler()).Pointer() == notFoundHandler {
+		return routeUnmatched
+	}
+	return c.Path()
+}
+
+func (t *Telemetry) finish(span *Span) {
+	if t.spans == nil {
+		return
+	}
+	span.End = time.Now()
+	select {
+	case t.spans <- span:
+	default:
+		// Drop rather than block requests when the exporter falls behind.
+	}
+}
+
+// Transaction is the traced unit of work of one handler. A nil
+// *Transaction is valid and records metrics only.
+type Transaction struct {
+	t    *Telemetry
+	span *Span
+	nr   newrelic.Transaction
+	req  *requestLog
+}
+
+// StartTransaction names the request's server span and starts the New
+// Relic transaction if enabled. The transaction also carries the
+// request's logging context.
+func (t *Telemetry) StartTransaction(name string, w http.ResponseWriter, r *http.Request) *Transaction {
+	txn := &Transaction{t: t, req: requestLogFrom(r.Context())}
+	if t.disabled {
+		return txn
+	}
+	if span, ok := r.Context().Value(spanContextKey{}).(*Span); ok {
+		// Helpers such as ensureLogin start their own transaction on the
+		// same request; the handler's name wins.
+		if _, named := span.Attributes["handler"]; !named {
+			span.Attributes["handler"] = name
+		}
+		txn.span = span
+	}
+	if t.nr != nil {
+		txn.nr = t.nr.StartTransaction(name, w, r)
+	}
+	return txn
+}
+
+func (txn *Transaction) End() {
+	if txn != nil && txn.nr != nil {
+		txn.nr.End()
+	}
+}
+
+// Segment times one datastore call within a transaction.
+type Segment struct {
+	txn        *Transaction
+	span       *Span
+	nr         *newrelic.DatastoreSegment
+	collection string
+	operation  string
+	start      time.Time
+}
+
+func StartMySQLSegment(txn *Transaction, collection, operation string) *Segment {
+	s := &Segment{txn: txn, collection: collection, operation: operation, start: time.Now()}
+	if txn == nil {
+		return s
+	}
+	if txn.span != nil && txn.t.spans != nil {
+		s.span = &Span{
+			TraceID:  txn.span.TraceID,
+			SpanID:   newSpanID(8),
+			ParentID: txn.span.SpanID,
+			Name:     operation + " " + collection,
+			Kind:     spanKindClient,
+			Start:    s.start,
+			Attributes: map[string]string{
+				"db.system":    "mysql",
+				"db.sql.table": collection,
+				"db.operation": operation,
+			},
+		}
+	}
+	if txn.nr != nil {
+		s.nr = &newrelic.DatastoreSegment{
+			StartTime:  txn.nr.StartSegmentNow(),
+			Product:    newrelic.DatastoreMySQL,
+			Collection: collection,
+			Operation:  operation,
+		}
+	}
+	return s
+}
+
+func (s *Segment) End() {
+	dbQueryDuration.Since(s.start, s.collection, s.operation)
+	if s.span != nil {
+		s.txn.t.finish(s.span)
+	}
+	if s.nr != nil {
+		s.nr.End()
+	}
+}
+
+// OTLP/HTTP JSON export
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributes(m map[string]string) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, otlpAttribute{k, otlpValue{v}})
+	}
+	return attrs
+}
+
+func otlpRequest(serviceName string, spans []*Span) ([]byte, error) {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error {
+			o.Status.Code = spanStatusError
+		}
+		out[i] = o
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{
+					"service.name":        serviceName,
+					"service.instance.id": me,
+				}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "isubata"},
+				"spans": out,
+			}},
+		}},
+	})
+}
+
+var otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+// exportSpans batches finished spans to endpoint until shutdown, then
+// sends what is left.
+func (t *Telemetry) exportSpans(endpoint, serviceName string) {
+	defer workers.Done()
+	var mu sync.Mutex
+	batch := make([]*Span, 0, spanBatchSize)
+	flush := func() {
+		mu.Lock()
+		spans := batch
+		batch = make([]*Span, 0, spanBatchSize)
+		mu.Unlock()
+		if len(spans) == 0 {
+			return
+		}
+		body, err := otlpRequest(serviceName, spans)
+		if err != nil {
+			log.Println("Failed to encode spans:", err)
+			return
+		}
+		resp, err := otlpClient.Post(endpoint, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Failed to export spans:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Println("Failed to export spans:", resp.Status)
+		}
+	}
+
+	ticker := time.NewTicker(spanFlushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case s := <-t.spans:
+			mu.Lock()
+			batch = append(batch, s)
+			full := len(batch) >= spanBatchSize
+			mu.Unlock()
+			if full {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-shutdownCh:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
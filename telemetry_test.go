@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestRouteLabel(t *testing.T) {
+	e := echo.New()
+	var got string
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			got = routeLabel(c)
+			return next(c)
+		}
+	})
+	e.GET("/channel/:channel_id", func(c echo.Context) error { return nil })
+
+	for path, want := range map[string]string{
+		"/channel/1":     "/channel/:channel_id",
+		"/channel/2":     "/channel/:channel_id",
+		"/wp-login.php":  routeUnmatched,
+		"/channel/1/foo": routeUnmatched,
+	} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if got != want {
+			t.Errorf("%s: route %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+const (
+	totpIssuer        = "Isubata"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	totpPendingMaxAge = 5 * time.Minute
+	totpMaxFailures   = 5
+	recoveryCodeCount = 10
+)
+
+var (
+	// requireTOTP forces every user to enroll before using the app.
+	requireTOTP bool
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type UserTOTP struct {
+	UserID    int64     `db:"user_id"`
+	Secret    string    `db:"secret"`
+	LastStep  int64     `db:"last_step"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func keyTOTPFailures(user int64) string {
+	return fmt.Sprintf("totpfail:%d", user)
+}
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	crand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// verifyTOTP checks code against the steps around now. Steps at or before
+// lastStep are rejected so that a code can be used only once.
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	code = strings.Replace(code, " ", "", -1)
+	cur := now.Unix() / totpPeriod
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(name, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+name) + "?" + v.Encode()
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(code)))
+}
+
+func newRecoveryCodes() []string {
+	const letters = "abcdefghijkmnpqrstuvwxyz23456789"
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		crand.Read(b)
+		for j := range b {
+			b[j] = letters[int(b[j])%len(letters)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+	}
+	return codes
+}
+
+func getUserTOTP(txn *Transaction, userID int64) (*UserTOTP, error) {
+	t, err := totpStore.Get(txn, userID)
+	if err != nil {
+		txn.Error("Failed to getUserTOTP:", err)
+		return nil, err
+	}
+	return t, nil
+}
+
+func hashRecoveryCodes(codes []string) []string {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return hashes
+}
+
+// checkSecondFactor accepts either a current TOTP code or a recovery code.
+func checkSecondFactor(txn *Transaction, t *UserTOTP, code string) (bool, error) {
+	if step, ok := verifyTOTP(t.Secret, code, t.LastStep, time.Now()); ok {
+		return totpStore.UseStep(txn, t.UserID, step)
+	}
+	if len(code) > totpDigits {
+		return totpStore.UseRecoveryCode(txn, t.UserID, hashRecoveryCode(code))
+	}
+	return false, nil
+}
+
+// verifySecondFactor checks a code given at login or to change 2FA
+// settings, counting failures towards the lockout.
+func verifySecondFactor(txn *Transaction, c echo.Context, user *User, t *UserTOTP, code string) error {
+	if totpLockedOut(user.ID) {
+		return echo.NewHTTPError(http.StatusTooManyRequests)
+	}
+	ok, err := checkSecondFactor(txn, t, code)
+	if err != nil {
+		txn.Error("Failed to verifySecondFactor:", err)
+		return err
+	}
+	if !ok {
+		recordTOTPFailure(user.ID)
+		audit(txn, c, auditTOTPFailed, nil, "user", user.ID, user.Name, "")
+		return echo.ErrForbidden
+	}
+	clearTOTPFailures(user.ID)
+	return nil
+}
+
+// localTOTPFailures counts second-factor failures in process while the
+// first Redis node is unavailable, and always with the memory store. Each
+// host then locks out on its own count, so during an outage an attacker
+// spread over n hosts gets n times totpMaxFailures tries per window; that
+// is preferred to refusing every 2FA login until Redis is back.
+var localTOTPFailures = struct {
+	sync.Mutex
+	m map[int64]totpFailures
+}{m: map[int64]totpFailures{}}
+
+type totpFailures struct {
+	n       int64
+	expires time.Time
+}
+
+// totpRedis runs fn against the first node through its breaker.
+func totpRedis(fn func() error) error {
+	if memoryStores {
+		return errRedisUnavailable
+	}
+	return shards.nodes[0].call(fn)
+}
+
+func totpLockedOut(userID int64) bool {
+	var n int64
+	err := totpRedis(func() error {
+		var err error
+		n, err = rd.Get(keyTOTPFailures(userID)).Int64()
+		return err
+	})
+	if err == redis.Nil {
+		return false
+	}
+	if err != nil {
+		localTOTPFailures.Lock()
+		f := localTOTPFailures.m[userID]
+		localTOTPFailures.Unlock()
+		if time.Now().After(f.expires) {
+			return false
+		}
+		n = f.n
+	}
+	return n >= totpMaxFailures
+}
+
+func recordTOTPFailure(userID int64) {
+	key := keyTOTPFailures(userID)
+	err := totpRedis(func() error {
+		if err := rd.Incr(key).Err(); err != nil {
+			return err
+		}
+		return rd.Expire(key, totpPendingMaxAge).Err()
+	})
+	if err == nil {
+		return
+	}
+	if !memoryStores {
+		log.Println("Counting 2FA failures in process, Redis is unavailable:", err)
+	}
+	localTOTPFailures.Lock()
+	f := localTOTPFailures.m[userID]
+	if time.Now().After(f.expires) {
+		f.n = 0
+	}
+	f.n++
+	f.expires = time.Now().Add(totpPendingMaxAge)
+	localTOTPFailures.m[userID] = f
+	localTOTPFailures.Unlock()
+}
+
+func clearTOTPFailures(userID int64) {
+	totpRedis(func() error {
+		return rd.Del(keyTOTPFailures(userID)).Err()
+	})
+	localTOTPFailures.Lock()
+	delete(localTOTPFailures.m, userID)
+	localTOTPFailures.Unlock()
+}
+
+func sessPendingUserID(c echo.Context) int64 {
+	sess, _ := session.Get("session", c)
+	userID, _ := sess.Values["pending_user_id"].(int64)
+	at, _ := sess.Values["pending_at"].(int64)
+	if userID == 0 || time.Since(time.Unix(at, 0)) > totpPendingMaxAge {
+		return 0
+	}
+	return userID
+}
+
+func sessSetPendingUserID(c echo.Context, id int64) {
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "user_id")
+	sess.Values["pending_user_id"] = id
+	sess.Values["pending_at"] = time.Now().Unix()
+	sess.Save(c.Request(), c.Response())
+}
+
+func sessClearPending(c echo.Context) {
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "pending_user_id")
+	delete(sess.Values, "pending_at")
+	delete(sess.Values, "totp_setup_secret")
+	sess.Save(c.Request(), c.Response())
+}
+
+// totpRequired reports whether 2FA is mandatory, either through
+// ISUBATA_REQUIRE_2FA or the admin setting.
+func totpRequired(txn *Transaction) (bool, error) {
+	if requireTOTP {
+		return true, nil
+	}
+	v, err := getSetting(txn, settingRequire2FA)
+	return v == "1", err
+}
+
+// needsTOTPEnrollment reports whether user must set up 2FA before doing
+// anything else.
+func needsTOTPEnrollment(txn *Transaction, c echo.Context, user *User) (bool, error) {
+	if strings.HasPrefix(c.Path(), "/2fa") {
+		return false, nil
+	}
+	required, err := totpRequired(txn)
+	if !required || err != nil {
+		return false, err
+	}
+	t, err := getUserTOTP(txn, user.ID)
+	if err != nil {
+		return false, err
+	}
+	return t == nil, nil
+}
+
+// request handlers
+
+func getLogin2FA(c echo.Context) error {
+	txn := app.StartTransaction("getLogin2FA", c.Response().Writer, c.Request())
+	defer txn.End()
+	if sessPendingUserID(c) == 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return c.Render(http.StatusOK, "login_2fa", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  []ChannelInfo{},
+		"User":      nil,
+	})
+}
+
+func postLogin2FA(c echo.Context) error {
+	txn := app.StartTransaction("postLogin2FA", c.Response().Writer, c.Request())
+	defer txn.End()
+	userID := sessPendingUserID(c)
+	if userID == 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	code := c.FormValue("code")
+	if code == "" {
+		return ErrBadReqeust
+	}
+
+	t, err := getUserTOTP(txn, userID)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		// 2FA was disabled in the meantime.
+		sessClearPending(c)
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	user, err := getUser(txn, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		sessClearPending(c)
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	if err := verifySecondFactor(txn, c, user, t, code); err != nil {
+		return err
+	}
+	audit(txn, c, auditLogin, user, "user", user.ID, user.Name, "2fa")
+	sessClearPending(c)
+	sessSetUserID(c, userID)
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func getTOTPSetup(c echo.Context) error {
+	txn := app.StartTransaction("getTOTPSetup", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	return renderTOTPSetup(txn, c, self, http.StatusOK, "")
+}
+
+// renderTOTPSetup shows the setup page, with message as an alert if set.
+func renderTOTPSetup(txn *Transaction, c echo.Context, self *User, status int, message string) error {
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		txn.Error("Failed to getTOTPSetup1:", err)
+		return err
+	}
+
+	t, err := getUserTOTP(txn, self.ID)
+	if err != nil {
+		return err
+	}
+	required, err := totpRequired(txn)
+	if err != nil {
+		txn.Error("Failed to getTOTPSetup2:", err)
+		return err
+	}
+
+	data := map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  channels,
+		"User":      self,
+		"Enabled":   t != nil,
+		"Required":  required,
+		"Message":   message,
+	}
+	if t == nil {
+		secret := newTOTPSecret()
+		sess, _ := session.Get("session", c)
+		sess.Values["totp_setup_secret"] = secret
+		sess.Save(c.Request(), c.Response())
+		data["Secret"] = secret
+		data["URI"] = totpURI(self.Name, secret)
+	}
+	return c.Render(status, "totp_setup", data)
+}
+
+func getTOTPQRCode(c echo.Context) error {
+	txn := app.StartTransaction("getTOTPQRCode", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	sess, _ := session.Get("session", c)
+	secret, _ := sess.Values["totp_setup_secret"].(string)
+	if secret == "" {
+		return echo.ErrNotFound
+	}
+	q, err := qrEncode([]byte(totpURI(self.Name, secret)))
+	if err != nil {
+		txn.Error("Failed to getTOTPQRCode1:", err)
+		return err
+	}
+	img, err := q.PNG(6)
+	if err != nil {
+		txn.Error("Failed to getTOTPQRCode2:", err)
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Blob(http.StatusOK, "image/png", img)
+}
+
+func postTOTPSetup(c echo.Context) error {
+	txn := app.StartTransaction("postTOTPSetup", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	sess, _ := session.Get("session", c)
+	secret, _ := sess.Values["totp_setup_secret"].(string)
+	if secret == "" {
+		return c.Redirect(http.StatusSeeOther, "/2fa/setup")
+	}
+	step, ok := verifyTOTP(secret, c.FormValue("code"), 0, time.Now())
+	if !ok {
+		return echo.ErrForbidden
+	}
+
+	codes := newRecoveryCodes()
+	err = totpStore.Enable(txn, self.ID, secret, step, hashRecoveryCodes(codes))
+	if err == errTOTPEnabled {
+		// Set up concurrently, e.g. from another tab; keep the first.
+		delete(sess.Values, "totp_setup_secret")
+		sess.Save(c.Request(), c.Response())
+		return renderTOTPSetup(txn, c, self, http.StatusConflict, "二要素認証は既に設定されています。")
+	}
+	if err != nil {
+		txn.Error("Failed to postTOTPSetup2:", err)
+		return err
+	}
+	audit(txn, c, auditTOTPEnabled, self, "user", self.ID, self.Name, "")
+
+	delete(sess.Values, "totp_setup_secret")
+	sess.Save(c.Request(), c.Response())
+
+	return renderRecoveryCodes(txn, c, self, codes)
+}
+
+func postTOTPRecovery(c echo.Context) error {
+	txn := app.StartTransaction("postTOTPRecovery", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	t, err := getUserTOTP(txn, self.ID)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return ErrBadReqeust
+	}
+	if err := verifySecondFactor(txn, c, self, t, c.FormValue("code")); err != nil {
+		return err
+	}
+
+	codes := newRecoveryCodes()
+	if err := totpStore.ResetRecoveryCodes(txn, self.ID, hashRecoveryCodes(codes)); err != nil {
+		txn.Error("Failed to postTOTPRecovery2:", err)
+		return err
+	}
+	audit(txn, c, auditTOTPRecovery, self, "user", self.ID, self.Name, "")
+	return renderRecoveryCodes(txn, c, self, codes)
+}
+
+func renderRecoveryCodes(txn *Transaction, c echo.Context, self *User, codes []string) error {
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		txn.Error("Failed to renderRecoveryCodes:", err)
+		return err
+	}
+	return c.Render(http.StatusOK, "totp_recovery", map[string]interface{}{
+		"ChannelID": 0,
+		"Channels":  channels,
+		"User":      self,
+		"Codes":     codes,
+	})
+}
+
+func postTOTPDisable(c echo.Context) error {
+	txn := app.StartTransaction("postTOTPDisable", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	required, err := totpRequired(txn)
+	if err != nil {
+		txn.Error("Failed to postTOTPDisable0:", err)
+		return err
+	}
+	if required {
+		return echo.ErrForbidden
+	}
+	t, err := getUserTOTP(txn, self.ID)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return c.Redirect(http.StatusSeeOther, "/2fa/setup")
+	}
+	if err := verifySecondFactor(txn, c, self, t, c.FormValue("code")); err != nil {
+		return err
+	}
+
+	if err := totpStore.Disable(txn, self.ID); err != nil {
+		txn.Error("Failed to postTOTPDisable2:", err)
+		return err
+	}
+	audit(txn, c, auditTOTPDisabled, self, "user", self.ID, self.Name, "")
+	return c.Redirect(http.StatusSeeOther, "/profile/"+url.PathEscape(self.Name))
+}
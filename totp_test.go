@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238, appendix B, cut to six digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("T=%d: got %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	now := time.Unix(1111111111, 0)
+	cur := now.Unix() / totpPeriod
+	for _, tt := range []struct {
+		name     string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"current", totpCode(key, cur), 0, cur, true},
+		{"previous", totpCode(key, cur-1), 0, cur - 1, true},
+		{"next", totpCode(key, cur+1), 0, cur + 1, true},
+		{"two back", totpCode(key, cur-2), 0, 0, false},
+		{"two ahead", totpCode(key, cur+2), 0, 0, false},
+		{"spaced", totpCode(key, cur)[:3] + " " + totpCode(key, cur)[3:], 0, cur, true},
+		{"replayed", totpCode(key, cur), cur, 0, false},
+		{"after a later step", totpCode(key, cur-1), cur, 0, false},
+		{"garbage", "abcdef", 0, 0, false},
+	} {
+		step, ok := verifyTOTP(secret, tt.code, tt.lastStep, now)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, step, ok, tt.step, tt.ok)
+		}
+	}
+}
+
+var (
+	secretPattern   = regexp.MustCompile(`<code>([A-Z2-7]+)</code>`)
+	recoveryPattern = regexp.MustCompile(`<code>([a-z2-9]{5}-[a-z2-9]{5})</code>`)
+)
+
+func TestTOTPLogin(t *testing.T) {
+	srv := newTestServer(t)
+	defer srv.Close()
+	owner := newTestClient(t, srv)
+	owner.expect("POST", "/register", url.Values{"name": {"erin"}, "password": {"pw"}}, http.StatusSeeOther)
+
+	m := secretPattern.FindStringSubmatch(owner.expect("GET", "/2fa/setup", nil, http.StatusOK))
+	if m == nil {
+		t.Fatal("no secret on the setup page")
+	}
+	key, err := totpEncoding.DecodeString(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := time.Now().Unix() / totpPeriod
+	owner.expect("POST", "/2fa/setup", url.Values{"code": {"000000"}}, http.StatusForbidden)
+	codes := recoveryPattern.FindAllStringSubmatch(
+		owner.expect("POST", "/2fa/setup", url.Values{"code": {totpCode(key, cur)}}, http.StatusOK), -1)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// login returns a client whose password was accepted.
+	login := func() *testClient {
+		tc := newTestClient(t, srv)
+		_, h, _ := tc.do("POST", "/login", url.Values{"name": {"erin"}, "password": {"pw"}})
+		if loc := h.Get("Location"); loc != "/login/2fa" {
+			t.Fatalf("login redirects to %q, want /login/2fa", loc)
+		}
+		return tc
+	}
+	recovered := login()
+	recovered.expect("POST", "/login/2fa", url.Values{"code": {codes[0][1]}}, http.StatusSeeOther)
+	recovered.expect("GET", "/channel/1", nil, http.StatusOK)
+
+	tc := login()
+	for _, code := range []string{
+		totpCode(key, cur), // used for setup
+		codes[0][1],        // used above
+		"000000",
+		"111111",
+		"222222",
+	} {
+		tc.expect("POST", "/login/2fa", url.Values{"code": {code}}, http.StatusForbidden)
+	}
+	tc.expect("POST", "/login/2fa", url.Values{"code": {totpCode(key, cur+1)}}, http.StatusTooManyRequests)
+	tc.expect("GET", "/channel/1", nil, http.StatusSeeOther)
+}
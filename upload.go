@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Avatar uploads are streamed: the request body is capped before it is
+// read, the file part is copied to a temp file and hashed on the way,
+// and only the decoded image is ever held in memory.
+
+const (
+	// uploadOverhead leaves room for multipart framing and the text
+	// fields sent alongside an avatar.
+	uploadOverhead    = 64 * 1024
+	uploadFieldMax    = 4 * 1024
+	uploadMaxFormSize = avatarMaxBytes + uploadOverhead
+)
+
+var errUploadTooLarge = errors.New("upload: too large")
+
+// limitBody rejects requests whose body exceeds n bytes with 413. Bodies
+// without a Content-Length are cut off at n bytes while being read.
+func limitBody(n int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.ContentLength > n {
+				return echo.ErrStatusRequestEntityTooLarge
+			}
+			req.Body = http.MaxBytesReader(c.Response().Writer, req.Body, n)
+			return next(c)
+		}
+	}
+}
+
+// isBodyTooLarge reports whether err comes from a body cut off by
+// limitBody. The multipart reader wraps that error into its own message.
+func isBodyTooLarge(err error) bool {
+	return err == errUploadTooLarge ||
+		err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// uploadError maps errors from reading an upload to a response.
+func uploadError(err error) error {
+	if isBodyTooLarge(err) {
+		return echo.ErrStatusRequestEntityTooLarge
+	}
+	return err
+}
+
+// spooledFile is an uploaded file part copied to disk.
+type spooledFile struct {
+	*os.File
+	Filename string
+	Size     int64
+	SHA1     string
+}
+
+// Close closes and removes the temp file.
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// Ext returns the extension of the client-supplied file name.
+func (f *spooledFile) Ext() string {
+	dotPos := strings.LastIndexByte(f.Filename, '.')
+	if dotPos < 0 {
+		return ""
+	}
+	return f.Filename[dotPos:]
+}
+
+// spool copies at most max bytes of r into a temp file in dir, hashing
+// them on the way. The returned file is positioned at its start.
+func spool(dir string, r io.Reader, max int64) (*spooledFile, error) {
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	f := &spooledFile{File: tmp}
+	h := sha1.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, max+1))
+	if err == nil && n > max {
+		err = errUploadTooLarge
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Size = n
+	f.SHA1 = fmt.Sprintf("%x", h.Sum(nil))
+	return f, nil
+}
+
+// readUpload streams a multipart/form-data body. Text fields are returned
+// as values; the part named fileField, if present, is spooled to dir and
+// must not exceed maxFile bytes. The caller closes the returned file.
+func readUpload(c echo.Context, fileField, dir string, maxFile int64) (url.Values, *spooledFile, error) {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		values, err := c.FormParams()
+		return values, nil, err
+	}
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, nil, ErrBadReqeust
+	}
+	values := url.Values{}
+	var file *spooledFile
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return values, file, nil
+		}
+		if err != nil {
+			return closeUpload(file, err)
+		}
+		if err := readPart(part, fileField, dir, maxFile, values, &file); err != nil {
+			return closeUpload(file, err)
+		}
+	}
+}
+
+func readPart(part *multipart.Part, fileField, dir string, maxFile int64, values url.Values, file **spooledFile) error {
+	defer part.Close()
+	name := part.FormName()
+	if part.FileName() == "" {
+		b, err := ioutil.ReadAll(io.LimitReader(part, uploadFieldMax+1))
+		if err != nil {
+			return err
+		}
+		if len(b) > uploadFieldMax {
+			return errUploadTooLarge
+		}
+		values.Add(name, string(b))
+		return nil
+	}
+	if name != fileField || *file != nil {
+		// Unexpected file parts are drained without being stored.
+		_, err := io.Copy(ioutil.Discard, part)
+		return err
+	}
+	f, err := spool(dir, part, maxFile)
+	if err != nil {
+		return err
+	}
+	f.Filename = part.FileName()
+	*file = f
+	return nil
+}
+
+func closeUpload(file *spooledFile, err error) (url.Values, *spooledFile, error) {
+	if file != nil {
+		file.Close()
+	}
+	return nil, nil, err
+}
+
+// uploadDir returns the directory uploads are spooled to. For the local
+// store that is the icon directory itself, so a verified upload can be
+// renamed into place.
+func uploadDir() string {
+	if l, ok := iconStore.(*localBlobStore); ok {
+		return l.dir
+	}
+	return ""
+}
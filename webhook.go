@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Channel owners and admins register HTTPS URLs that receive a signed
+// JSON payload for each channel event. Handlers only insert rows into
+// webhook_delivery; like icon replication, each host's worker delivers
+// the rows it enqueued, with exponential backoff. A webhook whose
+// deliveries keep failing is disabled until re-enabled on its page.
+//
+// Requests carry X-Isubata-Webhook-Timestamp and
+// X-Isubata-Webhook-Signature, "sha256=" followed by the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the webhook's secret.
+//
+// There is no channel.created event: webhooks are registered on a
+// channel, so a new channel has none to notify. Channels and messages
+// cannot be edited either, so channel.deleted is the only channel change
+// and there are no update events. Adding an edit feature should add its
+// event here.
+
+// Webhook events.
+const (
+	webhookMessageCreated = "message.created"
+	webhookMessageDeleted = "message.deleted"
+	webhookChannelDeleted = "channel.deleted"
+)
+
+var webhookEvents = []string{webhookMessageCreated, webhookMessageDeleted, webhookChannelDeleted}
+
+const (
+	webhookPollInterval    = time.Second
+	webhookPruneInterval   = time.Hour
+	webhookBatch           = 50
+	webhookWorkers         = 4
+	webhookMaxAttempts     = 8
+	webhookMinBackoff      = 10 * time.Second
+	webhookMaxBackoff      = time.Hour
+	webhookLogRetention    = 7 * 24 * time.Hour
+	webhookMaxURL          = 2048
+	webhookMaxPerChannel   = 10
+	webhookRecentLog       = 20
+	webhookEventHeader     = "X-Isubata-Webhook-Event"
+	webhookDeliveryHeader  = "X-Isubata-Webhook-Delivery"
+	webhookTimestampHeader = "X-Isubata-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Isubata-Webhook-Signature"
+
+	// webhookDisableAfter is the number of deliveries in a row that may
+	// fail every attempt before the webhook is disabled.
+	webhookDisableAfter = 5
+)
+
+var webhookClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: publicTransport,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// publicTransport only connects to public addresses, so URLs supplied by
+// users cannot reach services on the internal network. The address is
+// checked when the socket is dialed, after DNS resolution, so a name
+// that resolves to an internal address is refused as well. It never
+// uses a proxy, whose address would be the one checked.
+var publicTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: dialPublicOnly,
+	}).DialContext,
+	TLSHandshakeTimeout: 5 * time.Second,
+	MaxIdleConnsPerHost: webhookWorkers,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// cgnat is the shared address space of RFC 6598.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil && (ip4[0] == 0 || cgnat.Contains(ip4)) {
+		return false
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+type Webhook struct {
+	ID             int64     `db:"id"`
+	ChannelID      int64     `db:"channel_id"`
+	URL            string    `db:"url"`
+	Secret         string    `db:"secret"`
+	Events         string    `db:"events"` // comma-separated
+	Active         bool      `db:"active"`
+	Failures       int       `db:"failures"`
+	DisabledReason string    `db:"disabled_reason"`
+	CreatedBy      int64     `db:"created_by"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+
+	// Deliveries holds the most recent deliveries for the settings page.
+	Deliveries []WebhookDelivery `db:"-"`
+}
+
+type WebhookDelivery struct {
+	ID             int64     `db:"id"`
+	WebhookID      int64     `db:"webhook_id"`
+	Source         string    `db:"source"`
+	Event          string    `db:"event"`
+	Payload        string    `db:"payload"`
+	Status         string    `db:"status"`
+	Attempts       int       `db:"attempts"`
+	NextAttemptAt  time.Time `db:"next_attempt_at"`
+	ResponseStatus int       `db:"response_status"`
+	LastError      string    `db:"last_error"`
+	RequestID      string    `db:"request_id"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+// webhookJob is a due delivery together with where to send it.
+type webhookJob struct {
+	WebhookDelivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// WebhookPayload is the JSON body of a delivery.
+type WebhookPayload struct {
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Channel   APIChannel  `json:"channel"`
+	Message   *APIMessage `json:"message,omitempty"`
+}
+
+// randomToken returns 32 random bytes in hex, for secrets and tokens.
+func randomToken() string {
+	b := make([]byte, 32)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks enqueues a delivery of event to each active webhook of
+// the channel that subscribes to it. payload is only built if there is
+// one. Failures are logged but never fail the request.
+func notifyWebhooks(txn *Transaction, channelID int64, event string, payload func() (*WebhookPayload, error)) {
+	if memoryStores {
+		return // no webhooks can be registered
+	}
+	var ids []int64
+	s := StartMySQLSegment(txn, "webhook", "SELECT")
+	err := db.Select(&ids,
+		"SELECT id FROM webhook WHERE channel_id = ? AND active = 1 AND FIND_IN_SET(?, events)", channelID, event)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to notifyWebhooks1:", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	p, err := payload()
+	if err != nil {
+		txn.Error("Failed to notifyWebhooks2:", err)
+		return
+	}
+	p.Event = event
+	p.CreatedAt = time.Now()
+	body, err := json.Marshal(p)
+	if err != nil {
+		txn.Error("Failed to notifyWebhooks3:", err)
+		return
+	}
+
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, 0, len(ids)*5)
+	for i, id := range ids {
+		placeholders[i] = "(?, ?, ?, ?, 'pending', 0, NOW(), ?, NOW(), NOW())"
+		args = append(args, id, me, event, string(body), txn.RequestID())
+	}
+	s = StartMySQLSegment(txn, "webhook_delivery", "INSERT")
+	_, err = db.Exec(
+		"INSERT INTO webhook_delivery (webhook_id, source, event, payload, status, attempts, next_attempt_at, request_id, created_at, updated_at) VALUES "+
+			strings.Join(placeholders, ", "), args...)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to notifyWebhooks4:", err)
+	}
+}
+
+// queryChannelInfo returns nil without an error when the channel does
+// not exist.
+func queryChannelInfo(txn *Transaction, channelID int64) (*ChannelInfo, error) {
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range channels {
+		if channels[i].ID == channelID {
+			return &channels[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// messagePayload builds the payload of a message event.
+func messagePayload(txn *Transaction, m *Message) (*WebhookPayload, error) {
+	ch, err := queryChannelInfo(txn, m.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, fmt.Errorf("channel %d not found", m.ChannelID)
+	}
+	u, err := getUser(txn, m.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		u = &User{ID: m.UserID}
+	}
+	am := toAPIMessage(m, u)
+	return &WebhookPayload{Channel: toAPIChannel(*ch), Message: &am}, nil
+}
+
+// deactivateChannelWebhooks stops new deliveries to a deleted channel's
+// webhooks. Deliveries already queued, such as channel.deleted, are
+// still sent.
+func deactivateChannelWebhooks(txn *Transaction, channelID int64) {
+	s := StartMySQLSegment(txn, "webhook", "UPDATE")
+	_, err := db.Exec("UPDATE webhook SET active = 0, disabled_reason = 'channel deleted', updated_at = NOW() WHERE channel_id = ?",
+		channelID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to deactivateChannelWebhooks:", err)
+	}
+}
+
+// sendWebhook posts a delivery. It returns the response status, 0 if
+// there was no response.
+func sendWebhook(job webhookJob) (int, error) {
+	body := []byte(job.Payload)
+	req, err := http.NewRequest(http.MethodPost, job.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", "isubata-webhook/1")
+	req.Header.Set(webhookEventHeader, job.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(job.ID, 10))
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookSignatureHeader, webhookSignature(job.Secret, ts, body))
+	req.Header.Set(requestIDHeader, job.RequestID)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// The body is drained so the connection can be reused but never
+	// recorded: the delivery log is shown to the channel owner and must
+	// not echo what the receiver answered.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookMinBackoff << uint(attempts)
+	if d <= 0 || d > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return d
+}
+
+func deliverWebhook(job webhookJob) {
+	// Deliveries enqueued outside a request have no request ID.
+	if job.RequestID == "" {
+		job.RequestID = newRequestID()
+	}
+	fields := Fields{"request_id": job.RequestID, "webhook": job.WebhookID, "delivery": job.ID, "event": job.Event}
+	status, err := sendWebhook(job)
+	if err == nil {
+		webhookDeliveries.Inc("done")
+		_, err = db.Exec("UPDATE webhook_delivery SET status = 'done', attempts = attempts + 1, response_status = ?, last_error = '', updated_at = NOW() WHERE id = ?",
+			status, job.ID)
+		if err != nil {
+			logEntry(levelError, fields, "Failed to deliverWebhook1:", err)
+		}
+		_, err = db.Exec("UPDATE webhook SET failures = 0 WHERE id = ? AND failures > 0", job.WebhookID)
+		if err != nil {
+			logEntry(levelError, fields, "Failed to deliverWebhook2:", err)
+		}
+		return
+	}
+
+	logEntry(levelWarn, fields, "Failed to deliver webhook:", err)
+	result := "pending"
+	if job.Attempts+1 >= webhookMaxAttempts {
+		result = "failed"
+	}
+	webhookDeliveries.Inc(result)
+	next := time.Now().Add(webhookBackoff(job.Attempts))
+	_, err = db.Exec("UPDATE webhook_delivery SET status = ?, attempts = attempts + 1, next_attempt_at = ?, response_status = ?, last_error = ?, updated_at = NOW() WHERE id = ?",
+		result, next, status, truncateRunes(err.Error(), 255), job.ID)
+	if err != nil {
+		logEntry(levelError, fields, "Failed to deliverWebhook3:", err)
+		// Still count the attempt and back off, or the delivery would be
+		// sent again on every poll.
+		_, err = db.Exec("UPDATE webhook_delivery SET status = ?, attempts = attempts + 1, next_attempt_at = ?, response_status = ?, last_error = 'unrecorded error', updated_at = NOW() WHERE id = ?",
+			result, next, status, job.ID)
+		if err != nil {
+			logEntry(levelError, fields, "Failed to deliverWebhook4:", err)
+			return
+		}
+	}
+	if result == "failed" {
+		if err := recordWebhookFailure(job.WebhookID); err != nil {
+			logEntry(levelError, fields, "Failed to deliverWebhook5:", err)
+		}
+	}
+}
+
+// recordWebhookFailure counts a delivery that failed every attempt and
+// disables the webhook once webhookDisableAfter have failed in a row,
+// failing whatever it still has queued.
+func recordWebhookFailure(webhookID int64) error {
+	_, err := db.Exec("UPDATE webhook SET failures = failures + 1 WHERE id = ?", webhookID)
+	if err != nil {
+		return err
+	}
+	reason := fmt.Sprintf("%d deliveries in a row failed", webhookDisableAfter)
+	res, err := db.Exec("UPDATE webhook SET active = 0, disabled_reason = ?, updated_at = NOW() WHERE id = ? AND active = 1 AND failures >= ?",
+		reason, webhookID, webhookDisableAfter)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	log.Println("Disabled webhook", webhookID, "after", webhookDisableAfter, "failed deliveries")
+	_, err = db.Exec("UPDATE webhook_delivery SET status = 'failed', last_error = 'webhook disabled', updated_at = NOW() WHERE webhook_id = ? AND status = 'pending'",
+		webhookID)
+	return err
+}
+
+// runWebhooksOnce delivers the deliveries that are due, several at a
+// time.
+func runWebhooksOnce() error {
+	var jobs []webhookJob
+	err := db.Select(&jobs,
+		"SELECT d.*, w.url, w.secret FROM webhook_delivery d JOIN webhook w ON w.id = d.webhook_id"+
+			" WHERE d.source = ? AND d.status = 'pending' AND d.next_attempt_at <= NOW() ORDER BY d.next_attempt_at LIMIT ?",
+		me, webhookBatch)
+	if err != nil {
+		return err
+	}
+	sem := make(chan struct{}, webhookWorkers)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job webhookJob) {
+			defer wg.Done()
+			deliverWebhook(job)
+			<-sem
+		}(job)
+	}
+	wg.Wait()
+	return nil
+}
+
+// startWebhookWorker delivers queued events and prunes the delivery log.
+func startWebhookWorker() {
+	runPeriodically(webhookPollInterval, func() {
+		if err := runWebhooksOnce(); err != nil {
+			log.Println("Failed to runWebhooksOnce:", err)
+		}
+	})
+	runPeriodically(webhookPruneInterval, func() {
+		_, err := db.Exec("DELETE FROM webhook_delivery WHERE source = ? AND status <> 'pending' AND updated_at < ?",
+			me, time.Now().Add(-webhookLogRetention))
+		if err != nil {
+			log.Println("Failed to prune webhook deliveries:", err)
+		}
+	})
+}
+
+// validWebhookURL reports whether s is an absolute HTTPS URL that does
+// not name a non-public address.
+func validWebhookURL(s string) bool {
+	if len(s) > webhookMaxURL {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return false
+	}
+	// Names are checked when dialed; literal addresses can be refused
+	// up front.
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !publicIP(ip) {
+		return false
+	}
+	return true
+}
+
+// ensureChannelManager returns the logged-in user and the channel named
+// by the channel_id parameter if the user owns it or is an admin. Like
+// ensureAdmin, anything but a GET must carry the session's CSRF token.
+func ensureChannelManager(c echo.Context, txn *Transaction) (*User, *ChannelInfo, error) {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return nil, nil, err
+	}
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return nil, nil, ErrBadReqeust
+	}
+	ch, err := queryChannelInfo(txn, chID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ch == nil {
+		return nil, nil, echo.ErrNotFound
+	}
+	if !self.IsAdmin && ch.OwnerID != self.ID {
+		return nil, nil, echo.ErrForbidden
+	}
+	if c.Request().Method != http.MethodGet && !validCSRF(c) {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden, "invalid CSRF token")
+	}
+	return self, ch, nil
+}
+
+// channelWebhook returns the webhook named by the webhook_id parameter if
+// it belongs to the channel.
+func channelWebhook(c echo.Context, txn *Transaction, ch *ChannelInfo) (*Webhook, error) {
+	id, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return nil, ErrBadReqeust
+	}
+	var w Webhook
+	s := StartMySQLSegment(txn, "webhook", "SELECT")
+	err = db.Get(&w, "SELECT * FROM webhook WHERE id = ? AND channel_id = ?", id, ch.ID)
+	s.End()
+	if err != nil {
+		return nil, echo.ErrNotFound
+	}
+	return &w, nil
+}
+
+// request handlers
+
+func getChannelWebhooks(c echo.Context) error {
+	txn := app.StartTransaction("getChannelWebhooks", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, ch, err := ensureChannelManager(c, txn)
+	if self == nil {
+		return err
+	}
+	return renderChannelWebhooks(c, txn, self, ch, map[string]interface{}{
+		"Created": c.QueryParam("created"),
+	})
+}
+
+// renderChannelWebhooks renders the webhook settings page of a channel
+// with extra template data.
+func renderChannelWebhooks(c echo.Context, txn *Transaction, self *User, ch *ChannelInfo, data map[string]interface{}) error {
+	hooks := []Webhook{}
+	s := StartMySQLSegment(txn, "webhook", "SELECT")
+	err := db.Select(&hooks, "SELECT * FROM webhook WHERE channel_id = ? ORDER BY id", ch.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to renderChannelWebhooks1:", err)
+		return err
+	}
+	for i := range hooks {
+		s := StartMySQLSegment(txn, "webhook_delivery", "SELECT")
+		err := db.Select(&hooks[i].Deliveries,
+			"SELECT * FROM webhook_delivery WHERE webhook_id = ? ORDER BY id DESC LIMIT ?", hooks[i].ID, webhookRecentLog)
+		s.End()
+		if err != nil {
+			txn.Error("Failed to renderChannelWebhooks2:", err)
+			return err
+		}
+	}
+
+	incoming := []IncomingWebhook{}
+	s = StartMySQLSegment(txn, "incoming_webhook", "SELECT")
+	err = db.Select(&incoming, "SELECT * FROM incoming_webhook WHERE channel_id = ? ORDER BY id", ch.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to renderChannelWebhooks3:", err)
+		return err
+	}
+
+	channels, err := queryChannelInfos(txn)
+	if err != nil {
+		txn.Error("Failed to renderChannelWebhooks4:", err)
+		return err
+	}
+	data["ChannelID"] = ch.ID
+	data["Channels"] = channels
+	data["User"] = self
+	data["Channel"] = ch
+	data["Webhooks"] = hooks
+	data["Events"] = webhookEvents
+	data["Incoming"] = incoming
+	return c.Render(http.StatusOK, "webhooks", data)
+}
+
+func postChannelWebhooks(c echo.Context) error {
+	txn := app.StartTransaction("postChannelWebhooks", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, ch, err := ensureChannelManager(c, txn)
+	if self == nil {
+		return err
+	}
+	target := c.FormValue("url")
+	if !validWebhookURL(target) {
+		return echo.NewHTTPError(http.StatusBadRequest, "url must be an https:// URL on a public host")
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return ErrBadReqeust
+	}
+	var events []string
+	for _, e := range webhookEvents {
+		for _, v := range form["events"] {
+			if v == e {
+				events = append(events, e)
+			}
+		}
+	}
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+
+	var n int
+	s := StartMySQLSegment(txn, "webhook", "SELECT")
+	err = db.Get(&n, "SELECT COUNT(*) FROM webhook WHERE channel_id = ?", ch.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelWebhooks1:", err)
+		return err
+	}
+	if n >= webhookMaxPerChannel {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("a channel can have at most %d webhooks", webhookMaxPerChannel))
+	}
+
+	s = StartMySQLSegment(txn, "webhook", "INSERT")
+	res, err := db.Exec(
+		"INSERT INTO webhook (channel_id, url, secret, events, active, failures, disabled_reason, created_by, created_at, updated_at)"+
+			" VALUES (?, ?, ?, ?, 1, 0, '', ?, NOW(), NOW())",
+		ch.ID, target, randomToken(), strings.Join(events, ","), self.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelWebhooks2:", err)
+		return err
+	}
+	id, _ := res.LastInsertId()
+	audit(txn, c, auditWebhookCreate, self, "channel", ch.ID, ch.Name,
+		fmt.Sprintf("webhook %d: %s (%s)", id, target, strings.Join(events, ",")))
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%d/webhooks?created=%d", ch.ID, id))
+}
+
+func postChannelWebhookDelete(c echo.Context) error {
+	txn := app.StartTransaction("postChannelWebhookDelete", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, ch, err := ensureChannelManager(c, txn)
+	if self == nil {
+		return err
+	}
+	w, err := channelWebhook(c, txn, ch)
+	if err != nil {
+		return err
+	}
+	s := StartMySQLSegment(txn, "webhook", "DELETE")
+	_, err = db.Exec("DELETE FROM webhook WHERE id = ?", w.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelWebhookDelete1:", err)
+		return err
+	}
+	s = StartMySQLSegment(txn, "webhook_delivery", "DELETE")
+	_, err = db.Exec("DELETE FROM webhook_delivery WHERE webhook_id = ?", w.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelWebhookDelete2:", err)
+	}
+	audit(txn, c, auditWebhookDelete, self, "channel", ch.ID, ch.Name, fmt.Sprintf("webhook %d: %s", w.ID, w.URL))
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%d/webhooks", ch.ID))
+}
+
+func postChannelWebhookEnable(c echo.Context) error {
+	txn := app.StartTransaction("postChannelWebhookEnable", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, ch, err := ensureChannelManager(c, txn)
+	if self == nil {
+		return err
+	}
+	w, err := channelWebhook(c, txn, ch)
+	if err != nil {
+		return err
+	}
+	s := StartMySQLSegment(txn, "webhook", "UPDATE")
+	_, err = db.Exec("UPDATE webhook SET active = 1, failures = 0, disabled_reason = '', updated_at = NOW() WHERE id = ?", w.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelWebhookEnable:", err)
+		return err
+	}
+	audit(txn, c, auditWebhookEnable, self, "channel", ch.ID, ch.Name, fmt.Sprintf("webhook %d: %s", w.ID, w.URL))
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%d/webhooks", ch.ID))
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Incoming webhooks let other systems post into a channel with a POST to
+// /hooks/<id>/<token>, no session needed. The body is a Slack-style
+// payload, as JSON or as a form field named payload. Each webhook posts
+// as a bot user of its own through addMessage, so its messages behave
+// like any other. Messages that override the name or icon are posted as
+// further bot users, one per combination, up to incomingMaxPersonas per
+// webhook. Only a hash of the token is stored; the URL is shown once
+// when the webhook is created.
+
+const (
+	incomingMaxBody     = 64 * 1024
+	incomingMaxPersonas = 20
+	incomingMaxName     = 64
+
+	// An icon_url override is fetched while the webhook request waits,
+	// once per persona, so it gets a much tighter budget than an upload.
+	incomingIconTimeout  = 2 * time.Second
+	incomingIconMaxBytes = 256 * 1024
+)
+
+var (
+	incomingIconClient = &http.Client{
+		Timeout:   incomingIconTimeout,
+		Transport: publicTransport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	errIncomingText    = errors.New("no_text")
+	errIncomingPayload = errors.New("invalid_payload")
+
+	// slackLink matches mrkdwn links and mentions like <url|label> and
+	// <!here>.
+	slackLink = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]+))?>`)
+)
+
+type IncomingWebhook struct {
+	ID         int64      `db:"id"`
+	ChannelID  int64      `db:"channel_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	UserID     int64      `db:"user_id"`
+	CreatedBy  int64      `db:"created_by"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+}
+
+// IncomingWebhookPayload is the subset of Slack's incoming webhook
+// payload that is turned into a message. channel and icon_emoji are
+// accepted and ignored.
+type IncomingWebhookPayload struct {
+	Text        string               `json:"text"`
+	Username    string               `json:"username,omitempty"`
+	IconURL     string               `json:"icon_url,omitempty"`
+	IconEmoji   string               `json:"icon_emoji,omitempty"`
+	Channel     string               `json:"channel,omitempty"`
+	Attachments []IncomingAttachment `json:"attachments,omitempty"`
+	Blocks      []IncomingBlock      `json:"blocks,omitempty"`
+}
+
+type IncomingAttachment struct {
+	Fallback  string          `json:"fallback,omitempty"`
+	Pretext   string          `json:"pretext,omitempty"`
+	Title     string          `json:"title,omitempty"`
+	TitleLink string          `json:"title_link,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Fields    []IncomingField `json:"fields,omitempty"`
+	Footer    string          `json:"footer,omitempty"`
+}
+
+type IncomingField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+// IncomingBlock is a Block Kit block; section, header and context
+// blocks contribute their text.
+type IncomingBlock struct {
+	Type     string              `json:"type"`
+	Text     *IncomingBlockText  `json:"text,omitempty"`
+	Fields   []IncomingBlockText `json:"fields,omitempty"`
+	Elements []IncomingBlockText `json:"elements,omitempty"`
+}
+
+type IncomingBlockText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func incomingTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// slackText converts mrkdwn links and mentions to plain text and undoes
+// Slack's escaping of &, < and >.
+func slackText(s string) string {
+	s = slackLink.ReplaceAllStringFunc(s, func(m string) string {
+		sub := slackLink.FindStringSubmatch(m)
+		target, label := sub[1], sub[2]
+		switch {
+		case strings.HasPrefix(target, "!"):
+			if label != "" {
+				return label
+			}
+			return "@" + strings.TrimPrefix(target, "!")
+		case strings.HasPrefix(target, "@"), strings.HasPrefix(target, "#"):
+			if label != "" {
+				return target[:1] + label
+			}
+			return target
+		case label != "":
+			return label + " (" + target + ")"
+		}
+		return target
+	})
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(s)
+}
+
+// content renders the payload as message text.
+func (p *IncomingWebhookPayload) content() string {
+	var parts []string
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			parts = append(parts, slackText(s))
+		}
+	}
+	add(p.Text)
+	for _, b := range p.Blocks {
+		switch b.Type {
+		case "section", "header", "context":
+			if b.Text != nil {
+				add(b.Text.Text)
+			}
+			for _, f := range b.Fields {
+				add(f.Text)
+			}
+			for _, e := range b.Elements {
+				add(e.Text)
+			}
+		}
+	}
+	for _, a := range p.Attachments {
+		n := len(parts)
+		add(a.Pretext)
+		if a.TitleLink != "" && a.Title != "" {
+			add(a.Title + " (" + a.TitleLink + ")")
+		} else {
+			add(a.Title)
+		}
+		add(a.Text)
+		for _, f := range a.Fields {
+			if f.Title != "" {
+				add(f.Title + ": " + f.Value)
+			} else {
+				add(f.Value)
+			}
+		}
+		add(a.Footer)
+		if len(parts) == n {
+			add(a.Fallback)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// readIncomingPayload reads a JSON body, or a form with the JSON in its
+// payload field as Slack also accepts.
+func readIncomingPayload(c echo.Context) (*IncomingWebhookPayload, error) {
+	var data []byte
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		b, err := ioutil.ReadAll(c.Request().Body)
+		if err != nil {
+			return nil, err
+		}
+		data = b
+	} else {
+		data = []byte(c.FormValue("payload"))
+	}
+	var p IncomingWebhookPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, errIncomingPayload
+	}
+	return &p, nil
+}
+
+// createBotUser makes a user that cannot log in, for posting as a
+// webhook. A random suffix keeps its name clear of registered users.
+func createBotUser(txn *Transaction, webhookID int64, displayName, avatar string) (int64, error) {
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("hook%d-%s", webhookID, strings.ToLower(randomString(8)))
+		if avatar == "" {
+			a, err := generateAvatar(txn, name)
+			if err != nil {
+				txn.Error("Failed to generate avatar:", err)
+				a = defaultIcon
+			}
+			avatar = a
+		}
+		// An empty password digest matches no password.
+		id, err := userStore.Create(txn, name, randomString(20), "", displayName, avatar)
+		if err == errDuplicateName && i < 3 {
+			continue
+		}
+		return id, err
+	}
+}
+
+// fetchIncomingIcon stores the image at an icon_url override as an avatar
+// and returns its name.
+func fetchIncomingIcon(txn *Transaction, iconURL string) (string, error) {
+	if !validWebhookURL(iconURL) {
+		return "", fmt.Errorf("icon_url must be https on a public host: %q", iconURL)
+	}
+	resp, err := incomingIconClient.Get(iconURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("icon_url: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, incomingIconMaxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > incomingIconMaxBytes {
+		return "", errUploadTooLarge
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", errAvatarFormat
+	}
+	data, ext, err := normalizeAvatar(bytes.NewReader(data), avatarFormatExts[format])
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%x%s", sha1.Sum(data), ext)
+	if err := saveAvatar(txn, name, data); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// incomingPersona returns the bot user to post as for a payload's
+// username and icon_url overrides, creating it on first use. Past
+// incomingMaxPersonas the webhook's own user is used.
+func incomingPersona(txn *Transaction, w *IncomingWebhook, username, iconURL string) (int64, error) {
+	if username == "" && iconURL == "" {
+		return w.UserID, nil
+	}
+	key := fmt.Sprintf("%x", sha1.Sum([]byte(username+"\n"+iconURL)))
+	var userID int64
+	s := StartMySQLSegment(txn, "incoming_webhook_user", "SELECT")
+	err := db.Get(&userID, "SELECT user_id FROM incoming_webhook_user WHERE webhook_id = ? AND persona = ?", w.ID, key)
+	s.End()
+	if err == nil {
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var n int
+	s = StartMySQLSegment(txn, "incoming_webhook_user", "SELECT")
+	err = db.Get(&n, "SELECT COUNT(*) FROM incoming_webhook_user WHERE webhook_id = ?", w.ID)
+	s.End()
+	if err != nil {
+		return 0, err
+	}
+	if n >= incomingMaxPersonas {
+		txn.Error("Failed to incomingPersona: too many personas for incoming webhook", w.ID)
+		return w.UserID, nil
+	}
+
+	displayName := username
+	if displayName == "" {
+		displayName = w.Name
+	}
+	var avatar string
+	if iconURL != "" {
+		avatar, err = fetchIncomingIcon(txn, iconURL)
+		if err != nil {
+			txn.Error("Failed to fetchIncomingIcon:", err)
+		}
+	}
+	if avatar == "" {
+		u, err := getUser(txn, w.UserID)
+		if err != nil {
+			return 0, err
+		}
+		if u != nil {
+			avatar = u.AvatarIcon
+		}
+	}
+	userID, err = createBotUser(txn, w.ID, displayName, avatar)
+	if err != nil {
+		return 0, err
+	}
+	// A concurrent request may have created the persona first; both then
+	// use the one recorded.
+	s = StartMySQLSegment(txn, "incoming_webhook_user", "INSERT")
+	_, err = db.Exec("INSERT IGNORE INTO incoming_webhook_user (webhook_id, persona, user_id) VALUES (?, ?, ?)",
+		w.ID, key, userID)
+	s.End()
+	if err != nil {
+		return 0, err
+	}
+	s = StartMySQLSegment(txn, "incoming_webhook_user", "SELECT")
+	err = db.Get(&userID, "SELECT user_id FROM incoming_webhook_user WHERE webhook_id = ? AND persona = ?", w.ID, key)
+	s.End()
+	return userID, err
+}
+
+// request handlers
+
+// postIncomingWebhook answers like Slack: "ok", or an error code as
+// plain text.
+func postIncomingWebhook(c echo.Context) error {
+	txn := app.StartTransaction("postIncomingWebhook", c.Response().Writer, c.Request())
+	defer txn.End()
+	id, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusNotFound, "no_service")
+	}
+	var w IncomingWebhook
+	s := StartMySQLSegment(txn, "incoming_webhook", "SELECT")
+	err = db.Get(&w, "SELECT * FROM incoming_webhook WHERE id = ?", id)
+	s.End()
+	if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "no_service")
+	}
+	if err != nil {
+		txn.Error("Failed to postIncomingWebhook1:", err)
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(incomingTokenHash(c.Param("token"))), []byte(w.TokenHash)) != 1 {
+		return c.String(http.StatusNotFound, "no_service")
+	}
+	ch, err := queryChannelInfo(txn, w.ChannelID)
+	if err != nil {
+		txn.Error("Failed to postIncomingWebhook2:", err)
+		return err
+	}
+	if ch == nil {
+		return c.String(http.StatusNotFound, "channel_not_found")
+	}
+
+	p, err := readIncomingPayload(c)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			return c.String(http.StatusRequestEntityTooLarge, "payload_too_large")
+		}
+		return c.String(http.StatusBadRequest, errIncomingPayload.Error())
+	}
+	content := p.content()
+	if content == "" {
+		return c.String(http.StatusBadRequest, errIncomingText.Error())
+	}
+	userID, err := incomingPersona(txn, &w, truncateRunes(strings.TrimSpace(p.Username), incomingMaxName), p.IconURL)
+	if err != nil {
+		txn.Error("Failed to postIncomingWebhook3:", err)
+		return err
+	}
+	if _, err := addMessage(txn, ch.ID, userID, content); err != nil {
+		return err
+	}
+	s = StartMySQLSegment(txn, "incoming_webhook", "UPDATE")
+	_, err = db.Exec("UPDATE incoming_webhook SET last_used_at = NOW() WHERE id = ?", w.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postIncomingWebhook4:", err)
+	}
+	return c.String(http.StatusOK, "ok")
+}
+
+func postChannelIncomingWebhooks(c echo.Context) error {
+	txn := app.StartTransaction("postChannelIncomingWebhooks", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, ch, err := ensureChannelManager(c, txn)
+	if self == nil {
+		return err
+	}
+	name := truncateRunes(strings.TrimSpace(c.FormValue("name")), incomingMaxName)
+	if name == "" {
+		return ErrBadReqeust
+	}
+
+	var n int
+	s := StartMySQLSegment(txn, "incoming_webhook", "SELECT")
+	err = db.Get(&n, "SELECT COUNT(*) FROM incoming_webhook WHERE channel_id = ?", ch.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelIncomingWebhooks1:", err)
+		return err
+	}
+	if n >= webhookMaxPerChannel {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("a channel can have at most %d incoming webhooks", webhookMaxPerChannel))
+	}
+
+	token := randomToken()
+	s = StartMySQLSegment(txn, "incoming_webhook", "INSERT")
+	res, err := db.Exec(
+		"INSERT INTO incoming_webhook (channel_id, name, token_hash, user_id, created_by, created_at) VALUES (?, ?, ?, 0, ?, NOW())",
+		ch.ID, name, incomingTokenHash(token), self.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelIncomingWebhooks2:", err)
+		return err
+	}
+	id, _ := res.LastInsertId()
+	userID, err := createBotUser(txn, id, name, "")
+	if err != nil {
+		txn.Error("Failed to postChannelIncomingWebhooks3:", err)
+		return err
+	}
+	s = StartMySQLSegment(txn, "incoming_webhook", "UPDATE")
+	_, err = db.Exec("UPDATE incoming_webhook SET user_id = ? WHERE id = ?", userID, id)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelIncomingWebhooks4:", err)
+		return err
+	}
+	audit(txn, c, auditIncomingCreate, self, "channel", ch.ID, ch.Name, fmt.Sprintf("incoming webhook %d: %s", id, name))
+
+	// The token is only known now, so the page is rendered instead of
+	// redirecting.
+	return renderChannelWebhooks(c, txn, self, ch, map[string]interface{}{
+		"IncomingURL": fmt.Sprintf("%s://%s/hooks/%d/%s", c.Scheme(), c.Request().Host, id, token),
+	})
+}
+
+func postChannelIncomingWebhookDelete(c echo.Context) error {
+	txn := app.StartTransaction("postChannelIncomingWebhookDelete", c.Response().Writer, c.Request())
+	defer txn.End()
+	self, ch, err := ensureChannelManager(c, txn)
+	if self == nil {
+		return err
+	}
+	id, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	var w IncomingWebhook
+	s := StartMySQLSegment(txn, "incoming_webhook", "SELECT")
+	err = db.Get(&w, "SELECT * FROM incoming_webhook WHERE id = ? AND channel_id = ?", id, ch.ID)
+	s.End()
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	// Bot users are kept; their messages still refer to them.
+	s = StartMySQLSegment(txn, "incoming_webhook", "DELETE")
+	_, err = db.Exec("DELETE FROM incoming_webhook WHERE id = ?", w.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelIncomingWebhookDelete1:", err)
+		return err
+	}
+	s = StartMySQLSegment(txn, "incoming_webhook_user", "DELETE")
+	_, err = db.Exec("DELETE FROM incoming_webhook_user WHERE webhook_id = ?", w.ID)
+	s.End()
+	if err != nil {
+		txn.Error("Failed to postChannelIncomingWebhookDelete2:", err)
+	}
+	audit(txn, c, auditIncomingDelete, self, "channel", ch.ID, ch.Name, fmt.Sprintf("incoming webhook %d: %s", w.ID, w.Name))
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%d/webhooks", ch.ID))
+}